@@ -0,0 +1,81 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+)
+
+// SecretAccessor provides the payloads of secrets, e.g. the Git provider token and the signing key.
+type SecretAccessor interface {
+	// AccessSecretVersion returns the payload of the secret version with the provided resource name, e.g.
+	// "projects/{project-number}/secrets/{secret-name}/versions/{version-number}".
+	AccessSecretVersion(ctx context.Context, name string) ([]byte, error)
+}
+
+// ArtifactStore stores the artifacts and the result of a deploy request, where Cloud Deploy expects them.
+type ArtifactStore interface {
+	// UploadArtifact uploads the content as a deploy artifact and returns its URI. The objectSuffix
+	// determines the name of the artifact.
+	UploadArtifact(ctx context.Context, objectSuffix string, content *clouddeploy.GCSUploadContent) (string, error)
+	// UploadResult uploads the deploy result and returns its URI.
+	UploadResult(ctx context.Context, result *clouddeploy.DeployResult) (string, error)
+}
+
+// secretManagerAccessor implements SecretAccessor with Secret Manager.
+type secretManagerAccessor struct {
+	client *secretmanager.Client
+}
+
+// AccessSecretVersion downloads the Secret Manager SecretVersion, verifies the data checksum and
+// provides the data payload.
+func (s *secretManagerAccessor) AccessSecretVersion(ctx context.Context, name string) ([]byte, error) {
+	res, err := s.client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to access secret version %s: %v", name, err)
+	}
+
+	crc32c := crc32.MakeTable(crc32.Castagnoli)
+	checksum := int64(crc32.Checksum(res.Payload.Data, crc32c))
+	if checksum != *res.Payload.DataCrc32C {
+		return nil, fmt.Errorf("secret version response failed CRC-32 checksum validation; possible data corruption")
+	}
+	return res.Payload.Data, nil
+}
+
+// gcsArtifactStore implements ArtifactStore with the Cloud Storage paths of the deploy request.
+type gcsArtifactStore struct {
+	req       *clouddeploy.DeployRequest
+	gcsClient *storage.Client
+}
+
+// UploadArtifact uploads the content to the deploy output Cloud Storage path.
+func (s *gcsArtifactStore) UploadArtifact(ctx context.Context, objectSuffix string, content *clouddeploy.GCSUploadContent) (string, error) {
+	return s.req.UploadArtifact(ctx, s.gcsClient, objectSuffix, content)
+}
+
+// UploadResult uploads the deploy result to the deploy output Cloud Storage path.
+func (s *gcsArtifactStore) UploadResult(ctx context.Context, result *clouddeploy.DeployResult) (string, error) {
+	return s.req.UploadResult(ctx, s.gcsClient, result)
+}
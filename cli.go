@@ -0,0 +1,280 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	provider "github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/git-ops/git-deployer/providers"
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+)
+
+// Subcommands for running the deployer from the command line, e.g. from a laptop or CI, instead of Cloud Deploy.
+const (
+	deployCommand   = "deploy"
+	planCommand     = "plan"
+	renderCommand   = "render"
+	validateCommand = "validate"
+)
+
+// paramFlag maps a command line flag to the environment variable of a parameter.
+type paramFlag struct {
+	name  string
+	key   string
+	usage string
+	// Whether the flag may be provided without a value, e.g. "--enable-tag".
+	isBool bool
+}
+
+// paramFlags are the command line flags for the parameters. Parameters not provided as flags are read from
+// the environment variables, so the same configuration as for Cloud Deploy can be used.
+var paramFlags = []paramFlag{
+	{name: "source-repo", key: gitSourceRepoEnvKey, usage: "source repository, e.g. github.com/{owner}/{repo}"},
+	{name: "source-branch", key: gitSourceBranchEnvKey, usage: "branch of the source repository"},
+	{name: "output-repo", key: gitOutputRepoEnvKey, usage: "repository the hydrated manifests are pushed to"},
+	{name: "output-branch", key: gitOutputBranchEnvKey, usage: "branch of the output repository"},
+	{name: "secret", key: gitSecretEnvKey, usage: "Git provider token, as file:{path} or env:{variable}"},
+	{name: "username", key: gitUsernameEnvKey, usage: "Git username"},
+	{name: "email", key: gitEmailEnvKey, usage: "Git email"},
+	{name: "commit-message", key: gitCommitMessageEnvKey, usage: "commit message"},
+	{name: "pull-request-title", key: gitPullRequestTitleEnvKey, usage: "pull request title"},
+	{name: "pull-request-body", key: gitPullRequestBodyEnvKey, usage: "pull request body"},
+	{name: "enable-pull-request-merge", key: gitEnablePullRequestMergeEnvKey, usage: "merge the pull requests", isBool: true},
+	{name: "backend", key: gitBackendEnvKey, usage: "git backend, cli or native"},
+	{name: "clone-depth", key: gitCloneDepthEnvKey, usage: "clone depth, 0 for a full clone"},
+	{name: "clone-single-branch", key: gitCloneSingleBranchEnvKey, usage: "clone only the configured branch", isBool: true},
+	{name: "sparse-checkout", key: gitSparseCheckoutEnvKey, usage: "check out only the paths used for hydration", isBool: true},
+	{name: "signing-key-secret", key: gitSigningKeySecretEnvKey, usage: "commit signing key, as file:{path} or env:{variable}"},
+	{name: "push-retries", key: gitPushRetriesEnvKey, usage: "retries of a rejected push"},
+	{name: "enable-notes", key: gitEnableNotesEnvKey, usage: "attach rollout git notes to commits", isBool: true},
+	{name: "lock-dir", key: gitLockDirEnvKey, usage: "local directory to store rollout locks in instead of Cloud Storage"},
+	{name: "lock-ttl", key: gitLockTTLEnvKey, usage: "time after which an unrefreshed rollout lock is stale"},
+	{name: "rate-limit-max-wait", key: gitRateLimitMaxWaitEnvKey, usage: "total time a Git provider API request may be paused because of rate limits"},
+	{name: "lock-wait-timeout", key: gitLockWaitTimeoutEnvKey, usage: "how long to wait for a held rollout lock"},
+	{name: "enable-deployments", key: gitEnableDeploymentsEnvKey, usage: "create Git provider deployments", isBool: true},
+	{name: "deployment-environment", key: gitDeploymentEnvironmentEnvKey, usage: "Git provider deployment environment"},
+	{name: "enable-tag", key: gitEnableTagEnvKey, usage: "tag the output repository once all batches complete", isBool: true},
+	{name: "tag-name", key: gitTagNameEnvKey, usage: "name of the output repository tag"},
+	{name: "source-of-truth", key: hydrationSourceOfTruthEnvKey, usage: "path of the source of truth"},
+	{name: "source-of-truth-format", key: hydrationSourceOfTruthFormatEnvKey, usage: "format of the source of truth, csv, yaml, json or yaml-dir"},
+	{name: "base-dir", key: hydrationBaseDirEnvKey, usage: "path of the base library"},
+	{name: "overlay-dir", key: hydrationOverlayDirEnvKey, usage: "path of the overlays"},
+	{name: "hydration-output-dir", key: hydrationOutputDirEnvKey, usage: "path of the hydrated manifests in the output repository"},
+	{name: "cluster-group", key: hydrationClusterGroupEnvKey, usage: "cluster group to roll out to"},
+	{name: "batch-size", key: hydrationBatchSizeEnvKey, usage: "number or percentage of clusters per batch, 0 for a single batch, or a progressive schedule, e.g. 1,5,25%,100%"},
+	{name: "wait-time-between-batches", key: hydrationWaitTimeBetweenBatchesEnvKey, usage: "time to wait between batches"},
+	{name: "wave-column", key: hydrationWaveColumnEnvKey, usage: "source of truth column grouping clusters into waves rolled out in order"},
+	{name: "wave-batch-sizes", key: hydrationWaveBatchSizesEnvKey, usage: "comma separated batch sizes of waves, e.g. 1=1,2=25%"},
+	{name: "batch-strategy", key: hydrationBatchStrategyEnvKey, usage: "strategy grouping clusters into batches, sequential or topology"},
+	{name: "topology-column", key: hydrationTopologyColumnEnvKey, usage: "source of truth column with the failure domain of clusters for the topology batch strategy"},
+	{name: "max-clusters-per-domain", key: hydrationMaxClustersPerDomainEnvKey, usage: "maximum number of clusters of a failure domain per batch for the topology batch strategy"},
+	{name: "maintenance-window-column", key: hydrationMaintenanceWindowColumnEnvKey, usage: "source of truth column with the maintenance windows of clusters"},
+	{name: "maintenance-window-max-wait", key: hydrationMaintenanceWindowMaxWaitEnvKey, usage: "maximum time to wait for the maintenance windows of a batch"},
+	{name: "deploy-timeout", key: hydrationDeployTimeoutEnvKey, usage: "execution timeout of the deploy, after which maintenance windows are not waited for"},
+	{name: "maintenance-batch-duration", key: hydrationMaintenanceBatchDurationEnvKey, usage: "time a batch takes to be published within the maintenance windows of its clusters"},
+	{name: "platform-revision", key: hydrationPlatformRevisionEnvKey, usage: "platform revision to roll out"},
+	{name: "workload-revision", key: hydrationWorkloadRevisionEnvKey, usage: "workload revision to roll out"},
+	{name: "match-clusters-having-any-listed-tag", key: matchClustersHavingAnyListedTagEnvKey, usage: "comma separated tags, of which clusters must have any"},
+	{name: "match-clusters-having-all-listed-tags", key: matchClustersHavingAllListedTagsEnvKey, usage: "comma separated tags, of which clusters must have all"},
+	{name: "match-cluster-names", key: matchClusterNamesEnvKey, usage: "comma separated cluster names, globs or /regular expressions/, of which selected clusters must match any"},
+	{name: "exclude-cluster-names", key: excludeClusterNamesEnvKey, usage: "comma separated cluster names, globs or /regular expressions/ of clusters to exclude"},
+	{name: "exclude-clusters-having-tags", key: excludeClustersHavingTagsEnvKey, usage: "comma separated tags of clusters to exclude"},
+	{name: "match-clusters-expression", key: matchClustersExpressionEnvKey, usage: "selector expression clusters must match, e.g. 'region=us AND NOT frozen'"},
+}
+
+// paramValue is a flag.Value setting a parameter.
+type paramValue struct {
+	values map[string]string
+	flag   paramFlag
+}
+
+func (v *paramValue) String() string {
+	return ""
+}
+
+func (v *paramValue) Set(s string) error {
+	v.values[v.flag.key] = s
+	return nil
+}
+
+func (v *paramValue) IsBoolFlag() bool {
+	return v.flag.isBool
+}
+
+// commandOptions are the options of a subcommand.
+type commandOptions struct {
+	// Parameter values provided as flags, by environment variable name.
+	params map[string]string
+	// Cloud Deploy request fields.
+	project, location, pipeline, release, rollout, target string
+	// Directory deploy results and artifacts are written to. Results are written to stdout if not set.
+	resultsDir string
+	// Directory hydrated manifests are written to by the render subcommand.
+	outputDir string
+	// Local checkout of the source repository validated by the validate subcommand.
+	sourceDir string
+}
+
+// newCommandFlagSet returns the flag set of the subcommand, which populates the options.
+func newCommandFlagSet(command string, opts *commandOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	opts.params = map[string]string{}
+	for _, f := range paramFlags {
+		fs.Var(&paramValue{values: opts.params, flag: f}, f.name, f.usage)
+	}
+	fs.Func("secret-file", "file containing the Git provider token, same as --secret=file:{path}", func(s string) error {
+		opts.params[gitSecretEnvKey] = "file:" + s
+		return nil
+	})
+	fs.Func("secret-env", "environment variable containing the Git provider token, same as --secret=env:{variable}", func(s string) error {
+		opts.params[gitSecretEnvKey] = "env:" + s
+		return nil
+	})
+	fs.StringVar(&opts.project, "project", "local", "project recorded in commit metadata")
+	fs.StringVar(&opts.location, "location", "local", "location recorded in commit metadata")
+	fs.StringVar(&opts.pipeline, "pipeline", "local", "delivery pipeline recorded in commit metadata")
+	fs.StringVar(&opts.release, "release", "local", "release recorded in commit metadata and tag names")
+	fs.StringVar(&opts.rollout, "rollout", fmt.Sprintf("local-%d", time.Now().Unix()), "rollout, used as prefix of the feature branches")
+	fs.StringVar(&opts.target, "target", "local", "target recorded in commit metadata")
+	switch command {
+	case deployCommand:
+		fs.StringVar(&opts.resultsDir, "results-dir", "", "directory to write the deploy result and artifacts to, instead of stdout")
+	case validateCommand:
+		fs.StringVar(&opts.sourceDir, "source-dir", "", "local checkout of the source repository to validate, instead of cloning it")
+	case renderCommand:
+		fs.StringVar(&opts.outputDir, "output-dir", "rendered", "empty directory to write the hydrated manifests to")
+	}
+	return fs
+}
+
+// lookup returns the value of the parameter with the environment variable name, preferring flags over the
+// environment.
+func (o *commandOptions) lookup(key string) (string, bool) {
+	if v, ok := o.params[key]; ok {
+		return v, true
+	}
+	return os.LookupEnv(key)
+}
+
+// runCommand runs the subcommand in args[0] with the flags in args[1:].
+func runCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	command := args[0]
+	switch command {
+	case deployCommand, planCommand, renderCommand, validateCommand:
+	default:
+		return fmt.Errorf("unknown command %q, must be one of %s, %s, %s or %s", command, deployCommand, planCommand, renderCommand, validateCommand)
+	}
+
+	opts := &commandOptions{}
+	fs := newCommandFlagSet(command, opts)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	// Locks are stored in a local directory unless a Cloud Storage path, also stored locally, is provided.
+	_, dirOK := opts.lookup(gitLockDirEnvKey)
+	if _, gcsOK := opts.lookup(gitLockGCSPathEnvKey); !dirOK && !gcsOK {
+		opts.params[gitLockDirEnvKey] = filepath.Join(os.TempDir(), defaultLockDir)
+	}
+	params, err := determineParamsFrom(opts.lookup)
+	if err != nil {
+		return fmt.Errorf("unable to determine params: %v", err)
+	}
+	d := &deployer{
+		req: &clouddeploy.DeployRequest{
+			Project:  opts.project,
+			Location: opts.location,
+			Pipeline: opts.pipeline,
+			Release:  opts.release,
+			Rollout:  opts.rollout,
+			Target:   opts.target,
+		},
+		params:    params,
+		secrets:   &cliSecretAccessor{},
+		artifacts: &stdoutArtifactStore{w: stdout},
+		lockStore: &localLockStore{dir: filepath.Join(os.TempDir(), defaultLockDir)},
+	}
+	if len(opts.resultsDir) != 0 {
+		d.artifacts = &localArtifactStore{dir: opts.resultsDir}
+	}
+
+	switch command {
+	case validateCommand:
+		dir := opts.sourceDir
+		if len(dir) == 0 {
+			w, err := d.openPreviewWorkspace(ctx)
+			if err != nil {
+				return err
+			}
+			defer w.cleanup()
+			dir = w.repo.info().dir
+		}
+		sot, err := openSourceOfTruth(dir, params.hydrationSourceOfTruth, params.hydrationSourceOfTruthFormat)
+		if err != nil {
+			return err
+		}
+		if err := validateSourceOfTruth(sot, params.hydrationSourceOfTruth); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Parameters and source of truth %s are valid\n", params.hydrationSourceOfTruth)
+		return nil
+
+	case planCommand:
+		plan, err := d.plan(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%d clusters would be updated in %d batches\n", len(plan.clusters), len(plan.batches))
+		for _, b := range plan.batches {
+			if len(b.wave) != 0 {
+				fmt.Fprintf(stdout, "%s (wave %s): %s\n", b.branch, b.wave, strings.Join(b.clusters, ", "))
+			} else {
+				fmt.Fprintf(stdout, "%s: %s\n", b.branch, strings.Join(b.clusters, ", "))
+			}
+		}
+		if len(plan.excluded) != 0 {
+			fmt.Fprintf(stdout, "excluded: %s\n", formatExclusions(plan.excluded))
+		}
+		return nil
+
+	case renderCommand:
+		clusters, err := d.renderPreview(ctx, opts.outputDir)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Rendered manifests of %d clusters to %s: %s\n", len(clusters), opts.outputDir, strings.Join(clusters, ", "))
+		return nil
+
+	default:
+		res, err := d.deploy(ctx)
+		if err != nil {
+			d.completeDeployments(ctx, provider.DeploymentFailure, fmt.Sprintf("Rollout %s failed", d.req.Rollout))
+			res = failedDeployResult(err)
+		}
+		if _, uErr := d.artifacts.UploadResult(ctx, res); uErr != nil {
+			return fmt.Errorf("error writing deploy results: %v", uErr)
+		}
+		return err
+	}
+}
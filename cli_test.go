@@ -0,0 +1,230 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupCommandRepo creates the source repository of the integration tests and returns the flags to run
+// a subcommand against it.
+func setupCommandRepo(t *testing.T) []string {
+	t.Helper()
+	root := t.TempDir()
+	createBareRemote(t, root, "owner", "platform", map[string]string{
+		"source_of_truth.csv":        integrationSourceOfTruth,
+		"base_library/base.yaml":     "kind: Namespace\n",
+		"overlays/prod/overlay.yaml": "kind: Namespace\n",
+	}, 1)
+	redirectRemotes(t, root, "github.com", "owner", "token")
+	t.Setenv("GIT_DEPLOYER_TEST_TOKEN", "token")
+	return []string{
+		"--source-repo=github.com/owner/platform",
+		"--source-branch=main",
+		"--output-repo=github.com/owner/hydrated",
+		"--output-branch=main",
+		"--secret-env=GIT_DEPLOYER_TEST_TOKEN",
+		"--cluster-group=prod",
+		"--batch-size=3",
+		"--platform-revision=v2",
+		"--rollout=rollout-1",
+	}
+}
+
+func TestRunCommandValidate(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv(gitSourceRepoEnvKey, "github.com/owner/platform")
+	t.Setenv(hydrationClusterGroupEnvKey, "dev")
+	sourceDir := t.TempDir()
+	writeTestFile(t, sourceDir, defaultSourceOfTruth, integrationSourceOfTruth)
+	flags := []string{
+		"--source-dir=" + sourceDir,
+		"--source-branch=main",
+		"--output-repo=github.com/owner/hydrated",
+		"--output-branch=main",
+		"--secret=env:TOKEN",
+		"--batch-size=1",
+		"--platform-revision=v2",
+		"--enable-pull-request-merge",
+		"--enable-tag",
+	}
+
+	var out bytes.Buffer
+	if err := runCommand(ctx, append([]string{validateCommand}, flags...), &out); err != nil {
+		t.Fatalf("Expected valid parameters, got: %v", err)
+	}
+	if got, want := out.String(), "Parameters and source of truth source_of_truth.csv are valid\n"; got != want {
+		t.Errorf("Unexpected output: %q", got)
+	}
+
+	// Flags take precedence over the environment.
+	opts := &commandOptions{}
+	if err := newCommandFlagSet(validateCommand, opts).Parse(append(flags, "--cluster-group=prod")); err != nil {
+		t.Fatal(err)
+	}
+	p, err := determineParamsFrom(opts.lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.hydrationClusterGroup != "prod" || p.gitSourceRepo != "github.com/owner/platform" || !p.enableTag {
+		t.Errorf("Unexpected params: cluster group %q, source repo %q, tag %v", p.hydrationClusterGroup, p.gitSourceRepo, p.enableTag)
+	}
+
+	if err := runCommand(ctx, append([]string{validateCommand}, flags[2:]...), &out); err == nil || !strings.Contains(err.Error(), gitSourceBranchEnvKey) {
+		t.Errorf("Expected missing source branch error, got: %v", err)
+	}
+	writeTestFile(t, sourceDir, defaultSourceOfTruth, integrationSourceOfTruth+"cluster1,dev,,v1,v1\n")
+	if err := runCommand(ctx, append([]string{validateCommand}, flags...), &out); err == nil || !strings.Contains(err.Error(), "line 7: duplicate cluster_name") {
+		t.Errorf("Expected source of truth error, got: %v", err)
+	}
+	if err := runCommand(ctx, []string{"apply"}, &out); err == nil {
+		t.Error("Expected unknown command error")
+	}
+}
+
+func TestRunCommandPlan(t *testing.T) {
+	flags := setupCommandRepo(t)
+
+	var out bytes.Buffer
+	if err := runCommand(context.Background(), append([]string{planCommand}, flags...), &out); err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	want := "4 clusters would be updated in 2 batches\n" +
+		"rollout-1__1/2: cluster1, cluster2, cluster4\n" +
+		"rollout-1__2/2: cluster5\n"
+	if got := out.String(); got != want {
+		t.Errorf("Plan mismatch\nExpected: %s\n     Got: %s", want, got)
+	}
+}
+
+func TestRunCommandPlanFilters(t *testing.T) {
+	flags := setupCommandRepo(t)
+	flags = append(flags, "--match-cluster-names=cluster1,/cluster[2-5]/", "--exclude-cluster-names=cluster4", "--exclude-clusters-having-tags=eu")
+
+	var out bytes.Buffer
+	if err := runCommand(context.Background(), append([]string{planCommand}, flags...), &out); err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	want := "1 clusters would be updated in 1 batches\n" +
+		"rollout-1__1/1: cluster1\n" +
+		"excluded: cluster2 (exclude-clusters-having-tags eu), cluster4 (exclude-cluster-names cluster4), cluster5 (exclude-clusters-having-tags eu)\n"
+	if got := out.String(); got != want {
+		t.Errorf("Plan mismatch\nExpected: %s\n     Got: %s", want, got)
+	}
+}
+
+func TestRunCommandRender(t *testing.T) {
+	flags := setupCommandRepo(t)
+	installFakeHydrate(t, fakeHydrateScript)
+	outputDir := filepath.Join(t.TempDir(), "rendered")
+
+	var out bytes.Buffer
+	if err := runCommand(context.Background(), append([]string{renderCommand, "--output-dir=" + outputDir}, flags...), &out); err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	for _, cluster := range []string{"cluster1", "cluster2", "cluster4", "cluster5"} {
+		manifest, err := os.ReadFile(filepath.Join(outputDir, cluster+".yaml"))
+		if err != nil {
+			t.Fatalf("Expected %s to be rendered: %v", cluster, err)
+		}
+		if !strings.Contains(string(manifest), "platform: v2") {
+			t.Errorf("Expected %s to be rendered with platform revision v2, got: %s", cluster, manifest)
+		}
+	}
+	// Clusters outside of the cluster group are not rendered.
+	if _, err := os.Stat(filepath.Join(outputDir, "cluster3.yaml")); !os.IsNotExist(err) {
+		t.Errorf("Expected cluster3 not to be rendered, got: %v", err)
+	}
+
+	// Rendering into a non-empty directory would delete its content.
+	err := runCommand(context.Background(), append([]string{renderCommand, "--output-dir=" + outputDir}, flags...), &out)
+	if err == nil || !strings.Contains(err.Error(), "must be empty") {
+		t.Errorf("Expected non-empty output directory error, got: %v", err)
+	}
+}
+
+func TestCLISecretAccessor(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeTestFile(t, dir, "token", "file-token\n")
+	t.Setenv("GIT_DEPLOYER_TEST_TOKEN", "env-token")
+	s := &cliSecretAccessor{}
+
+	for name, want := range map[string]string{
+		"file:" + filepath.Join(dir, "token"): "file-token",
+		"env:GIT_DEPLOYER_TEST_TOKEN":         "env-token",
+	} {
+		got, err := s.AccessSecretVersion(ctx, name)
+		if err != nil {
+			t.Fatalf("Failed to access secret %s: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("Secret %s mismatch\nExpected: %s\n     Got: %s", name, want, got)
+		}
+	}
+	for _, name := range []string{"projects/1/secrets/git/versions/1", "env:GIT_DEPLOYER_UNSET_TOKEN"} {
+		if _, err := s.AccessSecretVersion(ctx, name); err == nil {
+			t.Errorf("Expected error accessing secret %s", name)
+		}
+	}
+}
+
+func TestRunCommandPlanWaves(t *testing.T) {
+	flags := setupCommandRepo(t)
+	flags = append(flags, "--wave-column=cluster_tags", "--wave-batch-sizes=us=1")
+
+	var out bytes.Buffer
+	if err := runCommand(context.Background(), append([]string{planCommand}, flags...), &out); err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	want := "4 clusters would be updated in 3 batches\n" +
+		"rollout-1__1/3 (wave eu): cluster2, cluster5\n" +
+		"rollout-1__2/3 (wave us): cluster1\n" +
+		"rollout-1__3/3 (wave us): cluster4\n"
+	if got := out.String(); got != want {
+		t.Errorf("Plan mismatch\nExpected: %s\n     Got: %s", want, got)
+	}
+
+	err := runCommand(context.Background(), append([]string{planCommand}, append(flags, "--wave-column=rollout_wave")...), &out)
+	if err == nil || !strings.Contains(err.Error(), `no wave column "rollout_wave"`) {
+		t.Errorf("Expected missing wave column error, got: %v", err)
+	}
+}
+
+func TestRunCommandPlanTopology(t *testing.T) {
+	flags := setupCommandRepo(t)
+	flags = append(flags, "--batch-strategy=topology", "--topology-column=cluster_tags")
+
+	var out bytes.Buffer
+	if err := runCommand(context.Background(), append([]string{planCommand}, flags...), &out); err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	want := "4 clusters would be updated in 2 batches\n" +
+		"rollout-1__1/2: cluster1, cluster2\n" +
+		"rollout-1__2/2: cluster4, cluster5\n"
+	if got := out.String(); got != want {
+		t.Errorf("Plan mismatch\nExpected: %s\n     Got: %s", want, got)
+	}
+
+	err := runCommand(context.Background(), append([]string{planCommand}, append(flags, "--batch-strategy=random")...), &out)
+	if err == nil || !strings.Contains(err.Error(), "must be one of sequential or topology") {
+		t.Errorf("Expected invalid batch strategy error, got: %v", err)
+	}
+}
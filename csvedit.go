@@ -0,0 +1,196 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// csvCommentChar starts a comment row in a CSV source of truth. Comment rows are ignored when reading and kept
+// when updating revisions.
+const csvCommentChar = '#'
+
+// rawCSVRecord is a record of a CSV file with the byte offsets of its fields, so individual cells can be
+// replaced while keeping the rest of the file byte-for-byte.
+type rawCSVRecord struct {
+	// 1-based line number the record starts on.
+	line int
+	// Byte offsets of the record, including its line ending.
+	start, end int
+	fields     []rawCSVField
+}
+
+// rawCSVField is a field of a rawCSVRecord.
+type rawCSVField struct {
+	// Byte offsets of the field, including quotes.
+	start, end int
+	value      string
+	quoted     bool
+}
+
+// scanCSV parses the records of the CSV data following the rules of encoding/csv. Empty lines and comment
+// rows are skipped.
+func scanCSV(data []byte) ([]rawCSVRecord, error) {
+	var records []rawCSVRecord
+	line := 1
+	for pos := 0; pos < len(data); {
+		lineEnd := bytes.IndexByte(data[pos:], '\n')
+		if lineEnd == -1 {
+			lineEnd = len(data)
+		} else {
+			lineEnd += pos + 1
+		}
+		if data[pos] == csvCommentChar || len(bytes.TrimRight(data[pos:lineEnd], "\r\n")) == 0 {
+			pos = lineEnd
+			line++
+			continue
+		}
+
+		r := rawCSVRecord{line: line, start: pos}
+		for {
+			f := rawCSVField{start: pos}
+			if pos < len(data) && data[pos] == '"' {
+				f.quoted = true
+				var value strings.Builder
+				for pos++; ; pos++ {
+					if pos >= len(data) {
+						return nil, fmt.Errorf("line %d: extraneous or missing \" in quoted-field", r.line)
+					}
+					c := data[pos]
+					if c == '\n' {
+						line++
+					}
+					if c != '"' {
+						value.WriteByte(c)
+						continue
+					}
+					if pos+1 < len(data) && data[pos+1] == '"' {
+						value.WriteByte('"')
+						pos++
+						continue
+					}
+					pos++
+					break
+				}
+				// Like encoding/csv, line endings in quoted fields are normalized.
+				f.value = strings.ReplaceAll(value.String(), "\r\n", "\n")
+				if pos < len(data) && data[pos] != ',' && data[pos] != '\n' && !bytes.HasPrefix(data[pos:], []byte("\r\n")) {
+					return nil, fmt.Errorf("line %d: extraneous or missing \" in quoted-field", line)
+				}
+			} else {
+				for pos < len(data) && data[pos] != ',' && data[pos] != '\n' && !bytes.HasPrefix(data[pos:], []byte("\r\n")) {
+					if data[pos] == '"' {
+						return nil, fmt.Errorf("line %d: bare \" in non-quoted-field", line)
+					}
+					pos++
+				}
+				f.value = string(data[f.start:pos])
+			}
+			f.end = pos
+			r.fields = append(r.fields, f)
+			if pos < len(data) && data[pos] == ',' {
+				pos++
+				continue
+			}
+			break
+		}
+		switch {
+		case pos < len(data) && data[pos] == '\n':
+			pos++
+		case pos < len(data):
+			pos += 2
+		}
+		r.end = pos
+		records = append(records, r)
+		line++
+	}
+	return records, nil
+}
+
+// encodeCSVField returns the field as it is written to a CSV file. The field is quoted if it was quoted before
+// or needs to be.
+func encodeCSVField(value string, quoted bool) string {
+	if quoted || strings.ContainsAny(value, ",\"\r\n") || strings.HasPrefix(value, " ") || strings.HasPrefix(value, "\t") {
+		return `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+	}
+	return value
+}
+
+// updateCSVRevisions returns the CSV data with the non-empty revisions of the named clusters replaced. Only
+// the changed cells are rewritten, so quoting, line endings and comment rows are kept.
+func updateCSVRevisions(data []byte, clusterNames []string, platformRevision, workloadRevision string) ([]byte, error) {
+	records, err := scanCSV(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("source of truth is empty")
+	}
+	header := make([]string, len(records[0].fields))
+	for i, f := range records[0].fields {
+		header[i] = f.value
+	}
+	fieldIndices, err := findFieldIndices(header, clusterNameColumn, platformRevisionColumn, workloadRevisionColumn)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	last := 0
+	for _, r := range records[1:] {
+		if len(r.fields) != len(header) {
+			return nil, fmt.Errorf("line %d: has %d fields, expected %d", r.line, len(r.fields), len(header))
+		}
+		if !slices.Contains(clusterNames, r.fields[fieldIndices[clusterNameColumn]].value) {
+			continue
+		}
+		// The revision columns are written in the order they appear in the record.
+		edits := map[int]string{}
+		if len(platformRevision) > 0 {
+			edits[fieldIndices[platformRevisionColumn]] = platformRevision
+		}
+		if len(workloadRevision) > 0 {
+			edits[fieldIndices[workloadRevisionColumn]] = workloadRevision
+		}
+		for i, f := range r.fields {
+			rev, ok := edits[i]
+			if !ok || rev == f.value {
+				continue
+			}
+			b.Write(data[last:f.start])
+			b.WriteString(encodeCSVField(rev, f.quoted))
+			last = f.end
+		}
+	}
+	b.Write(data[last:])
+	return b.Bytes(), nil
+}
+
+// stripCSVComments returns the CSV data without empty lines and comment rows, for readers that do not support
+// them.
+func stripCSVComments(data []byte) ([]byte, error) {
+	records, err := scanCSV(data)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	for _, r := range records {
+		b.Write(data[r.start:r.end])
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// TestUpdateCSVRevisionsGolden updates cluster1 and cluster3 of every testdata/csvedit/*.csv file and compares
+// the result with the .golden file. Run with -update to regenerate the golden files.
+func TestUpdateCSVRevisionsGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "csvedit", "*.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("No test inputs found")
+	}
+	for _, input := range inputs {
+		t.Run(strings.TrimSuffix(filepath.Base(input), ".csv"), func(t *testing.T) {
+			data, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := updateCSVRevisions(data, []string{"cluster1", "cluster3"}, "v2.0.0", "main")
+			if err != nil {
+				t.Fatalf("Failed to update revisions: %v", err)
+			}
+
+			golden := input + ".golden"
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Updated CSV mismatch\nExpected: %q\n     Got: %q", want, got)
+			}
+
+			// The edit must be equivalent to updating the parsed records.
+			records := readCSVRecords(t, data)
+			updated := readCSVRecords(t, got)
+			header := records[0]
+			for _, record := range records[1:] {
+				if name := record[slices.Index(header, clusterNameColumn)]; name != "cluster1" && name != "cluster3" {
+					continue
+				}
+				record[slices.Index(header, platformRevisionColumn)] = "v2.0.0"
+				record[slices.Index(header, workloadRevisionColumn)] = "main"
+			}
+			if !reflect.DeepEqual(updated, records) {
+				t.Errorf("Updated records mismatch\nExpected: %v\n     Got: %v", records, updated)
+			}
+		})
+	}
+}
+
+func TestUpdateCSVRevisionsUnchanged(t *testing.T) {
+	data := []byte("# comment\r\ncluster_name,platform_repository_revision,workload_repository_revision\r\n\"cluster1\",v1,v1\r\n")
+	got, err := updateCSVRevisions(data, []string{"cluster1"}, "v1", "")
+	if err != nil {
+		t.Fatalf("Failed to update revisions: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Expected unchanged CSV, got: %q", got)
+	}
+}
+
+func TestUpdateCSVRevisionsErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"Empty":           "",
+		"Missing columns": "cluster_name,cluster_group\ncluster1,prod\n",
+		"Missing fields":  "cluster_name,platform_repository_revision,workload_repository_revision\ncluster1,v1\n",
+		"Unclosed quote":  "cluster_name,platform_repository_revision,workload_repository_revision\n\"cluster1,v1,v1\n",
+		"Bare quote":      "cluster_name,platform_repository_revision,workload_repository_revision\nclus\"ter1,v1,v1\n",
+	} {
+		if _, err := updateCSVRevisions([]byte(data), []string{"cluster1"}, "v2", "v2"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestEncodeCSVField(t *testing.T) {
+	for _, tc := range []struct {
+		value  string
+		quoted bool
+		want   string
+	}{
+		{"v1", false, "v1"},
+		{"v1", true, `"v1"`},
+		{"a,b", false, `"a,b"`},
+		{`say "hi"`, false, `"say ""hi"""`},
+		{" v1", false, `" v1"`},
+	} {
+		if got := encodeCSVField(tc.value, tc.quoted); got != tc.want {
+			t.Errorf("encodeCSVField(%q, %v) = %s, expected %s", tc.value, tc.quoted, got, tc.want)
+		}
+	}
+}
+
+// readCSVRecords parses CSV data as the deployer reads a source of truth.
+func readCSVRecords(t *testing.T, data []byte) [][]string {
+	t.Helper()
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comment = csvCommentChar
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse CSV: %v", err)
+	}
+	return records
+}
@@ -15,20 +15,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/csv"
+	"errors"
 	"fmt"
-	"hash/crc32"
-	"math"
+	"net/http"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
 	"time"
 
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
-	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
-	"cloud.google.com/go/storage"
 	provider "github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/git-ops/git-deployer/providers"
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
 )
@@ -37,8 +34,23 @@ import (
 type deployer struct {
 	req       *clouddeploy.DeployRequest
 	params    *params
-	gcsClient *storage.Client
-	smClient  *secretmanager.Client
+	secrets   SecretAccessor
+	artifacts ArtifactStore
+	// HTTP client used for Git provider API requests. If nil then a client with a default timeout is used.
+	httpClient *http.Client
+	// Deployments created in the Git provider for the batch currently being processed.
+	deployments []*batchDeployment
+	// Store for the rollout lock.
+	lockStore lockStore
+	// The batch currently being processed.
+	batch *rolloutBatch
+}
+
+// batchDeployment is a deployment created in a Git provider for the merge commit of a batch.
+type batchDeployment struct {
+	gitProvider provider.GitProvider
+	deployment  *provider.Deployment
+	environment string
 }
 
 const branchPrefix = "deploy-"
@@ -50,16 +62,9 @@ func (d *deployer) process(ctx context.Context) error {
 	res, err := d.deploy(ctx)
 	if err != nil {
 		fmt.Printf("Deploy failed: %v\n", err)
-		dr := &clouddeploy.DeployResult{
-			ResultStatus:   clouddeploy.DeployFailed,
-			FailureMessage: err.Error(),
-			Metadata: map[string]string{
-				clouddeploy.CustomTargetSourceMetadataKey:    gitDeployerSampleName,
-				clouddeploy.CustomTargetSourceSHAMetadataKey: clouddeploy.GitCommit,
-			},
-		}
+		d.completeDeployments(ctx, provider.DeploymentFailure, fmt.Sprintf("Rollout %s failed", d.req.Rollout))
 		fmt.Println("Uploading failed deploy results")
-		rURI, err := d.req.UploadResult(ctx, d.gcsClient, dr)
+		rURI, err := d.artifacts.UploadResult(ctx, failedDeployResult(err))
 		if err != nil {
 			return fmt.Errorf("error uploading failed deploy results: %v", err)
 		}
@@ -68,7 +73,7 @@ func (d *deployer) process(ctx context.Context) error {
 	}
 
 	fmt.Println("Uploading deploy results")
-	rURI, err := d.req.UploadResult(ctx, d.gcsClient, res)
+	rURI, err := d.artifacts.UploadResult(ctx, res)
 	if err != nil {
 		return fmt.Errorf("error uploading deploy results: %v", err)
 	}
@@ -76,48 +81,112 @@ func (d *deployer) process(ctx context.Context) error {
 	return nil
 }
 
+// failedDeployResult returns the deploy result reporting the deploy error to Cloud Deploy.
+func failedDeployResult(err error) *clouddeploy.DeployResult {
+	return &clouddeploy.DeployResult{
+		ResultStatus:   clouddeploy.DeployFailed,
+		FailureMessage: err.Error(),
+		Metadata: map[string]string{
+			clouddeploy.CustomTargetSourceMetadataKey:    gitDeployerSampleName,
+			clouddeploy.CustomTargetSourceSHAMetadataKey: clouddeploy.GitCommit,
+		},
+	}
+}
+
 // deploy performs the following steps:
 //  1. Access the configured Secret Manager SecretVersion.
-//  2. Clone the Git Repository
-//  3. Determine the clusters that needs to be updated from the source of truth file
-//  4. Group clusters into batches for processing. For each batch ...
-//     a. Pull latest changes on main, and create a new branch
+//  2. Acquire the rollout lock for the output repository and cluster group, refreshing it in the background
+//     until the deploy completes
+//  3. Clone the Git Repository and validate the source of truth
+//  4. Determine the clusters that needs to be updated from the source of truth file and apply the cluster
+//     name and tag filters
+//  5. Group clusters into waves by the wave column, if configured, and each wave into batches for
+//     processing. For each batch ...
+//     a. Wait for the maintenance windows of the clusters, if configured, deferring clusters whose window
+//     does not open in time, then pull latest changes on main and create a new branch
 //     b. Update the cluster row(s) in SOT to match deployment parameters
 //     c. Run `hydrate.py` to render cluster registry manifest for this specific cluster
-//     d. Commit and push the changes.
-//     e. Wait for the specified time before moving to the next batch
+//     d. Commit the changes to the source and output repositories, then push and open pull requests,
+//     reverting the published changes if either repository fails.
+//     e. Mark the Git provider deployments of the batch as successful, if enabled
+//     f. Wait for the specified time before moving to the next batch
+//  6. Tag the merge commit of the last batch in the output repository, if enabled
 func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error) {
+	// Clusters whose maintenance window does not open before the Cloud Deploy job times out are deferred.
+	deadline := time.Now().Add(d.params.hydrationDeployTimeout)
 	fmt.Printf("Accessing SecretVersion %s\n", d.params.gitSecret)
-	s, err := d.accessSecretVersion(ctx, d.params.gitSecret)
+	s, err := d.secrets.AccessSecretVersion(ctx, d.params.gitSecret)
 	if err != nil {
 		return nil, fmt.Errorf("unable to access git secret: %v", err)
 	}
 	fmt.Printf("Accessed SecretVersion %s\n", d.params.gitSecret)
 	secret := string(s)
 
-	sourceRepoParts := strings.Split(d.params.gitSourceRepo, "/")
-	if len(sourceRepoParts) != 3 {
-		return nil, fmt.Errorf("invalid git repository reference: %q", d.params.gitSourceRepo)
+	var key *signingKey
+	if len(d.params.gitSigningKeySecret) != 0 {
+		fmt.Printf("Accessing signing key SecretVersion %s\n", d.params.gitSigningKeySecret)
+		k, err := d.secrets.AccessSecretVersion(ctx, d.params.gitSigningKeySecret)
+		if err != nil {
+			return nil, fmt.Errorf("unable to access signing key secret: %v", err)
+		}
+		if key, err = parseSigningKey(k); err != nil {
+			return nil, fmt.Errorf("unable to parse signing key: %v", err)
+		}
+		fmt.Printf("Commits will be signed with the %s signing key\n", key.format)
+	}
+
+	lock, err := d.acquireLock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := lock.release(context.WithoutCancel(ctx)); err != nil {
+			fmt.Printf("Failed to release lock: %v\n", err)
+		}
+	}()
+	// Steps using the context fail if the lock is lost while it is held.
+	ctx, stopRefresh := lock.keepAlive(ctx)
+	defer stopRefresh()
+
+	// Repositories are cloned into a workspace unique to this run, so leftovers of previous runs and
+	// repositories sharing a name do not collide.
+	workspace, err := os.MkdirTemp("", "git-deployer-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create workspace: %v", err)
 	}
-	srcHostname, srcOwner, srcRepoName := sourceRepoParts[0], sourceRepoParts[1], sourceRepoParts[2]
-	gitSourceRepo := newGitRepository(srcHostname, srcOwner, srcRepoName, d.params.gitEmail, d.params.gitUsername)
-	if err := d.setupGitWorkspace(ctx, secret, gitSourceRepo, d.params.gitSourceBranch); err != nil {
+	defer func() {
+		if err := os.RemoveAll(workspace); err != nil {
+			fmt.Printf("Failed to remove workspace %s: %v\n", workspace, err)
+		}
+	}()
+
+	gitSourceRepo, err := d.newRepository(d.params.gitSourceRepo, key)
+	if err != nil {
+		return nil, err
+	}
+	// The output directory is hydrated into the source repository when there is no separate output repository.
+	srcPaths := []string{d.params.hydrationSourceOfTruth, d.params.hydrationBaseDir, d.params.hydrationOverlaysDir, d.params.hydrationOutputDir}
+	if err := d.setupGitWorkspace(ctx, secret, gitSourceRepo, filepath.Join(workspace, "source"), d.params.gitSourceBranch, srcPaths); err != nil {
 		return nil, fmt.Errorf("unable to set up git workspace: %v", err)
 	}
 
-	var gitOutputRepo *gitRepository
-	var outHostname, outOwner, outRepoName string
+	// Every problem in the source of truth is reported before any branch is created or pushed.
+	sot, err := openSourceOfTruth(gitSourceRepo.info().dir, d.params.hydrationSourceOfTruth, d.params.hydrationSourceOfTruthFormat)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSourceOfTruth(sot, d.params.hydrationSourceOfTruth); err != nil {
+		return nil, err
+	}
+
+	var gitOutputRepo gitRepository
 
 	// Check if hydrated manifests need to be output to a separate repo
 	if d.params.gitSourceRepo != d.params.gitOutputRepo {
-		outputRepoParts := strings.Split(d.params.gitOutputRepo, "/")
-		if len(outputRepoParts) != 3 {
-			return nil, fmt.Errorf("invalid git repository reference: %q", d.params.gitOutputRepo)
+		if gitOutputRepo, err = d.newRepository(d.params.gitOutputRepo, key); err != nil {
+			return nil, err
 		}
-
-		outHostname, outOwner, outRepoName = outputRepoParts[0], outputRepoParts[1], outputRepoParts[2]
-		gitOutputRepo = newGitRepository(outHostname, outOwner, outRepoName, d.params.gitEmail, d.params.gitUsername)
-		if err := d.setupGitWorkspace(ctx, secret, gitOutputRepo, d.params.gitOutputBranch); err != nil {
+		if err := d.setupGitWorkspace(ctx, secret, gitOutputRepo, filepath.Join(workspace, "output"), d.params.gitOutputBranch, []string{d.params.hydrationOutputDir}); err != nil {
 			return nil, fmt.Errorf("unable to set up git workspace: %v", err)
 		}
 	} else {
@@ -129,135 +198,292 @@ func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error
 		d.params.hydrationClusterGroup,
 		d.params.matchClustersHavingAnyListedTag,
 		d.params.matchClustersHavingAllListedTags)
-	clustersToUpdate, err := determineClustersToUpdate(srcRepoName, d.params.hydrationSourceOfTruth, d.params.hydrationClusterGroup, d.params.matchClustersHavingAnyListedTag, d.params.matchClustersHavingAllListedTags)
+	if d.params.matchClustersExpression != nil {
+		fmt.Printf("Matching clusters with expression %s\n", d.params.matchClustersExpression)
+	}
+	clustersToUpdate, excludedClusters, err := sot.selectClusters(d.params.hydrationClusterGroup, d.params.matchClustersHavingAnyListedTag, d.params.matchClustersHavingAllListedTags, d.params.matchClustersExpression, d.params.clusterFilter())
 	if err != nil {
 		return nil, fmt.Errorf("Unable to determine clusters to be updated: %v", err)
 	}
 	fmt.Printf("Determined clusters to update: %v\n", clustersToUpdate)
-
-	var batchSize int
-	if d.params.hydrationBatchSize > 0 {
-		batchSize = d.params.hydrationBatchSize
-	} else {
-		batchSize = len(clustersToUpdate)
+	for _, e := range excludedClusters {
+		fmt.Printf("Excluded cluster %s\n", e)
 	}
-	numBatches := int(math.Ceil(float64(len(clustersToUpdate)) / float64(batchSize)))
-	batchCounter := 1
 
-	for i := 0; i < len(clustersToUpdate); i += batchSize {
-		end := i + d.params.hydrationBatchSize
-		if end > len(clustersToUpdate) {
-			end = len(clustersToUpdate)
+	if d.params.hydrationBatchStrategy == batchStrategyTopology {
+		fmt.Printf("Batching clusters with at most %d clusters per %s\n", d.params.hydrationMaxClustersPerDomain, d.params.hydrationTopologyColumn)
+	}
+	waves, err := d.planWaves(sot, clustersToUpdate)
+	if err != nil {
+		return nil, fmt.Errorf("unable to group clusters into waves: %v", err)
+	}
+	if len(d.params.hydrationWaveColumn) != 0 {
+		for _, w := range waves {
+			fmt.Printf("Planned %s\n", w)
 		}
-		batch := clustersToUpdate[i:end]
-		featureBranchName := fmt.Sprintf("%s__%d/%d", d.req.Rollout, batchCounter, numBatches)
-		fmt.Printf("Processing batch %v with branch %s\n", batch, featureBranchName)
-
-		if err := d.resetGitWorkspace(ctx, gitSourceRepo, d.params.gitSourceBranch, featureBranchName); err != nil {
-			return nil, fmt.Errorf("unable to reset git workspace: %v", err)
+	}
+	windows, err := d.maintenanceWindows(sot)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine maintenance windows: %v", err)
+	}
+	// Clusters not updated since their maintenance window does not open in time.
+	var deferredClusters []clusterExclusion
+	// Numbers of the batches skipped since all of their clusters were deferred.
+	var skippedBatches []int
+	// The merge of the last batch into the output repository, which is tagged once all batches complete.
+	var outputMerge *provider.MergeResponse
+	// The first batch with deferred clusters, later waves are not rolled out until its wave is complete.
+	var incomplete *rolloutBatch
+
+	for _, b := range waveBatches(waves) {
+		batchBranch := d.batchBranch(b.number, b.total)
+		if len(b.wave) != 0 {
+			fmt.Printf("Processing batch %v of wave %s with branch %s\n", b.clusters, b.wave, batchBranch)
+		} else {
+			fmt.Printf("Processing batch %v with branch %s\n", b.clusters, batchBranch)
 		}
-
-		if d.params.gitSourceRepo != d.params.gitOutputRepo {
-			if err := d.resetGitWorkspace(ctx, gitOutputRepo, d.params.gitOutputBranch, featureBranchName); err != nil {
-				return nil, fmt.Errorf("unable to reset git workspace: %v", err)
+		skipped := slices.Clone(skippedBatches)
+		if incomplete != nil && b.wave != incomplete.wave {
+			fmt.Printf("Skipping batch %s since wave %s was not fully rolled out\n", batchBranch, incomplete.wave)
+			for _, c := range b.clusters {
+				deferredClusters = append(deferredClusters, clusterExclusion{name: c, reason: fmt.Sprintf("wave %s was not fully rolled out", incomplete.wave)})
 			}
+			skippedBatches = append(skippedBatches, b.number)
+			continue
 		}
 
-		if err := updatePlatformAndWorkloadRepositoryRevision(gitSourceRepo.repoName, batch, d.params.hydrationSourceOfTruth, d.params.hydrationPlatformRevision, d.params.hydrationWorkloadRevision); err != nil {
-			return nil, fmt.Errorf("unable to update platform revision: %v", err)
-		}
-
-		if err := runHydrationCLI(gitSourceRepo.repoName, d.params.hydrationBaseDir, d.params.hydrationOverlaysDir, gitOutputRepo.repoName, d.params.hydrationOutputDir, d.params.hydrationSourceOfTruth); err != nil {
-			return nil, fmt.Errorf("unable to hydrate: %v", err)
-		}
-
-		op, err := gitSourceRepo.detectDiff()
-		if err != nil {
-			return nil, fmt.Errorf("unable to run git status: %v", err)
-		}
+		// Clusters whose maintenance windows open at different times are rolled out in separate parts of the
+		// batch, each within the windows of its clusters.
+		remaining := b.clusters
+		for part := 1; len(remaining) != 0; part++ {
+			batch := remaining
+			remaining = nil
+			featureBranchName := batchBranch
+			if windows != nil {
+				now := time.Now()
+				until := now.Add(d.params.hydrationMaintenanceWindowMaxWait)
+				if deadline.Before(until) {
+					until = deadline
+				}
+				schedule := scheduleMaintenance(batch, windows, now, until, d.params.hydrationMaintenanceBatchDuration+d.params.hydrationWaitTimeBetweenBatches)
+				for _, e := range schedule.deferred {
+					fmt.Printf("Deferred cluster %s\n", e)
+				}
+				deferredClusters = append(deferredClusters, schedule.deferred...)
+				if len(schedule.deferred) != 0 && incomplete == nil {
+					incomplete = b
+				}
+				if len(schedule.clusters) == 0 {
+					if part == 1 {
+						fmt.Printf("Skipping batch %s since all of its clusters are deferred\n", batchBranch)
+						skippedBatches = append(skippedBatches, b.number)
+					}
+					break
+				}
+				batch, remaining = schedule.clusters, schedule.remaining
+				if part > 1 || len(remaining) != 0 {
+					featureBranchName = fmt.Sprintf("%s.%d", batchBranch, part)
+					fmt.Printf("Processing clusters %v of batch %s with branch %s, clusters %v are rolled out later in their maintenance windows\n", batch, batchBranch, featureBranchName, remaining)
+				}
+				if schedule.start.After(now) {
+					fmt.Printf("Waiting until %s for the maintenance windows of clusters %v\n", schedule.start.Format(time.RFC3339), batch)
+					if err := waitForMaintenance(ctx, schedule.start); err != nil {
+						return nil, fmt.Errorf("unable to wait for maintenance windows: %v", err)
+					}
+				}
+			}
+			d.batch = &rolloutBatch{number: b.number, total: b.total, clusters: batch, wave: b.wave, skipped: skipped}
 
-		if len(op) == 0 {
-			return nil, fmt.Errorf("no diff detected between the rendered manifest and the manifest on branch %s", featureBranchName)
-		}
+			if err := context.Cause(ctx); err != nil {
+				return nil, fmt.Errorf("unable to process batch %s: %v", featureBranchName, err)
+			}
 
-		fmt.Printf("Committing and pushing source of truth changes to branch %s\n", featureBranchName)
-		if err := d.commitPushGitWorkspace(ctx, gitSourceRepo, featureBranchName); err != nil {
-			return nil, fmt.Errorf("unable to commit and push changes: %v", err)
-		}
+			if err := d.resetGitWorkspace(ctx, gitSourceRepo, d.params.gitSourceBranch, featureBranchName); err != nil {
+				return nil, fmt.Errorf("unable to reset git workspace: %v", err)
+			}
 
-		if err := d.handleDestinationBranch(ctx, gitSourceRepo, secret, featureBranchName, d.params.gitOutputBranch); err != nil {
-			return nil, err
-		}
+			if d.params.gitSourceRepo != d.params.gitOutputRepo {
+				if err := d.resetGitWorkspace(ctx, gitOutputRepo, d.params.gitOutputBranch, featureBranchName); err != nil {
+					return nil, fmt.Errorf("unable to reset git workspace: %v", err)
+				}
+			}
 
-		if gitSourceRepo != gitOutputRepo {
-			op, err := gitOutputRepo.detectDiff()
-			if err != nil {
-				return nil, fmt.Errorf("unable to run git status: %v", err)
+			// The changes are re-applied with these if a push is rejected and rebasing onto the moved
+			// remote branch fails.
+			hydrate := func() error {
+				// Source of truth formats other than CSV are converted for the hydration tool outside of the
+				// repositories.
+				sotPath, err := sot.hydrationInput(workspace)
+				if err != nil {
+					return fmt.Errorf("unable to prepare source of truth for hydration: %v", err)
+				}
+				if err := runHydrationCLI(gitSourceRepo.info().dir, d.params.hydrationBaseDir, d.params.hydrationOverlaysDir, gitOutputRepo.info().dir, d.params.hydrationOutputDir, sotPath); err != nil {
+					return fmt.Errorf("unable to hydrate: %v", err)
+				}
+				return nil
+			}
+			updateAndHydrate := func() error {
+				if err := sot.updateRevisions(batch, d.params.hydrationPlatformRevision, d.params.hydrationWorkloadRevision); err != nil {
+					return fmt.Errorf("unable to update platform revision: %v", err)
+				}
+				return hydrate()
 			}
 
-			if len(op) == 0 {
-				return nil, fmt.Errorf("no diff detected between the rendered manifest and the manifest on branch %s", featureBranchName)
+			if err := updateAndHydrate(); err != nil {
+				return nil, err
 			}
 
-			fmt.Printf("Committing and pushing hydrated files to branch %s\n", featureBranchName)
-			if err := d.commitPushGitWorkspace(ctx, gitOutputRepo, featureBranchName); err != nil {
-				return nil, fmt.Errorf("unable to commit and push changes: %v", err)
+			// Both repositories are validated and committed locally before anything is pushed, so a failure
+			// preparing either leaves the remote repositories untouched.
+			changes := []*repoChange{{gitRepo: gitSourceRepo, baseBranch: d.params.gitSourceBranch, reapply: updateAndHydrate, description: "source of truth changes"}}
+			if gitSourceRepo != gitOutputRepo {
+				changes = append(changes, &repoChange{gitRepo: gitOutputRepo, baseBranch: d.params.gitOutputBranch, reapply: hydrate, description: "hydrated files"})
+			}
+			for _, c := range changes {
+				op, err := c.gitRepo.detectDiff()
+				if err != nil {
+					return nil, fmt.Errorf("unable to run git status: %v", err)
+				}
+				if len(op) == 0 {
+					return nil, fmt.Errorf("no diff detected between the rendered manifest and the manifest on branch %s", featureBranchName)
+				}
+				fmt.Printf("Committing %s to branch %s\n", c.description, featureBranchName)
+				if err := d.commitGitWorkspace(c.gitRepo); err != nil {
+					return nil, err
+				}
 			}
 
-			if err := d.handleDestinationBranch(ctx, gitOutputRepo, secret, featureBranchName, d.params.gitOutputBranch); err != nil {
+			// Hydration may take longer than expected, so the clusters must still be in their windows.
+			if closed := closedWindows(batch, windows, time.Now()); len(closed) != 0 {
+				return nil, fmt.Errorf("maintenance windows of clusters %v closed before batch %s was published, increase parameter %q", closed, featureBranchName, hydrationMaintenanceBatchDurationEnvKey)
+			}
+			if err := d.publishChanges(ctx, changes, secret, featureBranchName); err != nil {
 				return nil, err
 			}
+			outputMerge = changes[len(changes)-1].merge
+
+			// The batch is merged, so its deployments are not left in progress while waiting for the next batch.
+			d.completeDeployments(ctx, provider.DeploymentSuccess, fmt.Sprintf("Completed batch %s", featureBranchName))
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("unable to wait between batches: %v", context.Cause(ctx))
+			case <-time.After(d.params.hydrationWaitTimeBetweenBatches):
+			}
+			fmt.Printf("Completed processing batch %v with branch %s\n", batch, featureBranchName)
 		}
-
-		batchCounter += 1
-		time.Sleep(d.params.hydrationWaitTimeBetweenBatches)
-		fmt.Printf("Completed processing batch %v with branch %s\n", batch, featureBranchName)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("Error processing cluster batches failed: %v", err)
 	}
 	fmt.Println("Completed processing all batches")
 
+	if d.params.enableTag {
+		// Nothing is merged if there are no clusters to update or all of them are deferred.
+		if outputMerge == nil {
+			fmt.Println("Not tagging the output repository since no batch was merged into it")
+		} else if err := d.tagOutputRepo(gitOutputRepo, outputMerge); err != nil {
+			return nil, err
+		}
+	}
+
 	fmt.Println("Uploading source of truth as a deploy artifact")
-	dURI, err := d.req.UploadArtifact(ctx, d.gcsClient, "source_of_truth.csv", &clouddeploy.GCSUploadContent{LocalPath: filepath.Join(srcRepoName, d.params.hydrationSourceOfTruth)})
+	sotPath, err := sot.hydrationInput(workspace)
+	if err != nil {
+		return nil, fmt.Errorf("unable to export source of truth: %v", err)
+	}
+	dURI, err := d.artifacts.UploadArtifact(ctx, "source_of_truth.csv", &clouddeploy.GCSUploadContent{LocalPath: sotPath})
 	if err != nil {
 		return nil, fmt.Errorf("error uploading deploy artifact: %v", err)
 	}
 	fmt.Printf("Uploaded deploy artifact to %s\n", dURI)
 
-	return &clouddeploy.DeployResult{
+	res := &clouddeploy.DeployResult{
 		ResultStatus:  clouddeploy.DeploySucceeded,
 		ArtifactFiles: []string{dURI},
 		Metadata: map[string]string{
 			clouddeploy.CustomTargetSourceMetadataKey:    gitDeployerSampleName,
 			clouddeploy.CustomTargetSourceSHAMetadataKey: clouddeploy.GitCommit,
 		},
-	}, nil
+	}
+	if len(excludedClusters) != 0 {
+		res.Metadata[excludedClustersMetadataKey] = formatExclusions(excludedClusters)
+	}
+	if len(d.params.hydrationWaveColumn) != 0 {
+		res.Metadata[rolloutWavesMetadataKey] = formatWaves(waves)
+	}
+	if len(deferredClusters) != 0 {
+		res.Metadata[deferredClustersMetadataKey] = formatExclusions(deferredClusters)
+	}
+	return res, nil
 }
 
-// accessSecretVersion downloads the Secret Manager SecretVersion, verifies the data checksum and
-// provides the data payload.
-func (d *deployer) accessSecretVersion(ctx context.Context, svName string) ([]byte, error) {
-	res, err := d.smClient.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
-		Name: svName,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to access secret version %s: %v", svName, err)
+// newRepository returns the gitRepository for a repository reference of the form "{hostname}/{owner}/{repo}".
+// Commits are signed with the key, if provided.
+func (d *deployer) newRepository(ref string, key *signingKey) (gitRepository, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid git repository reference: %q", ref)
 	}
+	return newGitRepository(d.params.gitBackend, parts[0], parts[1], parts[2], d.params.gitEmail, d.params.gitUsername, key), nil
+}
+
+// batchBranch returns the name of the feature branch for the 1-based batch number.
+func (d *deployer) batchBranch(number, total int) string {
+	return fmt.Sprintf("%s__%d/%d", d.req.Rollout, number, total)
+}
+
+// planBatches groups the clusters into batches of the sizes of the schedule, in order. Percentages are of all
+// the clusters. The remaining clusters are in a single batch once a size is 0.
+func planBatches(clusters []string, schedule batchSchedule) [][]string {
+	var batches [][]string
+	for i := 0; i < len(clusters); {
+		size := len(clusters) - i
+		if len(schedule) != 0 {
+			if n := schedule[min(len(batches), len(schedule)-1)].clusters(len(clusters)); n > 0 {
+				size = n
+			}
+		}
+		end := min(i+size, len(clusters))
+		batches = append(batches, clusters[i:end])
+		i = end
+	}
+	return batches
+}
 
-	crc32c := crc32.MakeTable(crc32.Castagnoli)
-	checksum := int64(crc32.Checksum(res.Payload.Data, crc32c))
-	if checksum != *res.Payload.DataCrc32C {
-		return nil, fmt.Errorf("secret version response failed CRC-32 checksum validation; possible data corruption")
+// acquireLock acquires the rollout lock for the output repository and cluster group, waiting for it if it
+// is held by another rollout.
+func (d *deployer) acquireLock(ctx context.Context) (*rolloutLock, error) {
+	lockPath := d.params.gitLockGCSPath
+	if len(d.params.gitLockDir) != 0 {
+		lockPath = d.params.gitLockDir
+	} else if len(lockPath) == 0 {
+		var err error
+		if lockPath, err = defaultLockPath(d.req.OutputGCSPath); err != nil {
+			return nil, fmt.Errorf("unable to determine lock path: %v", err)
+		}
+	}
+	holder := fmt.Sprintf("projects/%s/locations/%s/deliveryPipelines/%s/releases/%s/rollouts/%s", d.req.Project, d.req.Location, d.req.Pipeline, d.req.Release, d.req.Rollout)
+	lock := newRolloutLock(d.lockStore, lockPath, d.params.gitOutputRepo, d.params.hydrationClusterGroup, holder, d.req.Target, d.params.gitLockTTL)
+	fmt.Printf("Acquiring lock %s\n", lock.uri)
+	if err := lock.acquire(ctx, d.params.gitLockWaitTimeout); err != nil {
+		return nil, err
 	}
-	return res.Payload.Data, nil
+	return lock, nil
 }
 
-// setupGitWorkspace clones the Git repository and checks out the configured source branch.
-func (d *deployer) setupGitWorkspace(ctx context.Context, secret string, gitRepo *gitRepository, branch string) error {
-	fmt.Printf("Cloning Git repository %s\n", gitRepo.repoName)
-	if _, err := gitRepo.cloneRepo(secret); err != nil {
-		return fmt.Errorf("failed to clone git repository %s: %v", gitRepo.repoName, err)
+// setupGitWorkspace clones the Git repository and checks out the configured source branch. The paths are
+// the only paths checked out when sparse checkout is enabled.
+func (d *deployer) setupGitWorkspace(ctx context.Context, secret string, gitRepo gitRepository, dir, branch string, paths []string) error {
+	opts := cloneOptions{depth: d.params.gitCloneDepth}
+	if d.params.gitCloneSingleBranch {
+		opts.singleBranch = branch
+	}
+	if d.params.gitSparseCheckout {
+		opts.sparsePaths = paths
+	}
+	fmt.Printf("Cloning Git repository %s into %s\n", gitRepo.info().repoName, dir)
+	if _, err := gitRepo.cloneRepo(dir, secret, opts); err != nil {
+		return fmt.Errorf("failed to clone git repository %s: %v", gitRepo.info().repoName, err)
 	}
 	if err := gitRepo.config(); err != nil {
 		return fmt.Errorf("failed setting up the git config in the git repository: %v", err)
@@ -279,7 +505,7 @@ func (d *deployer) setupGitWorkspace(ctx context.Context, secret string, gitRepo
 }
 
 // resetGitWorkspace checks out the configured source branch.
-func (d *deployer) resetGitWorkspace(ctx context.Context, gitRepo *gitRepository, sourceBranch, featureBranch string) error {
+func (d *deployer) resetGitWorkspace(ctx context.Context, gitRepo gitRepository, sourceBranch, featureBranch string) error {
 
 	if err := gitRepo.config(); err != nil {
 		return fmt.Errorf("failed setting up the git config in the git repository: %v", err)
@@ -290,14 +516,8 @@ func (d *deployer) resetGitWorkspace(ctx context.Context, gitRepo *gitRepository
 	if _, err := gitRepo.checkoutBranch(sourceBranch); err != nil {
 		return fmt.Errorf("unable to checkout branch %s: %v", sourceBranch, err)
 	}
-	output, err := gitRepo.checkIfExists(sourceBranch)
-	if err != nil {
-		return fmt.Errorf("unable to check if branch %s exists: %v", sourceBranch, err)
-	}
-	if output != nil {
-		if _, err := gitRepo.pull(sourceBranch); err != nil {
-			return fmt.Errorf("unable to pull branch %s: %v", sourceBranch, err)
-		}
+	if err := pullBranch(gitRepo, sourceBranch); err != nil {
+		return err
 	}
 
 	// Now creating a new branch
@@ -305,20 +525,66 @@ func (d *deployer) resetGitWorkspace(ctx context.Context, gitRepo *gitRepository
 	if _, err := gitRepo.checkoutBranch(featureBranch); err != nil {
 		return fmt.Errorf("unable to checkout branch %s: %v", featureBranch, err)
 	}
-	output, err = gitRepo.checkIfExists(featureBranch)
+	return pullBranch(gitRepo, featureBranch)
+}
+
+// pullBranch fast-forwards the checked out branch to the remote branch, if it exists. The branch is reset to
+// the remote branch if they diverged, e.g. since the previous batch was squashed or rebased when merged, so
+// the local branch still has the pushed commit instead of the merged one.
+func pullBranch(gitRepo gitRepository, branch string) error {
+	output, err := gitRepo.checkIfExists(branch)
 	if err != nil {
-		return fmt.Errorf("unable to check if branch %s exists: %v", featureBranch, err)
+		return fmt.Errorf("unable to check if branch %s exists: %v", branch, err)
 	}
-	if output != nil {
-		if _, err := gitRepo.pull(featureBranch); err != nil {
-			return fmt.Errorf("unable to pull branch %s: %v", featureBranch, err)
+	if output == nil {
+		return nil
+	}
+	_, err = gitRepo.pull(branch)
+	if errors.Is(err, errPullDiverged) {
+		fmt.Printf("Branch %s diverged from the remote branch, resetting to the remote branch\n", branch)
+		if _, err := gitRepo.resetToRemote(branch); err != nil {
+			return fmt.Errorf("unable to reset to branch %s: %v", branch, err)
 		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to pull branch %s: %v", branch, err)
 	}
 	return nil
 }
 
-// commitPushGitWorkspace commits and pushes changes in the local Git workspace to the source branch.
-func (d *deployer) commitPushGitWorkspace(ctx context.Context, gitRepo *gitRepository, featureBranch string) error {
+// pushGitWorkspace pushes the committed changes in the local Git workspace to the feature branch. If the
+// push is rejected because the remote branch moved then the push is retried, up to gitPushRetries times,
+// after rebasing onto the remote branch. When the rebase fails the changes are instead re-applied with
+// reapply on a fresh checkout of the remote branch. Returns the SHA of the pushed commit of the changes,
+// empty if the remote branch already contained them.
+func (d *deployer) pushGitWorkspace(ctx context.Context, gitRepo gitRepository, featureBranch string, reapply func() error) (string, error) {
+	committed := true
+	for attempt := 1; ; attempt++ {
+		_, err := gitRepo.push(featureBranch)
+		if err == nil {
+			if !committed {
+				return "", nil
+			}
+			head, err := gitRepo.headCommit()
+			if err != nil {
+				return "", fmt.Errorf("unable to determine the pushed commit: %v", err)
+			}
+			return head, nil
+		}
+		if !errors.Is(err, errPushRejected) || attempt > d.params.gitPushRetries {
+			return "", fmt.Errorf("unable to git push changes to branch %s: %v", featureBranch, err)
+		}
+		fmt.Printf("Push to branch %s was rejected because the remote branch moved, retrying (%d/%d)\n", featureBranch, attempt, d.params.gitPushRetries)
+		if committed, err = d.rebaseGitWorkspace(gitRepo, featureBranch, reapply); err != nil {
+			return "", err
+		}
+	}
+}
+
+// commitGitWorkspace commits the changes in the local Git workspace, with trailers identifying the rollout
+// and batch.
+func (d *deployer) commitGitWorkspace(gitRepo gitRepository) error {
 	if _, err := gitRepo.add(); err != nil {
 		return fmt.Errorf("unable to git add changes: %v", err)
 	}
@@ -326,21 +592,169 @@ func (d *deployer) commitPushGitWorkspace(ctx context.Context, gitRepo *gitRepos
 	if len(commitMsg) == 0 {
 		commitMsg = fmt.Sprintf("Delivery Pipeline: %s Release: %s Rollout: %s", d.req.Pipeline, d.req.Release, d.req.Rollout)
 	}
+	commitMsg = fmt.Sprintf("%s\n\n%s", strings.TrimRight(commitMsg, "\n"), d.commitTrailers())
 	if _, err := gitRepo.commit(commitMsg); err != nil {
 		return fmt.Errorf("unable to git commit changes: %v", err)
 	}
-	if _, err := gitRepo.push(featureBranch); err != nil {
-		return fmt.Errorf("unable to git push changes to branch %s: %v", featureBranch, err)
+	return nil
+}
+
+// rebaseGitWorkspace rebases the local commit onto the remote branch. If the rebase fails then the local
+// Git workspace is reset to the remote branch and the changes are re-applied and committed. Returns whether
+// the local branch has a commit of the changes, which is not the case if the remote branch already contains
+// them.
+func (d *deployer) rebaseGitWorkspace(gitRepo gitRepository, branch string, reapply func() error) (bool, error) {
+	_, err := gitRepo.rebaseOnRemote(branch)
+	if err == nil {
+		// The rebase drops the local commit if the remote branch already contains the changes, leaving HEAD
+		// at the remote branch.
+		head, err := gitRepo.headCommit()
+		if err != nil {
+			return false, fmt.Errorf("unable to determine HEAD commit: %v", err)
+		}
+		op, err := gitRepo.checkIfExists(branch)
+		if err != nil {
+			return false, fmt.Errorf("unable to check if branch %s exists: %v", branch, err)
+		}
+		if strings.HasPrefix(string(op), head) {
+			fmt.Printf("Branch %s already contains the changes\n", branch)
+			return false, nil
+		}
+		return true, nil
+	}
+	if !errors.Is(err, errRebaseFailed) {
+		return false, fmt.Errorf("unable to rebase onto branch %s: %v", branch, err)
+	}
+
+	fmt.Printf("Unable to rebase onto branch %s, re-applying changes to a fresh checkout: %v\n", branch, err)
+	if _, err := gitRepo.resetToRemote(branch); err != nil {
+		return false, fmt.Errorf("unable to reset to branch %s: %v", branch, err)
+	}
+	if err := reapply(); err != nil {
+		return false, fmt.Errorf("unable to re-apply changes: %v", err)
+	}
+	op, err := gitRepo.detectDiff()
+	if err != nil {
+		return false, fmt.Errorf("unable to run git status: %v", err)
+	}
+	if len(op) == 0 {
+		// The remote branch already contains the changes, so the next push is a no-op.
+		fmt.Printf("Branch %s already contains the changes\n", branch)
+		return false, nil
+	}
+	return true, d.commitGitWorkspace(gitRepo)
+}
+
+// repoChange is the change of a batch committed to one of the repositories.
+type repoChange struct {
+	gitRepo gitRepository
+	// The branch the feature branch is based on and merged into.
+	baseBranch string
+	// Re-applies the change to a fresh checkout of the feature branch.
+	reapply     func() error
+	description string
+	// Whether the feature branch was pushed.
+	pushed bool
+	// SHA of the pushed commit of the change, empty if the feature branch already contained the change.
+	commit string
+	// The merge of the pull request into the destination branch, nil if not merged.
+	merge *provider.MergeResponse
+}
+
+// publishChanges pushes the feature branch of every repository, and only then opens and optionally merges
+// the pull requests. If any step fails then the changes already published are reverted, so the source of
+// truth never records a revision whose manifests are missing from the output repository.
+func (d *deployer) publishChanges(ctx context.Context, changes []*repoChange, secret, featureBranch string) error {
+	for _, c := range changes {
+		fmt.Printf("Pushing %s to branch %s\n", c.description, featureBranch)
+		commit, err := d.pushGitWorkspace(ctx, c.gitRepo, featureBranch, c.reapply)
+		if err != nil {
+			return d.revertChanges(ctx, changes, secret, featureBranch, fmt.Errorf("unable to push changes: %v", err))
+		}
+		c.pushed, c.commit = true, commit
+		d.pushRolloutNote(c.gitRepo, commit)
+	}
+	for _, c := range changes {
+		mr, err := d.handleDestinationBranch(ctx, c.gitRepo, secret, featureBranch, c.baseBranch)
+		if err != nil {
+			return d.revertChanges(ctx, changes, secret, featureBranch, err)
+		}
+		c.merge = mr
+	}
+	return nil
+}
+
+// revertChanges reverts the pushed changes after the publishing failed with cause. Returns cause, with the
+// revert failure if the changes could not be reverted and must be reverted manually.
+func (d *deployer) revertChanges(ctx context.Context, changes []*repoChange, secret, featureBranch string, cause error) error {
+	for _, c := range changes {
+		if !c.pushed {
+			continue
+		}
+		if err := d.revertChange(ctx, c, secret, featureBranch); err != nil {
+			return fmt.Errorf("%v; additionally unable to revert the %s pushed to repository %s, they must be reverted manually: %v", cause, c.description, c.gitRepo.info().repoName, err)
+		}
+	}
+	return cause
+}
+
+// revertChange reverts the commit of a pushed change. An unmerged change is reverted on the feature branch,
+// while the merge of a merged change is reverted through a pull request against its base branch, so changes
+// merged with a merge commit, squashed or rebased are all reverted. Nothing is reverted if the feature branch
+// already contained the change, since the deployer did not commit it.
+func (d *deployer) revertChange(ctx context.Context, c *repoChange, secret, featureBranch string) error {
+	if len(c.commit) == 0 {
+		fmt.Printf("Not reverting the %s on branch %s since the branch already contained them\n", c.description, featureBranch)
+		return nil
+	}
+	gitRepo := c.gitRepo
+	branch := featureBranch
+	commit := c.commit
+	if c.merge != nil {
+		// The merge commit is only on the remote base branch, which the revert branch starts from.
+		branch, commit = featureBranch+"__revert", c.merge.Sha
+		if _, err := gitRepo.checkoutBranch(branch); err != nil {
+			return fmt.Errorf("unable to checkout branch %s: %v", branch, err)
+		}
+		if _, err := gitRepo.resetToRemote(c.baseBranch); err != nil {
+			return fmt.Errorf("unable to reset branch %s to branch %s: %v", branch, c.baseBranch, err)
+		}
+	}
+	fmt.Printf("Reverting the %s pushed to branch %s on branch %s\n", c.description, featureBranch, branch)
+	if _, err := gitRepo.revert(commit); err != nil {
+		return fmt.Errorf("unable to revert commit %s: %v", commit, err)
+	}
+	if _, err := gitRepo.push(branch); err != nil {
+		return fmt.Errorf("unable to git push revert to branch %s: %v", branch, err)
+	}
+	if c.merge == nil {
+		return nil
+	}
+
+	gitProvider, err := provider.CreateProvider(gitRepo.info().hostname, gitRepo.info().repoName, gitRepo.info().owner, secret, d.httpClient, d.params.gitRateLimitMaxWait)
+	if err != nil {
+		return fmt.Errorf("unable to create git provider: %v", err)
+	}
+	title := fmt.Sprintf("[Rollout Manager]: Revert %s", featureBranch)
+	body := fmt.Sprintf("Reverts merge %s of branch %s since rollout %s failed to update all repositories.", c.merge.Sha, featureBranch, d.req.Rollout)
+	fmt.Printf("Opening pull request from %s to %s\n", branch, c.baseBranch)
+	pr, err := gitProvider.OpenPullRequest(ctx, branch, c.baseBranch, title, body)
+	if err != nil {
+		return fmt.Errorf("unable to open pull request from %s to %s: %v", branch, c.baseBranch, err)
+	}
+	fmt.Println("Merging the revert pull request")
+	if _, err := gitProvider.MergePullRequest(ctx, pr.Number); err != nil {
+		return fmt.Errorf("unable to merge pull request %d: %v", pr.Number, err)
 	}
 	return nil
 }
 
 // handleDestinationBranch opens a pull request on the destination branch if provided and will optionally
-// merge the PR if configured.
-func (d *deployer) handleDestinationBranch(ctx context.Context, gitRepo *gitRepository, secret string, featureBranchName string, destinationBranch string) error {
+// merge the PR if configured. Returns the merge, or nil if the pull request was not merged.
+func (d *deployer) handleDestinationBranch(ctx context.Context, gitRepo gitRepository, secret string, featureBranchName string, destinationBranch string) (*provider.MergeResponse, error) {
 	// If no destination branch is provided then there is no need to open a pull request.
 	if len(destinationBranch) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	title := d.params.gitPullRequestTitle
@@ -359,28 +773,96 @@ func (d *deployer) handleDestinationBranch(ctx context.Context, gitRepo *gitRepo
 		)
 	}
 
-	gitProvider, err := provider.CreateProvider(gitRepo.hostname, gitRepo.repoName, gitRepo.owner, secret)
+	gitProvider, err := provider.CreateProvider(gitRepo.info().hostname, gitRepo.info().repoName, gitRepo.info().owner, secret, d.httpClient, d.params.gitRateLimitMaxWait)
 	if err != nil {
-		return fmt.Errorf("unable to create git provider: %v", err)
+		return nil, fmt.Errorf("unable to create git provider: %v", err)
 	}
 	fmt.Printf("Opening pull request from %s to %s\n", featureBranchName, destinationBranch)
-	pr, err := gitProvider.OpenPullRequest(featureBranchName, destinationBranch, title, body)
+	pr, err := gitProvider.OpenPullRequest(ctx, featureBranchName, destinationBranch, title, body)
 	if err != nil {
-		return fmt.Errorf("unable to open pull request from %s to %s: %v", featureBranchName, destinationBranch, err)
+		return nil, fmt.Errorf("unable to open pull request from %s to %s: %v", featureBranchName, destinationBranch, err)
 	}
 
 	if !d.params.enablePullRequestMerge {
-		return nil
+		return nil, nil
 	}
 	fmt.Println("Merging the pull request")
-	_, err = gitProvider.MergePullRequest(pr.Number)
+	mr, err := gitProvider.MergePullRequest(ctx, pr.Number)
 	if err != nil {
-		return fmt.Errorf("unable to merge pull request %d: %v", pr.Number, err)
+		return nil, fmt.Errorf("unable to merge pull request %d: %v", pr.Number, err)
+	}
+
+	if !d.params.enableDeployments {
+		return mr, nil
+	}
+	env := d.params.gitDeploymentEnvironment
+	fmt.Printf("Creating deployment of %s to environment %s\n", mr.Sha, env)
+	dep, err := gitProvider.CreateDeployment(ctx, destinationBranch, mr.Sha, env, fmt.Sprintf("Deploying batch %s", featureBranchName))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create deployment of %s: %v", mr.Sha, err)
+	}
+	d.deployments = append(d.deployments, &batchDeployment{
+		gitProvider: gitProvider,
+		deployment:  dep,
+		environment: env,
+	})
+
+	return mr, nil
+}
+
+// tagOutputRepo creates and pushes the annotated tag of the merge commit in the output repository.
+func (d *deployer) tagOutputRepo(gitRepo gitRepository, merge *provider.MergeResponse) error {
+	if merge == nil || len(merge.Sha) == 0 {
+		return fmt.Errorf("unable to tag the output repository since the merge commit SHA is unknown")
+	}
+	name := strings.NewReplacer(
+		"{cluster-group}", d.params.hydrationClusterGroup,
+		"{pipeline}", d.req.Pipeline,
+		"{release}", d.req.Release,
+		"{rollout}", d.req.Rollout,
+		"{target}", d.req.Target,
+	).Replace(d.params.gitTagName)
+	msg := fmt.Sprintf("Delivery Pipeline: %s Release: %s Rollout: %s Cluster Group: %s", d.req.Pipeline, d.req.Release, d.req.Rollout, d.params.hydrationClusterGroup)
+
+	// A retried rollout finds the tag it pushed before.
+	tagged, err := gitRepo.remoteTagCommit(name)
+	if err != nil {
+		return fmt.Errorf("unable to look up tag %s: %v", name, err)
+	}
+	if tagged == merge.Sha {
+		fmt.Printf("Tag %s already points to %s\n", name, merge.Sha)
+		return nil
+	}
+	if len(tagged) != 0 {
+		return fmt.Errorf("tag %s already exists and points to %s instead of %s, set parameter %q to a tag name unique to the rollout, e.g. including {rollout}", name, tagged, merge.Sha, gitTagNameEnvKey)
 	}
 
+	// The merge commit is only on the remote destination branch.
+	if _, err := gitRepo.fetch(d.params.gitOutputBranch); err != nil {
+		return fmt.Errorf("unable to fetch branch %s: %v", d.params.gitOutputBranch, err)
+	}
+	fmt.Printf("Tagging %s as %s\n", merge.Sha, name)
+	if _, err := gitRepo.tag(name, msg, merge.Sha); err != nil {
+		return fmt.Errorf("unable to create tag %s: %v", name, err)
+	}
+	if _, err := gitRepo.pushTag(name); err != nil {
+		return fmt.Errorf("unable to push tag %s: %v", name, err)
+	}
 	return nil
 }
 
+// completeDeployments sets the final state of the deployments created for the current batch. Failures are
+// only logged since the deployments are informational and must not change the outcome of the rollout.
+func (d *deployer) completeDeployments(ctx context.Context, state provider.DeploymentState, description string) {
+	for _, bd := range d.deployments {
+		fmt.Printf("Setting deployment %d state to %s\n", bd.deployment.ID, state)
+		if err := bd.gitProvider.UpdateDeploymentStatus(ctx, bd.deployment.ID, bd.environment, state, description); err != nil {
+			fmt.Printf("Unable to update status of deployment %d: %v\n", bd.deployment.ID, err)
+		}
+	}
+	d.deployments = nil
+}
+
 type FieldsNotFoundError struct {
 	Fields []string
 }
@@ -438,102 +920,23 @@ func matchesAllTags(tags, matchTags []string) bool {
 	return true
 }
 
-func determineClustersToUpdate(repo, sourceOfTruth, clusterGroup string, matchClustersHavingAnyListedTag, matchClustersHavingAllListedTags []string) ([]string, error) {
-	filePath := filepath.Join(repo, sourceOfTruth)
-	f, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	records, err := csv.NewReader(f).ReadAll()
-	if err != nil {
-		return nil, err
-	}
-
-	fieldIndices, err := findFieldIndices(records[0], "cluster_name", "cluster_group", "cluster_tags")
-	if err != nil {
-		return nil, err
-	}
-
-	clusterNameIndex := fieldIndices["cluster_name"]
-	clusterGroupIndex := fieldIndices["cluster_group"]
-	clusterTagsIndex := fieldIndices["cluster_tags"]
-
-	clustersToUpdate := []string{}
-	for _, record := range records[1:] {
-		if clusterGroup != record[clusterGroupIndex] {
-			continue
-		}
-
-		clusterName := record[clusterNameIndex]
-		if len(matchClustersHavingAnyListedTag) == 0 && len(matchClustersHavingAllListedTags) == 0 {
-			clustersToUpdate = append(clustersToUpdate, clusterName)
-			continue
-		}
-
-		clusterTags := strings.Split(strings.Trim(record[clusterTagsIndex], "\" "), ",")
-		if len(matchClustersHavingAnyListedTag) > 0 {
-			if matchesAnyTags(clusterTags, matchClustersHavingAnyListedTag) {
-				clustersToUpdate = append(clustersToUpdate, clusterName)
-			}
-		} else {
-			if matchesAllTags(clusterTags, matchClustersHavingAllListedTags) {
-				clustersToUpdate = append(clustersToUpdate, clusterName)
-			}
-		}
-	}
-
-	return clustersToUpdate, nil
-}
-
-func updatePlatformAndWorkloadRepositoryRevision(repo string, clusterNames []string, sourceOfTruth, platformRevision, workloadRevision string) error {
-	filePath := filepath.Join(repo, sourceOfTruth)
+// updatePlatformAndWorkloadRepositoryRevision sets the non-empty revisions of the named clusters in the CSV
+// source of truth. Only the changed cells are rewritten, so the diff of a rollout is limited to the revisions.
+func updatePlatformAndWorkloadRepositoryRevision(repoDir string, clusterNames []string, sourceOfTruth, platformRevision, workloadRevision string) error {
+	filePath := filepath.Join(repoDir, sourceOfTruth)
 
-	f, err := os.Open(filePath)
+	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return fmt.Errorf("unable to open input file %s: %w", filePath, err)
 	}
-	defer f.Close()
-
-	records, err := csv.NewReader(f).ReadAll()
-	if err != nil {
-		return fmt.Errorf("error reading CSV records: %w", err)
-	}
-
-	fieldIndices, err := findFieldIndices(records[0], "cluster_name", "platform_repository_revision", "workload_repository_revision")
-	if err != nil {
-		return err
-	}
-
-	clusterNameIndex := fieldIndices["cluster_name"]
-	platformRevisionIndex := fieldIndices["platform_repository_revision"]
-	workloadRevisionIndex := fieldIndices["workload_repository_revision"]
-
-	wFile, err := os.Create(filePath)
+	updated, err := updateCSVRevisions(data, clusterNames, platformRevision, workloadRevision)
 	if err != nil {
-		return fmt.Errorf("error creating file for writing: %w", err)
+		return fmt.Errorf("unable to update source of truth %s: %w", sourceOfTruth, err)
 	}
-	defer wFile.Close()
-
-	writer := csv.NewWriter(wFile)
-	defer writer.Flush()
-	for _, record := range records {
-		if slices.Contains(clusterNames, record[clusterNameIndex]) && len(platformRevision) > 0 {
-			record[platformRevisionIndex] = platformRevision
-		}
-
-		if slices.Contains(clusterNames, record[clusterNameIndex]) && len(workloadRevision) > 0 {
-			record[workloadRevisionIndex] = workloadRevision
-		}
-
-		err := writer.Write(record)
-		if err != nil {
-			return fmt.Errorf("error writing CSV record: %w", err)
-		}
+	if bytes.Equal(data, updated) {
+		return nil
 	}
-
-	return nil
+	return os.WriteFile(filePath, updated, 0644)
 }
 
 // delete all files/directories in provided "hydrated" directorydirec except .gitkeep file
@@ -566,15 +969,17 @@ func cleanHydratedDirectory(directory string) error {
 	return nil
 }
 
-func runHydrationCLI(sourceRepo, baseLibraryPath, overlayPath, outputRepo, outputPath, sourceOfTruth string) error {
+// runHydrationCLI hydrates the manifests of the clusters in the CSV source of truth at sourceOfTruthPath into
+// outputPath of the output repository, or of the source repository if outputRepoDir is empty.
+func runHydrationCLI(sourceRepoDir, baseLibraryPath, overlayPath, outputRepoDir, outputPath, sourceOfTruthPath string) error {
 	const hydrateCliBin = "hydrate"
 
-	if outputRepo == "" {
-		outputRepo = sourceRepo
+	if outputRepoDir == "" {
+		outputRepoDir = sourceRepoDir
 	}
-	cleanHydratedDirectory(filepath.Join(outputRepo, outputPath))
+	cleanHydratedDirectory(filepath.Join(outputRepoDir, outputPath))
 
-	args := []string{"-b", filepath.Join(sourceRepo, baseLibraryPath), "-o", filepath.Join(sourceRepo, overlayPath), "-y", filepath.Join(sourceRepo, outputPath), filepath.Join(sourceRepo, sourceOfTruth)}
+	args := []string{"-b", filepath.Join(sourceRepoDir, baseLibraryPath), "-o", filepath.Join(sourceRepoDir, overlayPath), "-y", filepath.Join(outputRepoDir, outputPath), sourceOfTruthPath}
 
 	if _, err := runCmd(hydrateCliBin, args, "", true); err != nil {
 		return err
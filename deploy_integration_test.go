@@ -0,0 +1,435 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+)
+
+// The integration tests run the whole deploy flow against local bare repositories, a fake Git provider API
+// and in-memory secrets, artifacts and locks. Only the git binary is required.
+
+// fakeHydrateScript hydrates one manifest per source of truth row into the "-y" directory. The source of
+// truth must have the columns of integrationSourceOfTruth.
+const fakeHydrateScript = `while [ $# -gt 1 ]; do
+  case "$1" in
+    -y) out="$2"; shift 2;;
+    -b|-o) shift 2;;
+    *) shift;;
+  esac
+done
+mkdir -p "$out"
+tail -n +2 "$1" | while IFS=, read -r name group tags platform workload; do
+  printf 'cluster: %s\nplatform: %s\nworkload: %s\n' "$name" "$platform" "$workload" > "$out/$name.yaml"
+done
+`
+
+const integrationSourceOfTruth = `cluster_name,cluster_group,cluster_tags,platform_repository_revision,workload_repository_revision
+cluster1,prod,us,v1,v1
+cluster2,prod,eu,v1,v1
+cluster3,dev,us,v1,v1
+cluster4,prod,us,v1,v1
+cluster5,prod,eu,v1,v1
+`
+
+// fakeSecrets implements SecretAccessor with a map of secret version names to payloads.
+type fakeSecrets map[string]string
+
+func (s fakeSecrets) AccessSecretVersion(ctx context.Context, name string) ([]byte, error) {
+	payload, ok := s[name]
+	if !ok {
+		return nil, fmt.Errorf("secret version %s not found", name)
+	}
+	return []byte(payload), nil
+}
+
+// fakeArtifactStore implements ArtifactStore in memory.
+type fakeArtifactStore struct {
+	artifacts map[string][]byte
+	results   []*clouddeploy.DeployResult
+}
+
+func newFakeArtifactStore() *fakeArtifactStore {
+	return &fakeArtifactStore{artifacts: map[string][]byte{}}
+}
+
+func (s *fakeArtifactStore) UploadArtifact(ctx context.Context, objectSuffix string, content *clouddeploy.GCSUploadContent) (string, error) {
+	data := content.Data
+	if len(content.LocalPath) != 0 {
+		var err error
+		if data, err = os.ReadFile(content.LocalPath); err != nil {
+			return "", err
+		}
+	}
+	s.artifacts[objectSuffix] = data
+	return "gs://bucket/out/" + objectSuffix, nil
+}
+
+func (s *fakeArtifactStore) UploadResult(ctx context.Context, result *clouddeploy.DeployResult) (string, error) {
+	s.results = append(s.results, result)
+	return "gs://bucket/out/results.json", nil
+}
+
+// fakePullRequest is a pull request opened on the fakeGitProvider.
+type fakePullRequest struct {
+	repo   string
+	head   string
+	base   string
+	merged bool
+}
+
+// fakeGitProvider serves the GitHub and GitLab pull request APIs used by the deployer. Pull requests are
+// merged into the bare repositories under root with a merge commit, or squashed if squash is set.
+type fakeGitProvider struct {
+	root   string
+	squash bool
+
+	mu    sync.Mutex
+	pulls []*fakePullRequest
+}
+
+func (p *fakeGitProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// GitHub: /repos/{owner}/{repo}/pulls[/{number}/merge]
+	// GitLab: /api/v4/projects/{owner}%2F{repo}/merge_requests[/{iid}/merge]
+	var repo string
+	var rest []string
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	switch {
+	case len(parts) >= 4 && parts[0] == "repos" && parts[3] == "pulls":
+		repo, rest = parts[1]+"/"+parts[2], parts[4:]
+	case len(parts) >= 5 && parts[2] == "projects" && parts[4] == "merge_requests":
+		repo, _ = url.PathUnescape(parts[3])
+		rest = parts[5:]
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && len(rest) == 0:
+		var payload map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr := &fakePullRequest{repo: repo, head: payload["head"] + payload["source_branch"], base: payload["base"] + payload["target_branch"]}
+		p.pulls = append(p.pulls, pr)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"number": %d, "iid": %d}`, len(p.pulls), len(p.pulls))
+
+	case r.Method == http.MethodPut && len(rest) == 2 && rest[1] == "merge":
+		n, err := strconv.Atoi(rest[0])
+		if err != nil || n < 1 || n > len(p.pulls) || p.pulls[n-1].repo != repo {
+			http.Error(w, "pull request not found", http.StatusNotFound)
+			return
+		}
+		pr := p.pulls[n-1]
+		sha, err := p.merge(pr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+			return
+		}
+		pr.merged = true
+		fmt.Fprintf(w, `{"sha": %q, "merge_commit_sha": %q}`, sha, sha)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// merge merges the pull request head into the base branch of the bare repository and returns the merge
+// commit SHA.
+func (p *fakeGitProvider) merge(pr *fakePullRequest) (string, error) {
+	return mergeBranch(filepath.Join(p.root, pr.repo+".git"), pr.head, pr.base, p.squash)
+}
+
+// setIntegrationParams sets the deploy parameters for deploying platform revision v2 to the prod cluster
+// group of the github.com/owner/platform repository, hydrating into github.com/owner/hydrated.
+func setIntegrationParams(t *testing.T, host string) {
+	t.Helper()
+	for k, v := range map[string]string{
+		gitSourceRepoEnvKey:                   host + "/owner/platform",
+		gitSourceBranchEnvKey:                 "main",
+		gitOutputRepoEnvKey:                   host + "/owner/hydrated",
+		gitOutputBranchEnvKey:                 "main",
+		gitSecretEnvKey:                       "projects/1/secrets/git/versions/1",
+		gitEmailEnvKey:                        "deploy@example.com",
+		gitEnablePullRequestMergeEnvKey:       "true",
+		gitEnableTagEnvKey:                    "true",
+		hydrationClusterGroupEnvKey:           "prod",
+		hydrationBatchSizeEnvKey:              "2",
+		hydrationWaitTimeBetweenBatchesEnvKey: "0s",
+		hydrationPlatformRevisionEnvKey:       "v2",
+	} {
+		t.Setenv(k, v)
+	}
+}
+
+func TestDeployIntegration(t *testing.T) {
+	testCases := []struct {
+		name string
+		host string
+		// Whether pull requests are squashed, so the local branch of the previous batch diverges from the
+		// destination branch.
+		squash bool
+	}{
+		{name: "github.com", host: "github.com"},
+		{name: "gitlab.com", host: "gitlab.com"},
+		{name: "Squashed pull requests", host: "github.com", squash: true},
+	}
+	for _, tc := range testCases {
+		host := tc.host
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			createBareRemote(t, root, "owner", "platform", map[string]string{
+				"source_of_truth.csv":        integrationSourceOfTruth,
+				"base_library/base.yaml":     "kind: Namespace\n",
+				"overlays/prod/overlay.yaml": "kind: Namespace\n",
+			}, 1)
+			createBareRemote(t, root, "owner", "hydrated", map[string]string{"output/.gitkeep": ""}, 1)
+			redirectRemotes(t, root, host, "owner", "token")
+			installFakeHydrate(t, fakeHydrateScript)
+			setIntegrationParams(t, host)
+
+			fake := &fakeGitProvider{root: root, squash: tc.squash}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			params, err := determineParams()
+			if err != nil {
+				t.Fatalf("Failed to determine params: %v", err)
+			}
+			artifacts := newFakeArtifactStore()
+			locks := newMemLockStore()
+			d := &deployer{
+				req: &clouddeploy.DeployRequest{
+					Project:       "1",
+					Location:      "us-central1",
+					Pipeline:      "pipeline",
+					Release:       "release-1",
+					Rollout:       "rollout-1",
+					Target:        "prod",
+					OutputGCSPath: "gs://bucket/out",
+				},
+				params:     params,
+				secrets:    fakeSecrets{"projects/1/secrets/git/versions/1": "token"},
+				artifacts:  artifacts,
+				lockStore:  locks,
+				httpClient: redirectHTTPClient(server),
+			}
+
+			res, err := d.deploy(context.Background())
+			if err != nil {
+				t.Fatalf("Deploy failed: %v", err)
+			}
+			if res.ResultStatus != clouddeploy.DeploySucceeded {
+				t.Errorf("Expected deploy to succeed, got: %v", res.ResultStatus)
+			}
+
+			// Every batch opens and merges a pull request in both repositories.
+			var expectedPulls []fakePullRequest
+			for _, branch := range []string{"rollout-1__1/2", "rollout-1__2/2"} {
+				for _, repo := range []string{"owner/platform", "owner/hydrated"} {
+					expectedPulls = append(expectedPulls, fakePullRequest{repo: repo, head: branch, base: "main", merged: true})
+				}
+			}
+			var gotPulls []fakePullRequest
+			for _, pr := range fake.pulls {
+				gotPulls = append(gotPulls, *pr)
+			}
+			if !reflect.DeepEqual(gotPulls, expectedPulls) {
+				t.Errorf("Pull requests mismatch\nExpected: %+v\n     Got: %+v", expectedPulls, gotPulls)
+			}
+
+			platform := t.TempDir()
+			mustRunGit(t, "", "clone", filepath.Join(root, "owner", "platform.git"), platform)
+			hydrated := t.TempDir()
+			mustRunGit(t, "", "clone", filepath.Join(root, "owner", "hydrated.git"), hydrated)
+
+			// Only the prod clusters are updated in the source of truth, and hydrated with the new revision.
+			sot, err := os.ReadFile(filepath.Join(platform, "source_of_truth.csv"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedSOT := strings.NewReplacer(
+				"cluster1,prod,us,v1", "cluster1,prod,us,v2",
+				"cluster2,prod,eu,v1", "cluster2,prod,eu,v2",
+				"cluster4,prod,us,v1", "cluster4,prod,us,v2",
+				"cluster5,prod,eu,v1", "cluster5,prod,eu,v2",
+			).Replace(integrationSourceOfTruth)
+			if string(sot) != expectedSOT {
+				t.Errorf("Source of truth mismatch\nExpected: %s\n     Got: %s", expectedSOT, sot)
+			}
+			for _, cluster := range []string{"cluster1", "cluster2", "cluster4", "cluster5"} {
+				manifest, err := os.ReadFile(filepath.Join(hydrated, "output", cluster+".yaml"))
+				if err != nil {
+					t.Fatalf("Expected %s to be hydrated: %v", cluster, err)
+				}
+				if !strings.Contains(string(manifest), "platform: v2") {
+					t.Errorf("Expected %s to be hydrated with platform revision v2, got: %s", cluster, manifest)
+				}
+			}
+
+			// Each batch commit records its clusters in the trailers.
+			for i, clusters := range []string{"cluster1,cluster2", "cluster4,cluster5"} {
+				branch := fmt.Sprintf("origin/rollout-1__%d/2", i+1)
+				for _, dir := range []string{platform, hydrated} {
+					got := mustRunGit(t, dir, "log", "-1", "--format=%(trailers:key=Batch,key=Clusters,valueonly)", branch)
+					if want := fmt.Sprintf("%d/2\n%s", i+1, clusters); got != want {
+						t.Errorf("Trailers of %s mismatch\nExpected: %s\n     Got: %s", branch, want, got)
+					}
+				}
+			}
+
+			// The last merge commit of the output repository is tagged.
+			if got, want := mustRunGit(t, hydrated, "rev-parse", "prod/release-1^{commit}"), mustRunGit(t, hydrated, "rev-parse", "origin/main"); got != want {
+				t.Errorf("Tagged commit mismatch\nExpected: %s\n     Got: %s", want, got)
+			}
+
+			if string(artifacts.artifacts["source_of_truth.csv"]) != expectedSOT {
+				t.Errorf("Expected the updated source of truth to be uploaded, got: %s", artifacts.artifacts["source_of_truth.csv"])
+			}
+			if len(locks.objects) != 0 {
+				t.Errorf("Expected the rollout lock to be released, got: %v", locks.objects)
+			}
+		})
+	}
+}
+
+func TestDeployIntegrationNoClusters(t *testing.T) {
+	root := t.TempDir()
+	createBareRemote(t, root, "owner", "platform", map[string]string{
+		"source_of_truth.csv":        integrationSourceOfTruth,
+		"base_library/base.yaml":     "kind: Namespace\n",
+		"overlays/prod/overlay.yaml": "kind: Namespace\n",
+	}, 1)
+	createBareRemote(t, root, "owner", "hydrated", map[string]string{"output/.gitkeep": ""}, 1)
+	redirectRemotes(t, root, "github.com", "owner", "token")
+	installFakeHydrate(t, fakeHydrateScript)
+	setIntegrationParams(t, "github.com")
+	// No cluster is in the cluster group, so nothing is merged and tagging is skipped.
+	t.Setenv(hydrationClusterGroupEnvKey, "staging")
+
+	fake := &fakeGitProvider{root: root}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	params, err := determineParams()
+	if err != nil {
+		t.Fatalf("Failed to determine params: %v", err)
+	}
+	d := &deployer{
+		req:        &clouddeploy.DeployRequest{Pipeline: "pipeline", Release: "release-1", Rollout: "rollout-1", Target: "staging", OutputGCSPath: "gs://bucket/out"},
+		params:     params,
+		secrets:    fakeSecrets{"projects/1/secrets/git/versions/1": "token"},
+		artifacts:  newFakeArtifactStore(),
+		lockStore:  newMemLockStore(),
+		httpClient: redirectHTTPClient(server),
+	}
+	res, err := d.deploy(context.Background())
+	if err != nil {
+		t.Fatalf("Deploy failed: %v", err)
+	}
+	if res.ResultStatus != clouddeploy.DeploySucceeded {
+		t.Errorf("Expected deploy to succeed, got: %v", res.ResultStatus)
+	}
+	if len(fake.pulls) != 0 {
+		t.Errorf("Expected no pull requests, got: %d", len(fake.pulls))
+	}
+	if got := mustRunGit(t, filepath.Join(root, "owner", "hydrated.git"), "tag", "--list"); len(got) != 0 {
+		t.Errorf("Expected no tags, got: %s", got)
+	}
+}
+
+func TestDeployIntegrationIncompleteWave(t *testing.T) {
+	root := t.TempDir()
+	// The maintenance window of cluster2 is too short to publish a batch in, so it is always deferred.
+	createBareRemote(t, root, "owner", "platform", map[string]string{
+		"source_of_truth.csv": `cluster_name,cluster_group,cluster_tags,platform_repository_revision,workload_repository_revision,rollout_wave,maintenance_window
+cluster1,prod,us,v1,v1,1,
+cluster2,prod,eu,v1,v1,1,* * * * * 1m
+cluster4,prod,us,v1,v1,2,
+cluster5,prod,eu,v1,v1,2,
+`,
+		"base_library/base.yaml":     "kind: Namespace\n",
+		"overlays/prod/overlay.yaml": "kind: Namespace\n",
+	}, 1)
+	createBareRemote(t, root, "owner", "hydrated", map[string]string{"output/.gitkeep": ""}, 1)
+	redirectRemotes(t, root, "github.com", "owner", "token")
+	installFakeHydrate(t, fakeHydrateScript)
+	setIntegrationParams(t, "github.com")
+	t.Setenv(hydrationWaveColumnEnvKey, "rollout_wave")
+	t.Setenv(hydrationMaintenanceWindowColumnEnvKey, "maintenance_window")
+
+	fake := &fakeGitProvider{root: root}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	params, err := determineParams()
+	if err != nil {
+		t.Fatalf("Failed to determine params: %v", err)
+	}
+	d := &deployer{
+		req:        &clouddeploy.DeployRequest{Pipeline: "pipeline", Release: "release-1", Rollout: "rollout-1", Target: "prod", OutputGCSPath: "gs://bucket/out"},
+		params:     params,
+		secrets:    fakeSecrets{"projects/1/secrets/git/versions/1": "token"},
+		artifacts:  newFakeArtifactStore(),
+		lockStore:  newMemLockStore(),
+		httpClient: redirectHTTPClient(server),
+	}
+	res, err := d.deploy(context.Background())
+	if err != nil {
+		t.Fatalf("Deploy failed: %v", err)
+	}
+	if res.ResultStatus != clouddeploy.DeploySucceeded {
+		t.Errorf("Expected deploy to succeed, got: %v", res.ResultStatus)
+	}
+
+	// Only the first wave is rolled out, without its deferred cluster, and the second wave is deferred.
+	var gotPulls []fakePullRequest
+	for _, pr := range fake.pulls {
+		gotPulls = append(gotPulls, *pr)
+	}
+	expectedPulls := []fakePullRequest{
+		{repo: "owner/platform", head: "rollout-1__1/2", base: "main", merged: true},
+		{repo: "owner/hydrated", head: "rollout-1__1/2", base: "main", merged: true},
+	}
+	if !reflect.DeepEqual(gotPulls, expectedPulls) {
+		t.Errorf("Pull requests mismatch\nExpected: %+v\n     Got: %+v", expectedPulls, gotPulls)
+	}
+	deferred := res.Metadata[deferredClustersMetadataKey]
+	for _, want := range []string{"cluster2 (maintenance window", "cluster4 (wave 1 was not fully rolled out)", "cluster5 (wave 1 was not fully rolled out)"} {
+		if !strings.Contains(deferred, want) {
+			t.Errorf("Expected deferred clusters to contain %q, got: %s", want, deferred)
+		}
+	}
+}
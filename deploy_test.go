@@ -15,14 +15,25 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
 	"slices"
+	"strings"
+	"sync"
 	"testing"
+
+	provider "github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/git-ops/git-deployer/providers"
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
 )
 
 func createTempCSV(directory string, data [][]string) (string, error) {
@@ -237,13 +248,14 @@ func TestFindFieldIndices(t *testing.T) {
 	}
 }
 
-func TestDetermineClustersToUpdate(t *testing.T) {
+func TestCSVSelectClusters(t *testing.T) {
 	testData := [][]string{
-		{"cluster_name", "cluster_group", "cluster_tags"},
-		{"cluster1", "groupA", "tag1,tag2"},
-		{"cluster2", "groupB", "tag3,tag4"},
-		{"cluster3", "groupA", "tag1,tag4,tag5"},
-		{"cluster4", "groupA", "tag2"},
+		{"cluster_name", "cluster_group", "cluster_tags", "platform_repository_revision", "workload_repository_revision"},
+		{"cluster1", "groupA", "tag1,tag2", "v1", "v1"},
+		{"cluster2", "groupB", "tag3,tag4", "v1", "v1"},
+		{"cluster3", "groupA", "tag1,tag4,tag5", "v1", "v1"},
+		{"cluster4", "groupA", "tag2", "v1", "v1"},
+		{"cluster5", "groupB", `"tag1"`, "v1", "v1"},
 	}
 
 	sourceOfTruth, err := createTempCSV("", testData)
@@ -297,6 +309,15 @@ func TestDetermineClustersToUpdate(t *testing.T) {
 			[]string{},
 			os.ErrNotExist,
 		},
+		{
+			"Quoted tags",
+			sourceOfTruth,
+			"groupB",
+			[]string{"tag1"},
+			[]string{},
+			[]string{"cluster5"},
+			nil,
+		},
 		{
 			"No tags matches all clusters in group",
 			sourceOfTruth,
@@ -310,7 +331,8 @@ func TestDetermineClustersToUpdate(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result, err := determineClustersToUpdate("", tc.sourceOfTruth, tc.clusterGroup, tc.matchAnyTags, tc.matchAllTags)
+			sot := &csvSourceOfTruth{path: tc.sourceOfTruth}
+			result, _, err := sot.selectClusters(tc.clusterGroup, tc.matchAnyTags, tc.matchAllTags, nil, nil)
 
 			if tc.expectedError != nil {
 				if err == nil {
@@ -442,3 +464,421 @@ func TestUpdatePlatformAndWorkloadRepositoryRevision(t *testing.T) {
 		})
 	}
 }
+
+func TestPushGitWorkspaceRetries(t *testing.T) {
+	testCases := []struct {
+		name string
+		// The file and revision the concurrent commit changes on the remote branch.
+		remoteFile     string
+		remoteRevision string
+		retries        int
+		// Whether the changes are expected to be re-applied since the rebase conflicts.
+		expectReapply bool
+		// Whether the remote branch is expected to already contain the changes, so nothing is committed.
+		expectContained bool
+		expectError     bool
+	}{
+		{name: "Rebase onto remote change", remoteFile: "other.txt", remoteRevision: "v1", retries: 1},
+		{name: "Re-apply on rebase conflict", remoteFile: "source_of_truth.csv", remoteRevision: "v1", retries: 1, expectReapply: true},
+		{name: "Remote already contains the changes", remoteFile: "source_of_truth.csv", remoteRevision: "v2", retries: 1, expectContained: true},
+		{name: "No retries", remoteFile: "other.txt", remoteRevision: "v1", retries: 0, expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			bare := createBareRemote(t, root, "owner", "repo", map[string]string{"source_of_truth.csv": "cluster_name,platform_revision\ncluster1,v0\n"}, 1)
+			redirectRemotes(t, root, "github.com", "owner", "secret")
+
+			g := newGitRepository(gitBackendCLI, "github.com", "owner", "repo", "deploy@example.com", "Cloud Deploy", nil)
+			if _, err := g.cloneRepo(filepath.Join(t.TempDir(), "repo"), "secret", cloneOptions{}); err != nil {
+				t.Fatalf("Failed to clone: %v", err)
+			}
+			if err := g.config(); err != nil {
+				t.Fatalf("Failed to configure: %v", err)
+			}
+			if _, err := g.checkoutBranch("feature"); err != nil {
+				t.Fatalf("Failed to checkout branch: %v", err)
+			}
+			if _, err := g.push("feature"); err != nil {
+				t.Fatalf("Failed to push: %v", err)
+			}
+
+			// Another writer moves the remote branch.
+			other := t.TempDir()
+			mustRunGit(t, "", "clone", "--branch", "feature", bare, other)
+			writeTestFile(t, other, tc.remoteFile, fmt.Sprintf("cluster_name,platform_revision\ncluster1,%s\n", tc.remoteRevision))
+			mustRunGit(t, other, "add", ".")
+			mustRunGit(t, other, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-m", "concurrent change")
+			mustRunGit(t, other, "push", "origin", "feature")
+
+			apply := func() error {
+				writeTestFile(t, g.info().dir, "source_of_truth.csv", "cluster_name,platform_revision\ncluster1,v2\n")
+				return nil
+			}
+			if err := apply(); err != nil {
+				t.Fatal(err)
+			}
+			reapplied := false
+			d := &deployer{req: &clouddeploy.DeployRequest{}, params: &params{gitCommitMessage: "update cluster1", gitPushRetries: tc.retries}}
+			if err := d.commitGitWorkspace(g); err != nil {
+				t.Fatalf("Failed to commit: %v", err)
+			}
+			commit, err := d.pushGitWorkspace(context.Background(), g, "feature", func() error {
+				reapplied = true
+				return apply()
+			})
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("Expected an error, but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if reapplied != tc.expectReapply {
+				t.Errorf("Re-applied mismatch\nExpected: %t\n     Got: %t", tc.expectReapply, reapplied)
+			}
+
+			mustRunGit(t, other, "pull", "origin", "feature")
+			if tc.expectContained {
+				if len(commit) != 0 {
+					t.Errorf("Expected no pushed commit since the remote already contains the changes, got: %s", commit)
+				}
+				return
+			}
+			// The remote branch has the concurrent commit followed by the deployer commit.
+			if head := mustRunGit(t, other, "rev-parse", "HEAD"); commit != head {
+				t.Errorf("Pushed commit mismatch\nExpected: %s\n     Got: %s", head, commit)
+			}
+			if got := mustRunGit(t, other, "log", "--format=%s", "-2"); got != "update cluster1\nconcurrent change" {
+				t.Errorf("Unexpected remote history: %s", got)
+			}
+			got, err := os.ReadFile(filepath.Join(other, "source_of_truth.csv"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "cluster_name,platform_revision\ncluster1,v2\n"; string(got) != want {
+				t.Errorf("Source of truth mismatch\nExpected: %s\n     Got: %s", want, got)
+			}
+		})
+	}
+}
+
+// newTestRepoChange clones the repository from the bare remotes under root and commits a change to the
+// feature branch.
+func newTestRepoChange(t *testing.T, root, repoName, description string) *repoChange {
+	t.Helper()
+	createBareRemote(t, root, "owner", repoName, map[string]string{"README.md": "readme\n"}, 1)
+	g := newGitRepository(gitBackendCLI, "github.com", "owner", repoName, "deploy@example.com", "Cloud Deploy", nil)
+	if _, err := g.cloneRepo(filepath.Join(t.TempDir(), "repo"), "secret", cloneOptions{}); err != nil {
+		t.Fatalf("Failed to clone: %v", err)
+	}
+	if err := g.config(); err != nil {
+		t.Fatalf("Failed to configure: %v", err)
+	}
+	if _, err := g.checkoutBranch("feature"); err != nil {
+		t.Fatalf("Failed to checkout branch: %v", err)
+	}
+	writeTestFile(t, g.info().dir, "changed.txt", "change\n")
+	if _, err := g.add(); err != nil {
+		t.Fatalf("Failed to add: %v", err)
+	}
+	if _, err := g.commit("update " + repoName); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	return &repoChange{gitRepo: g, reapply: func() error { return nil }, description: description}
+}
+
+// redirectHTTPClient returns an HTTP client that sends every request to the test server.
+func redirectHTTPClient(server *httptest.Server) *http.Client {
+	target, _ := url.Parse(server.URL)
+	transport := http.DefaultTransport
+	return &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			return transport.RoundTrip(req)
+		}),
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestPublishChangesRevertsOnFailure(t *testing.T) {
+	testCases := []struct {
+		name              string
+		destinationBranch string
+		// Whether the push to the output repository is rejected by the remote.
+		rejectOutputPush bool
+		// Whether the source pull request is squashed instead of merged with a merge commit.
+		squash bool
+		// The branch of the source repository expected to revert the change.
+		expectedRevertBranch string
+		// The subject of the commit expected to revert the change.
+		expectedRevertSubject string
+	}{
+		{
+			name:                  "Output push fails",
+			rejectOutputPush:      true,
+			expectedRevertBranch:  "feature",
+			expectedRevertSubject: `Revert "update source"`,
+		},
+		{
+			name:                  "Output pull request fails after source merge",
+			destinationBranch:     "main",
+			expectedRevertBranch:  "feature__revert",
+			expectedRevertSubject: `Revert "Merge feature"`,
+		},
+		{
+			name:                  "Output pull request fails after source squash",
+			destinationBranch:     "main",
+			squash:                true,
+			expectedRevertBranch:  "feature__revert",
+			expectedRevertSubject: `Revert "Squash feature"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			redirectRemotes(t, root, "github.com", "owner", "secret")
+			source := newTestRepoChange(t, root, "source", "source of truth changes")
+			output := newTestRepoChange(t, root, "output", "hydrated files")
+			// The revert pull request targets the base branch of the source repository, not the output branch.
+			source.baseBranch, output.baseBranch = tc.destinationBranch, "release"
+			if tc.rejectOutputPush {
+				writeTestFile(t, filepath.Join(root, "owner", "output.git"), "hooks/pre-receive", "#!/bin/sh\nexit 1\n")
+				if err := os.Chmod(filepath.Join(root, "owner", "output.git", "hooks", "pre-receive"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var mu sync.Mutex
+			var revertPRs, merges []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case r.Method == http.MethodPost && r.URL.Path == "/repos/owner/source/pulls":
+					var pr map[string]string
+					json.NewDecoder(r.Body).Decode(&pr)
+					if pr["head"] == "feature__revert" {
+						revertPRs = append(revertPRs, pr["base"])
+					}
+					w.WriteHeader(http.StatusCreated)
+					fmt.Fprintf(w, `{"number": %d}`, len(revertPRs)+1)
+				case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/repos/owner/source/pulls/"):
+					merges = append(merges, r.URL.Path)
+					if len(merges) > 1 {
+						fmt.Fprint(w, `{"sha": "abc123"}`)
+						return
+					}
+					// The merge commit is not the commit pushed to the feature branch.
+					sha, err := mergeBranch(filepath.Join(root, "owner", "source.git"), "feature", tc.destinationBranch, tc.squash)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+						return
+					}
+					fmt.Fprintf(w, `{"sha": %q}`, sha)
+				default:
+					w.WriteHeader(http.StatusUnprocessableEntity)
+				}
+			}))
+			defer server.Close()
+
+			d := &deployer{
+				req:        &clouddeploy.DeployRequest{Rollout: "rollout"},
+				params:     &params{enablePullRequestMerge: true},
+				httpClient: redirectHTTPClient(server),
+			}
+			if err := d.publishChanges(context.Background(), []*repoChange{source, output}, "secret", "feature"); err == nil {
+				t.Fatal("Expected an error, but got none")
+			}
+
+			// The reverting commit on the source remote restores the original tree.
+			clone := t.TempDir()
+			mustRunGit(t, "", "clone", "--branch", tc.expectedRevertBranch, filepath.Join(root, "owner", "source.git"), clone)
+			if got := mustRunGit(t, clone, "log", "--format=%s", "-1"); got != tc.expectedRevertSubject {
+				t.Errorf("Expected a revert commit, got: %s", got)
+			}
+			if _, err := os.Stat(filepath.Join(clone, "changed.txt")); err == nil {
+				t.Error("Expected the change to be reverted")
+			}
+
+			if len(tc.destinationBranch) == 0 {
+				return
+			}
+			if !slices.Equal(revertPRs, []string{tc.destinationBranch}) {
+				t.Errorf("Expected a revert pull request against %s, got: %v", tc.destinationBranch, revertPRs)
+			}
+			if len(merges) != 2 {
+				t.Errorf("Expected the source and revert pull requests to be merged, got: %v", merges)
+			}
+		})
+	}
+}
+
+// mergeBranch merges the head branch into the base branch of the bare repository with a merge commit, or
+// squashed into a single commit, and returns the SHA of the resulting commit.
+func mergeBranch(bare, head, base string, squash bool) (string, error) {
+	work, err := os.MkdirTemp("", "merge")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(work)
+	merge := []string{"-C", work, "-c", "user.name=provider", "-c", "user.email=provider@example.com", "merge", "--no-ff", "-m", "Merge " + head, "FETCH_HEAD"}
+	if squash {
+		merge = []string{"-C", work, "merge", "--squash", "FETCH_HEAD"}
+	}
+	cmds := [][]string{
+		{"clone", "--branch", base, bare, work},
+		{"-C", work, "fetch", "origin", head},
+		merge,
+	}
+	if squash {
+		cmds = append(cmds, []string{"-C", work, "-c", "user.name=provider", "-c", "user.email=provider@example.com", "commit", "-m", "Squash " + head})
+	}
+	cmds = append(cmds, []string{"-C", work, "push", "origin", base})
+	for _, args := range cmds {
+		if _, err := runCmd(gitBin, args, "", false); err != nil {
+			return "", err
+		}
+	}
+	op, err := runCmd(gitBin, []string{"-C", work, "rev-parse", "HEAD"}, "", false)
+	return strings.TrimSpace(string(op)), err
+}
+
+func TestRevertChangeSkipsUncommittedChange(t *testing.T) {
+	root := t.TempDir()
+	redirectRemotes(t, root, "github.com", "owner", "secret")
+	c := newTestRepoChange(t, root, "source", "source of truth changes")
+	if _, err := c.gitRepo.push("feature"); err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+	// Someone else's commit is at HEAD since the feature branch already contained the change.
+	c.pushed = true
+
+	d := &deployer{req: &clouddeploy.DeployRequest{Rollout: "rollout"}, params: &params{}}
+	if err := d.revertChange(context.Background(), c, "secret", "feature"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	clone := t.TempDir()
+	mustRunGit(t, "", "clone", "--branch", "feature", filepath.Join(root, "owner", "source.git"), clone)
+	if got := mustRunGit(t, clone, "log", "--format=%s", "-1"); got != "update source" {
+		t.Errorf("Expected the feature branch to be left unchanged, got: %s", got)
+	}
+}
+
+func TestTagOutputRepo(t *testing.T) {
+	for _, backend := range []string{gitBackendCLI, gitBackendNative} {
+		t.Run(backend, func(t *testing.T) {
+			if _, err := exec.LookPath(gitBin); err != nil {
+				t.Skip("git binary not available")
+			}
+			var g gitRepository
+			var bare string
+			if backend == gitBackendCLI {
+				root := t.TempDir()
+				bare = createBareRemote(t, root, "owner", "repo", map[string]string{"README.md": "readme\n"}, 1)
+				redirectRemotes(t, root, "github.com", "owner", "secret")
+				g = newGitRepository(gitBackendCLI, "github.com", "owner", "repo", "deploy@example.com", "Cloud Deploy", nil)
+				if _, err := g.cloneRepo(filepath.Join(t.TempDir(), "repo"), "secret", cloneOptions{}); err != nil {
+					t.Fatalf("Failed to clone: %v", err)
+				}
+				if err := g.config(); err != nil {
+					t.Fatalf("Failed to configure: %v", err)
+				}
+			} else {
+				ng, remoteDir := newNativeTestRepository(t)
+				if _, err := ng.push("main"); err != nil {
+					t.Fatalf("Failed to push main: %v", err)
+				}
+				g, bare = ng, remoteDir
+			}
+
+			// The pull request is merged on the remote, so the merge commit is not available locally.
+			other := t.TempDir()
+			mustRunGit(t, "", "clone", "--branch", "main", bare, other)
+			writeTestFile(t, other, "output/cluster1.yaml", "kind: ConfigMap\n")
+			mustRunGit(t, other, "add", ".")
+			mustRunGit(t, other, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-m", "merge")
+			mustRunGit(t, other, "push", "origin", "main")
+			sha := mustRunGit(t, other, "rev-parse", "HEAD")
+
+			d := &deployer{
+				req:    &clouddeploy.DeployRequest{Pipeline: "pipeline", Release: "release-1", Rollout: "rollout-1"},
+				params: &params{hydrationClusterGroup: "prod", gitOutputBranch: "main", gitTagName: "{cluster-group}/{release}"},
+			}
+			if err := d.tagOutputRepo(g, &provider.MergeResponse{Sha: sha}); err != nil {
+				t.Fatalf("Failed to tag: %v", err)
+			}
+			if got := mustRunGit(t, bare, "cat-file", "-t", "prod/release-1"); got != "tag" {
+				t.Errorf("Expected an annotated tag, got: %s", got)
+			}
+			if got := mustRunGit(t, bare, "rev-parse", "prod/release-1^{commit}"); got != sha {
+				t.Errorf("Tagged commit mismatch\nExpected: %s\n     Got: %s", sha, got)
+			}
+
+			// A retried rollout succeeds if the tag already points to the merge commit.
+			if err := d.tagOutputRepo(g, &provider.MergeResponse{Sha: sha}); err != nil {
+				t.Errorf("Expected retagging the same commit to succeed, got: %v", err)
+			}
+
+			// An existing tag is not moved.
+			mustRunGit(t, other, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--allow-empty", "-m", "another merge")
+			mustRunGit(t, other, "push", "origin", "main")
+			err := d.tagOutputRepo(g, &provider.MergeResponse{Sha: mustRunGit(t, other, "rev-parse", "HEAD")})
+			if err == nil || !strings.Contains(err.Error(), "tag prod/release-1 already exists and points to "+sha) {
+				t.Errorf("Expected an error naming the existing tag, got: %v", err)
+			}
+			if got := mustRunGit(t, bare, "rev-parse", "prod/release-1^{commit}"); got != sha {
+				t.Errorf("Expected the tag not to be moved, got: %s", got)
+			}
+		})
+	}
+}
+
+// installFakeHydrate puts a hydrate script with the provided body on the PATH.
+func installFakeHydrate(t *testing.T, script string) {
+	t.Helper()
+	binDir := t.TempDir()
+	writeTestFile(t, binDir, "hydrate", "#!/bin/sh\n"+script)
+	if err := os.Chmod(filepath.Join(binDir, "hydrate"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRunHydrationCLI(t *testing.T) {
+	argsFile := filepath.Join(t.TempDir(), "args")
+	installFakeHydrate(t, fmt.Sprintf("echo \"$@\" >> %s\n", argsFile))
+	sourceDir := filepath.Join(t.TempDir(), "repo")
+	outputDir := filepath.Join(t.TempDir(), "repo")
+	writeTestFile(t, outputDir, "output/stale.yaml", "kind: ConfigMap\n")
+
+	if err := runHydrationCLI(sourceDir, "base_library/", "overlays/", outputDir, "output", filepath.Join(sourceDir, "source_of_truth.csv")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(outputDir, "output", "stale.yaml")); err == nil {
+		t.Error("Expected the output directory of the output repository to be cleaned")
+	}
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("-b %s -o %s -y %s %s",
+		filepath.Join(sourceDir, "base_library"),
+		filepath.Join(sourceDir, "overlays"),
+		filepath.Join(outputDir, "output"),
+		filepath.Join(sourceDir, "source_of_truth.csv"))
+	if got := strings.Split(strings.TrimSpace(string(args)), "\n")[0]; got != want {
+		t.Errorf("Hydrate arguments mismatch\nExpected: %s\n     Got: %s", want, got)
+	}
+}
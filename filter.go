@@ -0,0 +1,155 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// excludedClustersMetadataKey is the deploy result metadata key listing the clusters excluded by a
+// clusterFilter, with the reason of each exclusion.
+const excludedClustersMetadataKey = "excluded-clusters"
+
+// clusterNamePattern matches cluster names. It is either a glob, e.g. "cluster-*", a regular expression
+// enclosed in slashes matching the whole name, e.g. "/cluster-[0-9]+/", or a literal name.
+type clusterNamePattern struct {
+	pattern string
+	// Regular expression of the pattern, nil for a glob or literal name.
+	re *regexp.Regexp
+}
+
+// parseClusterNamePatterns parses the comma separated cluster name patterns.
+func parseClusterNamePatterns(value string) ([]clusterNamePattern, error) {
+	var patterns []clusterNamePattern
+	for _, p := range strings.Split(value, ",") {
+		p = strings.TrimSpace(p)
+		if len(p) == 0 {
+			continue
+		}
+		if len(p) > 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			re, err := regexp.Compile("^(?:" + p[1:len(p)-1] + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression %s: %v", p, err)
+			}
+			patterns = append(patterns, clusterNamePattern{pattern: p, re: re})
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %s: %v", p, err)
+		}
+		patterns = append(patterns, clusterNamePattern{pattern: p})
+	}
+	return patterns, nil
+}
+
+func (p clusterNamePattern) matches(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	match, _ := path.Match(p.pattern, name)
+	return match
+}
+
+// isLiteral returns whether the pattern only matches the name equal to it.
+func (p clusterNamePattern) isLiteral() bool {
+	return p.re == nil && !strings.ContainsAny(p.pattern, `*?[\`)
+}
+
+func (p clusterNamePattern) String() string {
+	return p.pattern
+}
+
+// clusterFilter restricts the clusters selected by cluster group, tags and expression to an allowlist of names,
+// and excludes clusters by name or tag, e.g. to leave out a cluster during an incident.
+type clusterFilter struct {
+	matchNames   []clusterNamePattern
+	excludeNames []clusterNamePattern
+	excludeTags  []string
+}
+
+// clusterExclusion is a selected cluster that is excluded by a clusterFilter.
+type clusterExclusion struct {
+	name   string
+	reason string
+}
+
+func (e clusterExclusion) String() string {
+	return fmt.Sprintf("%s (%s)", e.name, e.reason)
+}
+
+// formatExclusions returns the exclusions as a comma separated list.
+func formatExclusions(exclusions []clusterExclusion) string {
+	s := make([]string, len(exclusions))
+	for i, e := range exclusions {
+		s[i] = e.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// clusterSelection collects the clusters selected by cluster group, tags and expression, applying the filter.
+type clusterSelection struct {
+	// Filter applied to the selected clusters, none if nil.
+	filter *clusterFilter
+	// Clusters selected before applying the filter.
+	candidates []string
+	clusters   []string
+	excluded   []clusterExclusion
+}
+
+// newClusterSelection returns an empty selection applying the filter, which may be nil.
+func newClusterSelection(filter *clusterFilter) *clusterSelection {
+	return &clusterSelection{filter: filter, clusters: []string{}}
+}
+
+// add adds the cluster with the tags, unless the filter does not match or excludes it.
+func (s *clusterSelection) add(name string, tags []string) {
+	s.candidates = append(s.candidates, name)
+	f := s.filter
+	if f == nil {
+		s.clusters = append(s.clusters, name)
+		return
+	}
+	if len(f.matchNames) != 0 && !slices.ContainsFunc(f.matchNames, func(p clusterNamePattern) bool { return p.matches(name) }) {
+		return
+	}
+	if i := slices.IndexFunc(f.excludeNames, func(p clusterNamePattern) bool { return p.matches(name) }); i != -1 {
+		s.excluded = append(s.excluded, clusterExclusion{name: name, reason: fmt.Sprintf("%s %s", excludeClusterNamesEnvKey, f.excludeNames[i])})
+		return
+	}
+	for _, tag := range f.excludeTags {
+		if slices.Contains(tags, tag) {
+			s.excluded = append(s.excluded, clusterExclusion{name: name, reason: fmt.Sprintf("%s %s", excludeClustersHavingTagsEnvKey, tag)})
+			return
+		}
+	}
+	s.clusters = append(s.clusters, name)
+}
+
+// result returns the selected and excluded clusters. Literal names of the allowlist must be selected before
+// applying the filter, so a misspelled or wrongly grouped cluster fails the selection rather than being skipped.
+func (s *clusterSelection) result() ([]string, []clusterExclusion, error) {
+	if s.filter != nil {
+		for _, p := range s.filter.matchNames {
+			if p.isLiteral() && !slices.Contains(s.candidates, p.pattern) {
+				return nil, nil, fmt.Errorf("cluster %q of parameter %q is not in the cluster group or not matched by the tags", p.pattern, matchClusterNamesEnvKey)
+			}
+		}
+	}
+	return s.clusters, s.excluded, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClusterNamePatterns(t *testing.T) {
+	patterns, err := parseClusterNamePatterns(" cluster-a, us-*,, /eu-[0-9]+/ ,cluster-?b")
+	if err != nil {
+		t.Fatalf("Failed to parse patterns: %v", err)
+	}
+	testCases := map[string][]bool{
+		"cluster-a":  {true, false, false, false},
+		"cluster-ab": {false, false, false, true},
+		"us-east1":   {false, true, false, false},
+		"eu-1":       {false, false, true, false},
+		"eu-1a":      {false, false, false, false},
+		"cluster-bb": {false, false, false, true},
+	}
+	for name, want := range testCases {
+		var got []bool
+		for _, p := range patterns {
+			got = append(got, p.matches(name))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Matches of %s mismatch\nExpected: %v\n     Got: %v", name, want, got)
+		}
+	}
+	var literal []string
+	for _, p := range patterns {
+		if p.isLiteral() {
+			literal = append(literal, p.String())
+		}
+	}
+	if want := []string{"cluster-a"}; !reflect.DeepEqual(literal, want) {
+		t.Errorf("Expected literal patterns %v, got: %v", want, literal)
+	}
+
+	for _, value := range []string{"/eu-[/", "cluster-[a"} {
+		if _, err := parseClusterNamePatterns(value); err == nil {
+			t.Errorf("Expected error parsing %q", value)
+		}
+	}
+}
+
+func TestClusterSelection(t *testing.T) {
+	clusters := []struct {
+		name string
+		tags []string
+	}{
+		{"cluster-a", []string{"us"}},
+		{"cluster-b", []string{"us", "incident"}},
+		{"cluster-c", []string{"eu"}},
+		{"other-d", []string{"eu"}},
+	}
+	mustParse := func(value string) []clusterNamePattern {
+		p, err := parseClusterNamePatterns(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	testCases := []struct {
+		name             string
+		filter           *clusterFilter
+		expectedClusters []string
+		expectedExcluded []clusterExclusion
+		expectedError    string
+	}{
+		{
+			name:             "No filter",
+			expectedClusters: []string{"cluster-a", "cluster-b", "cluster-c", "other-d"},
+		},
+		{
+			name:             "Allowlist",
+			filter:           &clusterFilter{matchNames: mustParse("cluster-a,cluster-b")},
+			expectedClusters: []string{"cluster-a", "cluster-b"},
+		},
+		{
+			name:             "Allowlist glob and denylist",
+			filter:           &clusterFilter{matchNames: mustParse("cluster-*"), excludeNames: mustParse("/.*-c/")},
+			expectedClusters: []string{"cluster-a", "cluster-b"},
+			expectedExcluded: []clusterExclusion{{name: "cluster-c", reason: "exclude-cluster-names /.*-c/"}},
+		},
+		{
+			name:             "Excluded tags",
+			filter:           &clusterFilter{excludeTags: []string{"incident", "eu"}},
+			expectedClusters: []string{"cluster-a"},
+			expectedExcluded: []clusterExclusion{
+				{name: "cluster-b", reason: "exclude-clusters-having-tags incident"},
+				{name: "cluster-c", reason: "exclude-clusters-having-tags eu"},
+				{name: "other-d", reason: "exclude-clusters-having-tags eu"},
+			},
+		},
+		{
+			name:             "Excluded cluster of the allowlist",
+			filter:           &clusterFilter{matchNames: mustParse("cluster-a,cluster-b"), excludeTags: []string{"incident"}},
+			expectedClusters: []string{"cluster-a"},
+			expectedExcluded: []clusterExclusion{{name: "cluster-b", reason: "exclude-clusters-having-tags incident"}},
+		},
+		{
+			name:          "Unknown cluster of the allowlist",
+			filter:        &clusterFilter{matchNames: mustParse("cluster-a,cluster-e")},
+			expectedError: `cluster "cluster-e" of parameter "match-cluster-names" is not in the cluster group`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newClusterSelection(tc.filter)
+			for _, c := range clusters {
+				s.add(c.name, c.tags)
+			}
+			got, excluded, err := s.result()
+			if len(tc.expectedError) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("Expected error %q, got: %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.expectedClusters) {
+				t.Errorf("Clusters mismatch\nExpected: %v\n     Got: %v", tc.expectedClusters, got)
+			}
+			if !reflect.DeepEqual(excluded, tc.expectedExcluded) {
+				t.Errorf("Excluded clusters mismatch\nExpected: %v\n     Got: %v", tc.expectedExcluded, excluded)
+			}
+		})
+	}
+}
@@ -15,99 +15,430 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 const (
 	gitBin = "git"
+	gpgBin = "gpg"
 	remote = "origin"
 )
 
-// gitRepository holds the repository values for git commands.
-type gitRepository struct {
+// Supported git backends.
+const (
+	// gitBackendCLI runs the git binary for every operation.
+	gitBackendCLI = "cli"
+	// gitBackendNative uses a Go implementation of git and does not require the git binary.
+	gitBackendNative = "native"
+)
+
+// gitRepository provides the git operations the deployer performs on a repository. Operations
+// return the output of the operation, if any.
+type gitRepository interface {
+	// info returns the values describing the repository.
+	info() *repoInfo
+	// cloneRepo clones the Git repository into the directory, which must not exist or be empty.
+	cloneRepo(dir, secret string, opts cloneOptions) ([]byte, error)
+	// config sets up the committer username and email, and commit signing if a signing key is set, in
+	// the Git repository.
+	config() error
+	// checkoutBranch checkouts and resets an existing branch or creates a new one.
+	checkoutBranch(branch string) ([]byte, error)
+	// add adds all the files in the working tree to the index.
+	add() ([]byte, error)
+	// detectDiff returns the working tree status, which is empty if there are no changes.
+	detectDiff() ([]byte, error)
+	// commit commits all changes to the repository with the provided message.
+	commit(msg string) ([]byte, error)
+	// push pushes a branch to the remote.
+	push(branch string) ([]byte, error)
+	// checkIfExists returns a non-empty output if the branch exists on the remote.
+	checkIfExists(branch string) ([]byte, error)
+	// pull fast-forwards the branch to a remote branch. Returns an error wrapping errPullDiverged if the
+	// local branch has commits that are not present on the remote branch.
+	pull(branch string) ([]byte, error)
+	// fetch fetches a remote branch, so that its commits are available locally.
+	fetch(branch string) ([]byte, error)
+	// tag creates an annotated tag of the commit with the message.
+	tag(name, msg, commit string) ([]byte, error)
+	// pushTag pushes a tag to the remote, an existing remote tag is not moved.
+	pushTag(name string) ([]byte, error)
+	// remoteTagCommit returns the SHA of the commit a tag of the remote points to, empty if the remote has
+	// no such tag.
+	remoteTagCommit(name string) (string, error)
+	// headCommit returns the SHA of the HEAD commit.
+	headCommit() (string, error)
+	// revert commits the reversal of the commit, which must be the HEAD commit for the native backend. A
+	// merge commit is reverted relative to its first parent.
+	revert(commit string) ([]byte, error)
+	// pushNote adds a note with the message to the commit under the notes ref and pushes the notes ref,
+	// after fetching it from the remote. Returns an error wrapping errPushRejected if the remote notes
+	// ref moved concurrently.
+	pushNote(ref, commit, msg string) ([]byte, error)
+	// rebaseOnRemote fetches a remote branch and rebases the local commits onto it. If the rebase fails
+	// then it is aborted, leaving the branch unchanged, and an error wrapping errRebaseFailed is returned.
+	rebaseOnRemote(branch string) ([]byte, error)
+	// resetToRemote fetches a remote branch and resets the branch and working tree to it, discarding
+	// local commits and changes.
+	resetToRemote(branch string) ([]byte, error)
+}
+
+var (
+	// errPushRejected is wrapped by the error push returns when the remote branch has commits that
+	// are not present locally.
+	errPushRejected = errors.New("push rejected because the remote branch has diverged")
+	// errRebaseFailed is wrapped by the error rebaseOnRemote returns when the local commits could not
+	// be rebased onto the remote branch.
+	errRebaseFailed = errors.New("rebase onto the remote branch failed")
+	// errPullDiverged is wrapped by the error pull returns when the local branch cannot be fast-forwarded
+	// to the remote branch.
+	errPullDiverged = errors.New("pull failed because the local branch has diverged from the remote branch")
+)
+
+// cloneOptions limits how much of a repository is cloned. The zero value clones the full repository.
+type cloneOptions struct {
+	// Number of commits of history to fetch, 0 fetches the full history.
+	depth int
+	// If set then only this branch is fetched and checked out.
+	singleBranch string
+	// Paths relative to the repository root to check out, all paths are checked out when empty.
+	sparsePaths []string
+}
+
+// repoInfo holds the repository values shared by the git backends.
+type repoInfo struct {
+	// Directory of the cloned repository.
 	dir      string
 	hostname string
 	owner    string
 	repoName string
 	email    string
 	username string
+	// Key used to sign commits, commits are not signed if nil.
+	signingKey *signingKey
+}
+
+func (r *repoInfo) info() *repoInfo {
+	return r
 }
 
-// newGitRepository returns a gitRepository to interact with a repository.
-func newGitRepository(hostname, owner, repoName, email, username string) *gitRepository {
-	return &gitRepository{
-		hostname: hostname,
-		owner:    owner,
-		repoName: repoName,
-		email:    email,
-		username: username,
+// commitEmail returns the email of commits and tags. Some value is needed for the email otherwise
+// writing commits fails.
+func (r *repoInfo) commitEmail() string {
+	if len(r.email) == 0 {
+		return "<>"
+	}
+	return r.email
+}
+
+// newGitRepository returns a gitRepository to interact with a repository using the provided git backend.
+// Commits are signed with the signing key, if provided.
+func newGitRepository(backend, hostname, owner, repoName, email, username string, key *signingKey) gitRepository {
+	info := repoInfo{
+		hostname:   hostname,
+		owner:      owner,
+		repoName:   repoName,
+		email:      email,
+		username:   username,
+		signingKey: key,
+	}
+	if backend == gitBackendNative {
+		return &nativeGitRepository{repoInfo: info}
 	}
+	return &cliGitRepository{repoInfo: info}
 }
 
-// cloneRepo clones a Git repository to the local filesystem.
-func (g *gitRepository) cloneRepo(secret string) ([]byte, error) {
-	args := []string{"clone", fmt.Sprintf("https://%s:%s@%s/%s/%s.git", g.owner, secret, g.hostname, g.owner, g.repoName)}
-	g.dir = g.repoName
-	return runCmd(gitBin, args, "", false)
+// cliGitRepository implements the gitRepository interface by running the git binary.
+type cliGitRepository struct {
+	repoInfo
+}
+
+// cloneRepo clones a Git repository to the local filesystem. For sparse checkouts the clone is made
+// without blobs, which are fetched on demand for the checked out paths only.
+func (g *cliGitRepository) cloneRepo(dir, secret string, opts cloneOptions) ([]byte, error) {
+	args := []string{"clone"}
+	if opts.depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(opts.depth))
+	}
+	if len(opts.singleBranch) > 0 {
+		args = append(args, "--single-branch", "--branch", opts.singleBranch)
+	} else if opts.depth > 0 {
+		// --depth implies --single-branch, keep fetching all branches unless asked otherwise.
+		args = append(args, "--no-single-branch")
+	}
+	if len(opts.sparsePaths) > 0 {
+		args = append(args, "--filter=blob:none", "--no-checkout")
+	}
+	args = append(args, fmt.Sprintf("https://%s:%s@%s/%s/%s.git", g.owner, secret, g.hostname, g.owner, g.repoName), dir)
+	g.dir = dir
+	op, err := runCmd(gitBin, args, "", false)
+	if err != nil || len(opts.sparsePaths) == 0 {
+		return op, err
+	}
+
+	// Patterns are anchored to the repository root, so a file or directory of the same name
+	// elsewhere in the repository is not checked out.
+	sArgs := []string{"sparse-checkout", "set", "--no-cone"}
+	for _, p := range opts.sparsePaths {
+		sArgs = append(sArgs, "/"+strings.TrimPrefix(filepath.ToSlash(filepath.Clean(p)), "/"))
+	}
+	if _, err := runCmd(gitBin, sArgs, g.dir, true); err != nil {
+		return nil, err
+	}
+	return runCmd(gitBin, []string{"checkout"}, g.dir, true)
 }
 
 // config sets up the git config with a username and email in the Git repository.
-func (g *gitRepository) config() error {
+func (g *cliGitRepository) config() error {
 	uArgs := []string{"config", "user.name", fmt.Sprintf("%q", g.username)}
 	if _, err := runCmd(gitBin, uArgs, g.dir, true); err != nil {
 		return err
 	}
 
-	// We need to set some value for the email otherwise run into errors when writing commits.
-	email := g.email
-	if len(email) == 0 {
-		email = "<>"
-	}
-	eArgs := []string{"config", "user.email", email}
+	eArgs := []string{"config", "user.email", g.commitEmail()}
 	if _, err := runCmd(gitBin, eArgs, g.dir, true); err != nil {
 		return err
 	}
+
+	if g.signingKey == nil {
+		return nil
+	}
+	return g.configSigning()
+}
+
+// configSigning sets up git to sign every commit with the signing key. The key is written into the .git
+// directory so it is removed along with the repository. OpenPGP keys are imported into a gpg keyring in the
+// .git directory, which git uses through a gpg wrapper, so the default keyring of the user is not changed.
+func (g *cliGitRepository) configSigning() error {
+	gitDir, err := filepath.Abs(filepath.Join(g.dir, ".git"))
+	if err != nil {
+		return err
+	}
+	keyPath := filepath.Join(gitDir, "signing_key")
+	if err := os.WriteFile(keyPath, g.signingKey.data, 0600); err != nil {
+		return fmt.Errorf("unable to write signing key: %v", err)
+	}
+
+	// For SSH git expects the path of the key, for OpenPGP the key ID.
+	keyID := keyPath
+	config := [][]string{{"gpg.format", g.signingKey.format}}
+	if g.signingKey.format == signingFormatOpenPGP {
+		gpgHome := filepath.Join(gitDir, "gnupg")
+		if err := os.MkdirAll(gpgHome, 0700); err != nil {
+			return fmt.Errorf("unable to create gpg home directory: %v", err)
+		}
+		if _, err := runCmd(gpgBin, []string{"--homedir", gpgHome, "--batch", "--import", keyPath}, "", false); err != nil {
+			return fmt.Errorf("unable to import signing key: %v", err)
+		}
+		op, err := runCmd(gpgBin, []string{"--homedir", gpgHome, "--batch", "--with-colons", "--import-options", "show-only", "--import", keyPath}, "", false)
+		if err != nil {
+			return fmt.Errorf("unable to determine signing key fingerprint: %v", err)
+		}
+		if keyID, err = gpgFingerprint(op); err != nil {
+			return err
+		}
+		program := filepath.Join(gitDir, "gpg")
+		script := fmt.Sprintf("#!/bin/sh\nexec %s --homedir %s \"$@\"\n", gpgBin, shellQuote(gpgHome))
+		if err := os.WriteFile(program, []byte(script), 0700); err != nil {
+			return fmt.Errorf("unable to write gpg wrapper: %v", err)
+		}
+		config = append(config, []string{"gpg.program", program})
+	}
+
+	for _, kv := range append(config, []string{"user.signingkey", keyID}, []string{"commit.gpgsign", "true"}) {
+		if _, err := runCmd(gitBin, []string{"config", kv[0], kv[1]}, g.dir, true); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// shellQuote quotes the string as a single word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// gpgFingerprint returns the fingerprint of the first key in the colon delimited gpg output.
+func gpgFingerprint(op []byte) (string, error) {
+	for _, line := range strings.Split(string(op), "\n") {
+		fields := strings.Split(line, ":")
+		if fields[0] == "fpr" && len(fields) > 9 {
+			return fields[9], nil
+		}
+	}
+	return "", fmt.Errorf("no fingerprint found for signing key")
+}
+
 // checkoutBranch checkouts and resets an existing branch or creates a new one.
-func (g *gitRepository) checkoutBranch(branch string) ([]byte, error) {
+func (g *cliGitRepository) checkoutBranch(branch string) ([]byte, error) {
 	args := []string{"checkout", "-B", branch}
 	return runCmd(gitBin, args, g.dir, true)
 }
 
 // add adds all the files in the working tree to the index.
-func (g *gitRepository) add() ([]byte, error) {
+func (g *cliGitRepository) add() ([]byte, error) {
 	args := []string{"add", "."}
 	return runCmd(gitBin, args, g.dir, true)
 }
 
 // detectDiff gets the working tree status and uses the porcelain command to simplify scripting.
-func (g *gitRepository) detectDiff() ([]byte, error) {
+func (g *cliGitRepository) detectDiff() ([]byte, error) {
 	args := []string{"status", "--porcelain"}
 	return runCmd(gitBin, args, g.dir, true)
 }
 
 // commit commits the changes in the index to the repository with the provided message.
-func (g *gitRepository) commit(msg string) ([]byte, error) {
+func (g *cliGitRepository) commit(msg string) ([]byte, error) {
 	args := []string{"commit", "-a", "-m", msg}
 	return runCmd(gitBin, args, g.dir, true)
 }
 
 // push pushes the changes a remote branch.
-func (g *gitRepository) push(branch string) ([]byte, error) {
+func (g *cliGitRepository) push(branch string) ([]byte, error) {
 	args := []string{"push", remote, branch}
-	return runCmd(gitBin, args, g.dir, true)
+	op, err := runCmd(gitBin, args, g.dir, true)
+	if err != nil && isPushRejected(err.Error()) {
+		return op, fmt.Errorf("%w: %v", errPushRejected, err)
+	}
+	return op, err
+}
+
+// isPushRejected returns whether the git push error output reports a non-fast-forward rejection.
+func isPushRejected(msg string) bool {
+	return strings.Contains(msg, "[rejected]") || strings.Contains(msg, "non-fast-forward") || strings.Contains(msg, "fetch first")
 }
 
 // checkIfExists checks if a branch exists on the remote.
-func (g *gitRepository) checkIfExists(branch string) ([]byte, error) {
+func (g *cliGitRepository) checkIfExists(branch string) ([]byte, error) {
 	args := []string{"ls-remote", "--heads", remote, fmt.Sprintf("refs/heads/%s", branch)}
 	return runCmd(gitBin, args, g.dir, true)
 }
 
-// pull pulls changes from a remote branch.
-func (g *gitRepository) pull(branch string) ([]byte, error) {
-	args := []string{"pull", remote, branch}
+// pull fast-forwards the branch to a remote branch. Diverged branches are not merged, so the result does
+// not depend on the pull.rebase and pull.ff settings of the git installation.
+func (g *cliGitRepository) pull(branch string) ([]byte, error) {
+	args := []string{"pull", "--ff-only", remote, branch}
+	op, err := runCmd(gitBin, args, g.dir, true)
+	if err != nil && strings.Contains(err.Error(), "Not possible to fast-forward") {
+		return op, fmt.Errorf("%w: %v", errPullDiverged, err)
+	}
+	return op, err
+}
+
+// fetch fetches a remote branch, the fetched commit is available as FETCH_HEAD.
+func (g *cliGitRepository) fetch(branch string) ([]byte, error) {
+	args := []string{"fetch", remote, branch}
+	return runCmd(gitBin, args, g.dir, true)
+}
+
+// tag creates an annotated tag of the commit with the message.
+func (g *cliGitRepository) tag(name, msg, commit string) ([]byte, error) {
+	args := []string{"tag", "-a", "-m", msg, name, commit}
 	return runCmd(gitBin, args, g.dir, true)
 }
+
+// pushTag pushes a tag to the remote.
+func (g *cliGitRepository) pushTag(name string) ([]byte, error) {
+	args := []string{"push", remote, fmt.Sprintf("refs/tags/%s", name)}
+	return runCmd(gitBin, args, g.dir, true)
+}
+
+// remoteTagCommit returns the SHA of the commit a tag of the remote points to, the peeled SHA of an
+// annotated tag.
+func (g *cliGitRepository) remoteTagCommit(name string) (string, error) {
+	ref := fmt.Sprintf("refs/tags/%s", name)
+	op, err := runCmd(gitBin, []string{"ls-remote", remote, ref, ref + "^{}"}, g.dir, false)
+	if err != nil {
+		return "", err
+	}
+	var sha string
+	for _, line := range strings.Split(strings.TrimSpace(string(op)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if fields[1] == ref+"^{}" {
+			return fields[0], nil
+		}
+		if fields[1] == ref {
+			sha = fields[0]
+		}
+	}
+	return sha, nil
+}
+
+// headCommit returns the SHA of the HEAD commit.
+func (g *cliGitRepository) headCommit() (string, error) {
+	op, err := runCmd(gitBin, []string{"rev-parse", "HEAD"}, g.dir, false)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(op)), nil
+}
+
+// revert commits the reversal of the commit, relative to its first parent if it is a merge commit.
+func (g *cliGitRepository) revert(commit string) ([]byte, error) {
+	op, err := runCmd(gitBin, []string{"rev-list", "--parents", "-n", "1", commit}, g.dir, false)
+	if err != nil {
+		return op, err
+	}
+	args := []string{"revert", "--no-edit"}
+	if len(strings.Fields(string(op))) > 2 {
+		args = append(args, "-m", "1")
+	}
+	return runCmd(gitBin, append(args, commit), g.dir, true)
+}
+
+// pushNote adds a note to the commit and pushes the notes ref.
+func (g *cliGitRepository) pushNote(ref, commit, msg string) ([]byte, error) {
+	op, err := runCmd(gitBin, []string{"ls-remote", remote, ref}, g.dir, true)
+	if err != nil {
+		return op, err
+	}
+	// Notes of other commits are kept by starting from the remote notes, if any.
+	if len(op) != 0 {
+		if op, err := runCmd(gitBin, []string{"fetch", remote, fmt.Sprintf("+%s:%s", ref, ref)}, g.dir, true); err != nil {
+			return op, err
+		}
+	}
+	if op, err := runCmd(gitBin, []string{"notes", "--ref", ref, "add", "-f", "-m", msg, commit}, g.dir, true); err != nil {
+		return op, err
+	}
+	op, err = runCmd(gitBin, []string{"push", remote, ref}, g.dir, true)
+	if err != nil && isPushRejected(err.Error()) {
+		return op, fmt.Errorf("%w: %v", errPushRejected, err)
+	}
+	return op, err
+}
+
+// rebaseOnRemote fetches a remote branch and rebases the local commits onto it, aborting the rebase
+// if it fails.
+func (g *cliGitRepository) rebaseOnRemote(branch string) ([]byte, error) {
+	if op, err := g.fetch(branch); err != nil {
+		return op, err
+	}
+	op, err := runCmd(gitBin, []string{"rebase", "FETCH_HEAD"}, g.dir, true)
+	if err != nil {
+		if _, abortErr := runCmd(gitBin, []string{"rebase", "--abort"}, g.dir, true); abortErr != nil {
+			return op, fmt.Errorf("%w: %v, and aborting the rebase failed: %v", errRebaseFailed, err, abortErr)
+		}
+		return op, fmt.Errorf("%w: %v", errRebaseFailed, err)
+	}
+	return op, nil
+}
+
+// resetToRemote fetches a remote branch and resets the branch and working tree to it.
+func (g *cliGitRepository) resetToRemote(branch string) ([]byte, error) {
+	if op, err := g.fetch(branch); err != nil {
+		return op, err
+	}
+	if op, err := runCmd(gitBin, []string{"reset", "--hard", "FETCH_HEAD"}, g.dir, true); err != nil {
+		return op, err
+	}
+	return runCmd(gitBin, []string{"clean", "-fd"}, g.dir, true)
+}
@@ -0,0 +1,385 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// nativeGitRepository implements the gitRepository interface with go-git, so the git binary is not
+// required. Errors returned by go-git are wrapped and can be inspected with errors.Is and errors.As.
+type nativeGitRepository struct {
+	repoInfo
+	repo   *git.Repository
+	auth   *githttp.BasicAuth
+	signer git.Signer
+}
+
+// cloneRepo clones a Git repository to the local filesystem. Sparse checkouts are not supported.
+func (g *nativeGitRepository) cloneRepo(dir, secret string, opts cloneOptions) ([]byte, error) {
+	if len(opts.sparsePaths) > 0 {
+		return nil, fmt.Errorf("sparse checkout is not supported by the %s git backend", gitBackendNative)
+	}
+	g.dir = dir
+	g.auth = &githttp.BasicAuth{Username: g.owner, Password: secret}
+	co := &git.CloneOptions{
+		URL:   fmt.Sprintf("https://%s/%s/%s.git", g.hostname, g.owner, g.repoName),
+		Auth:  g.auth,
+		Depth: opts.depth,
+	}
+	if len(opts.singleBranch) > 0 {
+		co.SingleBranch = true
+		co.ReferenceName = plumbing.NewBranchReferenceName(opts.singleBranch)
+	}
+	repo, err := git.PlainClone(g.dir, false, co)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone: %w", err)
+	}
+	g.repo = repo
+	return nil, nil
+}
+
+// config sets up the git config with a username and email in the Git repository.
+func (g *nativeGitRepository) config() error {
+	cfg, err := g.repo.Config()
+	if err != nil {
+		return fmt.Errorf("failed to read git config: %w", err)
+	}
+	cfg.User.Name = g.username
+	cfg.User.Email = g.commitEmail()
+	if err := g.repo.SetConfig(cfg); err != nil {
+		return fmt.Errorf("failed to write git config: %w", err)
+	}
+
+	if g.signingKey == nil || g.signer != nil {
+		return nil
+	}
+	switch g.signingKey.format {
+	case signingFormatOpenPGP:
+		entity, err := openPGPEntity(g.signingKey.data)
+		if err != nil {
+			return err
+		}
+		g.signer = &openPGPSigner{entity: entity}
+	case signingFormatSSH:
+		signer, err := newSSHSigner(g.signingKey.data)
+		if err != nil {
+			return err
+		}
+		g.signer = signer
+	default:
+		return fmt.Errorf("unsupported signing key format: %s", g.signingKey.format)
+	}
+	return nil
+}
+
+// openPGPSigner signs git objects with an OpenPGP key, producing an armored detached signature.
+type openPGPSigner struct {
+	entity *openpgp.Entity
+}
+
+// Sign implements the go-git Signer interface.
+func (s *openPGPSigner) Sign(message io.Reader) ([]byte, error) {
+	var b bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&b, s.entity, message, nil); err != nil {
+		return nil, fmt.Errorf("unable to sign: %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+// checkoutBranch checkouts and resets an existing branch or creates a new one. This mirrors
+// "git checkout -B": the branch is pointed at HEAD and local changes are kept.
+func (g *nativeGitRepository) checkoutBranch(branch string) ([]byte, error) {
+	head, err := g.repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve HEAD: %w", err)
+	}
+	name := plumbing.NewBranchReferenceName(branch)
+	if err := g.repo.Storer.SetReference(plumbing.NewHashReference(name, head.Hash())); err != nil {
+		return nil, fmt.Errorf("failed to reset branch %s: %w", branch, err)
+	}
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open worktree: %w", err)
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Branch: name, Keep: true}); err != nil {
+		return nil, fmt.Errorf("failed to checkout branch %s: %w", branch, err)
+	}
+	return nil, nil
+}
+
+// add adds all the files in the working tree to the index.
+func (g *nativeGitRepository) add() ([]byte, error) {
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open worktree: %w", err)
+	}
+	if err := wt.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		return nil, fmt.Errorf("failed to add changes: %w", err)
+	}
+	return nil, nil
+}
+
+// detectDiff gets the working tree status, the output is empty when there are no changes.
+func (g *nativeGitRepository) detectDiff() ([]byte, error) {
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open worktree: %w", err)
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status: %w", err)
+	}
+	if status.IsClean() {
+		return nil, nil
+	}
+	return []byte(status.String()), nil
+}
+
+// commit commits all changes to the repository with the provided message.
+func (g *nativeGitRepository) commit(msg string) ([]byte, error) {
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open worktree: %w", err)
+	}
+	hash, err := wt.Commit(msg, &git.CommitOptions{
+		All: true,
+		Author: &object.Signature{
+			Name:  g.username,
+			Email: g.commitEmail(),
+			When:  time.Now(),
+		},
+		Signer: g.signer,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	return []byte(hash.String()), nil
+}
+
+// push pushes the changes a remote branch.
+func (g *nativeGitRepository) push(branch string) ([]byte, error) {
+	ref := plumbing.NewBranchReferenceName(branch)
+	err := g.repo.Push(&git.PushOptions{
+		RemoteName: remote,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("%s:%s", ref, ref))},
+		Auth:       g.auth,
+	})
+	// go-git reports rejected pushes with an unwrapped "non-fast-forward update" error.
+	if err != nil && isPushRejected(err.Error()) {
+		return nil, fmt.Errorf("failed to push branch %s: %w: %w", branch, errPushRejected, err)
+	}
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, fmt.Errorf("failed to push branch %s: %w", branch, err)
+	}
+	return nil, nil
+}
+
+// checkIfExists checks if a branch exists on the remote, the output is empty when it does not.
+func (g *nativeGitRepository) checkIfExists(branch string) ([]byte, error) {
+	r, err := g.repo.Remote(remote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get remote %s: %w", remote, err)
+	}
+	refs, err := r.List(&git.ListOptions{Auth: g.auth})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote references: %w", err)
+	}
+	name := plumbing.NewBranchReferenceName(branch)
+	for _, ref := range refs {
+		if ref.Name() == name {
+			return []byte(fmt.Sprintf("%s\t%s", ref.Hash(), ref.Name())), nil
+		}
+	}
+	return nil, nil
+}
+
+// pull fast-forwards the branch to a remote branch.
+func (g *nativeGitRepository) pull(branch string) ([]byte, error) {
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open worktree: %w", err)
+	}
+	err = wt.Pull(&git.PullOptions{
+		RemoteName:    remote,
+		ReferenceName: plumbing.NewBranchReferenceName(branch),
+		Auth:          g.auth,
+	})
+	if errors.Is(err, git.ErrNonFastForwardUpdate) {
+		return nil, fmt.Errorf("%w: failed to pull branch %s: %v", errPullDiverged, branch, err)
+	}
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, fmt.Errorf("failed to pull branch %s: %w", branch, err)
+	}
+	return nil, nil
+}
+
+// headCommit returns the SHA of the HEAD commit.
+func (g *nativeGitRepository) headCommit() (string, error) {
+	head, err := g.repo.Head()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve HEAD: %w", err)
+	}
+	return head.Hash().String(), nil
+}
+
+// revert commits the reversal of the commit, which must be the HEAD commit. The working tree is reset to the
+// first parent of HEAD and the result is committed on top of HEAD, so the HEAD commit must not be the root
+// commit.
+func (g *nativeGitRepository) revert(commitSHA string) ([]byte, error) {
+	head, err := g.repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve HEAD: %w", err)
+	}
+	if head.Hash().String() != commitSHA {
+		return nil, fmt.Errorf("unable to revert commit %s, only the HEAD commit %s can be reverted by the %s git backend", commitSHA, head.Hash(), gitBackendNative)
+	}
+	commit, err := g.repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HEAD commit: %w", err)
+	}
+	if commit.NumParents() == 0 {
+		return nil, fmt.Errorf("unable to revert root commit %s", commit.Hash)
+	}
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open worktree: %w", err)
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: commit.ParentHashes[0], Mode: git.HardReset}); err != nil {
+		return nil, fmt.Errorf("failed to reset to the first parent of HEAD: %w", err)
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: commit.Hash, Mode: git.SoftReset}); err != nil {
+		return nil, fmt.Errorf("failed to reset to HEAD: %w", err)
+	}
+	if _, err := g.add(); err != nil {
+		return nil, err
+	}
+	msg := fmt.Sprintf("Revert \"%s\"\n\nThis reverts commit %s.\n", strings.SplitN(commit.Message, "\n", 2)[0], commit.Hash)
+	return g.commit(msg)
+}
+
+// pushNote is not supported since go-git cannot write notes.
+func (g *nativeGitRepository) pushNote(ref, commit, msg string) ([]byte, error) {
+	return nil, fmt.Errorf("notes are not supported by the %s git backend", gitBackendNative)
+}
+
+// rebaseOnRemote is not supported since go-git cannot rebase, an error wrapping errRebaseFailed is always
+// returned and the branch is left unchanged.
+func (g *nativeGitRepository) rebaseOnRemote(branch string) ([]byte, error) {
+	return nil, fmt.Errorf("%w: rebase is not supported by the %s git backend", errRebaseFailed, gitBackendNative)
+}
+
+// fetch fetches a remote branch into its remote-tracking branch.
+func (g *nativeGitRepository) fetch(branch string) ([]byte, error) {
+	err := g.repo.Fetch(&git.FetchOptions{
+		RemoteName: remote,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("+%s:%s", plumbing.NewBranchReferenceName(branch), plumbing.NewRemoteReferenceName(remote, branch)))},
+		Auth:       g.auth,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, fmt.Errorf("failed to fetch branch %s: %w", branch, err)
+	}
+	return nil, nil
+}
+
+// tag creates an annotated tag of the commit with the message.
+func (g *nativeGitRepository) tag(name, msg, commit string) ([]byte, error) {
+	_, err := g.repo.CreateTag(name, plumbing.NewHash(commit), &git.CreateTagOptions{
+		Tagger: &object.Signature{
+			Name:  g.username,
+			Email: g.commitEmail(),
+			When:  time.Now(),
+		},
+		Message: msg,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tag %s: %w", name, err)
+	}
+	return nil, nil
+}
+
+// pushTag pushes a tag to the remote.
+func (g *nativeGitRepository) pushTag(name string) ([]byte, error) {
+	ref := plumbing.NewTagReferenceName(name)
+	err := g.repo.Push(&git.PushOptions{
+		RemoteName: remote,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("%s:%s", ref, ref))},
+		Auth:       g.auth,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, fmt.Errorf("failed to push tag %s: %w", name, err)
+	}
+	return nil, nil
+}
+
+// remoteTagCommit returns the SHA of the commit a tag of the remote points to, the peeled SHA of an
+// annotated tag.
+func (g *nativeGitRepository) remoteTagCommit(name string) (string, error) {
+	r, err := g.repo.Remote(remote)
+	if err != nil {
+		return "", fmt.Errorf("failed to get remote %s: %w", remote, err)
+	}
+	refs, err := r.List(&git.ListOptions{Auth: g.auth, PeelingOption: git.AppendPeeled})
+	if err != nil {
+		return "", fmt.Errorf("failed to list remote references: %w", err)
+	}
+	ref := plumbing.NewTagReferenceName(name).String()
+	var sha string
+	for _, r := range refs {
+		switch r.Name().String() {
+		case ref + "^{}":
+			return r.Hash().String(), nil
+		case ref:
+			sha = r.Hash().String()
+		}
+	}
+	return sha, nil
+}
+
+// resetToRemote fetches a remote branch and resets the checked out branch and working tree to it,
+// removing untracked files.
+func (g *nativeGitRepository) resetToRemote(branch string) ([]byte, error) {
+	if _, err := g.fetch(branch); err != nil {
+		return nil, err
+	}
+	remoteRef := plumbing.NewRemoteReferenceName(remote, branch)
+	ref, err := g.repo.Reference(remoteRef, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", remoteRef, err)
+	}
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open worktree: %w", err)
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: ref.Hash(), Mode: git.HardReset}); err != nil {
+		return nil, fmt.Errorf("failed to reset to %s: %w", remoteRef, err)
+	}
+	if err := wt.Clean(&git.CleanOptions{Dir: true}); err != nil {
+		return nil, fmt.Errorf("failed to clean worktree: %w", err)
+	}
+	return nil, nil
+}
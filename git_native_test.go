@@ -0,0 +1,240 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// newNativeTestRepository initializes a repository with an initial commit on main whose origin is a
+// local bare repository. It does not require the git binary.
+func newNativeTestRepository(t *testing.T) (*nativeGitRepository, string) {
+	t.Helper()
+	remoteDir := filepath.Join(t.TempDir(), "remote.git")
+	if _, err := git.PlainInit(remoteDir, true); err != nil {
+		t.Fatalf("Failed to init bare repository: %v", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "repo")
+	repo, err := git.PlainInitWithOptions(dir, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{DefaultBranch: "refs/heads/main"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	if _, err := repo.CreateRemote(&gitconfig.RemoteConfig{Name: remote, URLs: []string{remoteDir}}); err != nil {
+		t.Fatalf("Failed to create remote: %v", err)
+	}
+
+	g := &nativeGitRepository{
+		repoInfo: repoInfo{dir: dir, repoName: "repo", username: "Cloud Deploy", email: "deploy@example.com"},
+		repo:     repo,
+	}
+	if err := g.config(); err != nil {
+		t.Fatalf("Failed to configure repository: %v", err)
+	}
+	writeTestFile(t, dir, "source_of_truth.csv", "cluster_name\ncluster1\n")
+	if _, err := g.add(); err != nil {
+		t.Fatalf("Failed to add: %v", err)
+	}
+	if _, err := g.commit("initial commit"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	return g, remoteDir
+}
+
+func writeTestFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+}
+
+func TestNativeGitRepository(t *testing.T) {
+	g, remoteDir := newNativeTestRepository(t)
+
+	if _, err := g.push("main"); err != nil {
+		t.Fatalf("Failed to push main: %v", err)
+	}
+	if _, err := g.checkoutBranch("feature"); err != nil {
+		t.Fatalf("Failed to checkout feature branch: %v", err)
+	}
+
+	op, err := g.detectDiff()
+	if err != nil {
+		t.Fatalf("Failed to detect diff: %v", err)
+	}
+	if len(op) != 0 {
+		t.Errorf("Expected no diff on a clean worktree, got: %s", op)
+	}
+
+	writeTestFile(t, g.dir, "output/cluster1.yaml", "kind: ConfigMap\n")
+	op, err = g.detectDiff()
+	if err != nil {
+		t.Fatalf("Failed to detect diff: %v", err)
+	}
+	if len(op) == 0 {
+		t.Error("Expected a diff after writing a file, got none")
+	}
+
+	op, err = g.checkIfExists("feature")
+	if err != nil {
+		t.Fatalf("Failed to check if branch exists: %v", err)
+	}
+	if len(op) != 0 {
+		t.Errorf("Expected feature branch to not exist on the remote, got: %s", op)
+	}
+
+	if _, err := g.add(); err != nil {
+		t.Fatalf("Failed to add: %v", err)
+	}
+	if _, err := g.commit("hydrate cluster1"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if _, err := g.push("feature"); err != nil {
+		t.Fatalf("Failed to push feature branch: %v", err)
+	}
+	op, err = g.checkIfExists("feature")
+	if err != nil {
+		t.Fatalf("Failed to check if branch exists: %v", err)
+	}
+	if len(op) == 0 {
+		t.Error("Expected feature branch to exist on the remote")
+	}
+
+	// A second clone on main pulls the feature branch as a fast-forward.
+	otherDir := filepath.Join(t.TempDir(), "other")
+	otherRepo, err := git.PlainClone(otherDir, false, &git.CloneOptions{URL: remoteDir, ReferenceName: "refs/heads/main"})
+	if err != nil {
+		t.Fatalf("Failed to clone remote: %v", err)
+	}
+	other := &nativeGitRepository{repoInfo: repoInfo{dir: otherDir}, repo: otherRepo}
+	if _, err := other.pull("feature"); err != nil {
+		t.Fatalf("Failed to pull feature branch: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(otherDir, "output/cluster1.yaml")); err != nil {
+		t.Errorf("Expected pulled file to exist: %v", err)
+	}
+}
+
+func TestNativeGitRepositoryPushRejected(t *testing.T) {
+	g, remoteDir := newNativeTestRepository(t)
+	if _, err := g.push("main"); err != nil {
+		t.Fatalf("Failed to push main: %v", err)
+	}
+
+	// Another writer moves the remote branch.
+	otherDir := filepath.Join(t.TempDir(), "other")
+	otherRepo, err := git.PlainClone(otherDir, false, &git.CloneOptions{URL: remoteDir, ReferenceName: "refs/heads/main"})
+	if err != nil {
+		t.Fatalf("Failed to clone remote: %v", err)
+	}
+	other := &nativeGitRepository{repoInfo: repoInfo{dir: otherDir, username: "test", email: "test@example.com"}, repo: otherRepo}
+	writeTestFile(t, otherDir, "source_of_truth.csv", "cluster_name\ncluster2\n")
+	if _, err := other.commit("concurrent change"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if _, err := other.push("main"); err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	writeTestFile(t, g.dir, "source_of_truth.csv", "cluster_name\ncluster3\n")
+	writeTestFile(t, g.dir, "output/cluster3.yaml", "kind: ConfigMap\n")
+	if _, err := g.add(); err != nil {
+		t.Fatalf("Failed to add: %v", err)
+	}
+	if _, err := g.commit("local change"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if _, err := g.push("main"); !errors.Is(err, errPushRejected) {
+		t.Fatalf("Expected push to be rejected, got: %v", err)
+	}
+	if _, err := g.rebaseOnRemote("main"); !errors.Is(err, errRebaseFailed) {
+		t.Fatalf("Expected rebase to fail, got: %v", err)
+	}
+
+	if _, err := g.resetToRemote("main"); err != nil {
+		t.Fatalf("Failed to reset to remote: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(g.dir, "source_of_truth.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "cluster_name\ncluster2\n"; string(got) != want {
+		t.Errorf("Source of truth mismatch\nExpected: %s\n     Got: %s", want, got)
+	}
+	if _, err := os.Stat(filepath.Join(g.dir, "output")); err == nil {
+		t.Error("Expected untracked files to be removed")
+	}
+}
+
+func TestNativeGitRepositoryRevert(t *testing.T) {
+	g, _ := newNativeTestRepository(t)
+	writeTestFile(t, g.dir, "source_of_truth.csv", "cluster_name\ncluster2\n")
+	writeTestFile(t, g.dir, "output/cluster2.yaml", "kind: ConfigMap\n")
+	if _, err := g.add(); err != nil {
+		t.Fatalf("Failed to add: %v", err)
+	}
+	if _, err := g.commit("update cluster2"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	if _, err := g.revert(plumbing.ZeroHash.String()); err == nil {
+		t.Error("Expected reverting a commit other than HEAD to fail")
+	}
+	updated, err := g.headCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.revert(updated); err != nil {
+		t.Fatalf("Failed to revert: %v", err)
+	}
+	head, err := g.repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := g.repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(commit.Message, `Revert "update cluster2"`) {
+		t.Errorf("Unexpected revert commit message: %s", commit.Message)
+	}
+	if _, err := commit.File("output/cluster2.yaml"); err == nil {
+		t.Error("Expected the added file to be removed by the revert")
+	}
+	f, err := commit.File("source_of_truth.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := f.Contents(); got != "cluster_name\ncluster1\n" {
+		t.Errorf("Expected the modified file to be restored, got: %s", got)
+	}
+	if op, err := g.detectDiff(); err != nil || len(op) != 0 {
+		t.Errorf("Expected a clean worktree, got: %s %v", op, err)
+	}
+}
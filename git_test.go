@@ -0,0 +1,227 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// createBareRemote creates a bare repository named {owner}/{repoName}.git under root, with a main branch
+// containing the provided files committed over the provided number of commits.
+func createBareRemote(t *testing.T, root, owner, repoName string, files map[string]string, commits int) string {
+	t.Helper()
+	if _, err := exec.LookPath(gitBin); err != nil {
+		t.Skip("git binary not available")
+	}
+	bare := filepath.Join(root, owner, repoName+".git")
+	mustRunGit(t, "", "init", "--bare", "--initial-branch=main", bare)
+
+	work := t.TempDir()
+	mustRunGit(t, "", "clone", bare, work)
+	mustRunGit(t, work, "checkout", "-b", "main")
+	for name, content := range files {
+		writeTestFile(t, work, name, content)
+	}
+	for i := 0; i < commits; i++ {
+		writeTestFile(t, work, "history.txt", fmt.Sprintf("commit %d\n", i))
+		mustRunGit(t, work, "add", ".")
+		mustRunGit(t, work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-m", fmt.Sprintf("commit %d", i))
+	}
+	mustRunGit(t, work, "push", "origin", "main")
+	return bare
+}
+
+// redirectRemotes makes git resolve every repository URL on the provided host to the bare repositories
+// under root, e.g. "https://{owner}:{secret}@{host}/{owner}/{repo}.git" to "file://{root}/{owner}/{repo}.git".
+func redirectRemotes(t *testing.T, root, host, owner, secret string) {
+	t.Helper()
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", fmt.Sprintf("url.file://%s/.insteadOf", root))
+	t.Setenv("GIT_CONFIG_VALUE_0", fmt.Sprintf("https://%s:%s@%s/", owner, secret, host))
+}
+
+func mustRunGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(gitBin, args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestCLICloneRepo(t *testing.T) {
+	files := map[string]string{
+		"source_of_truth.csv":        "cluster_name\ncluster1\n",
+		"base_library/base.yaml":     "kind: Namespace\n",
+		"overlays/prod/overlay.yaml": "kind: Namespace\n",
+		"output/.gitkeep":            "",
+		"docs/large.md":              "unrelated\n",
+	}
+
+	testCases := []struct {
+		name            string
+		opts            cloneOptions
+		expectedCommits string
+		expectedPaths   []string
+		unexpectedPaths []string
+	}{
+		{
+			name:            "Full clone",
+			opts:            cloneOptions{},
+			expectedCommits: "3",
+			expectedPaths:   []string{"source_of_truth.csv", "base_library/base.yaml", "docs/large.md"},
+		},
+		{
+			name:            "Shallow single branch clone",
+			opts:            cloneOptions{depth: 1, singleBranch: "main"},
+			expectedCommits: "1",
+			expectedPaths:   []string{"source_of_truth.csv", "docs/large.md"},
+		},
+		{
+			name:            "Sparse checkout",
+			opts:            cloneOptions{depth: 1, sparsePaths: []string{"source_of_truth.csv", "base_library/", "overlays/", "output"}},
+			expectedCommits: "1",
+			expectedPaths:   []string{"source_of_truth.csv", "base_library/base.yaml", "overlays/prod/overlay.yaml", "output/.gitkeep"},
+			unexpectedPaths: []string{"docs/large.md", "history.txt"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			createBareRemote(t, root, "owner", "repo", files, 3)
+			redirectRemotes(t, root, "github.com", "owner", "secret")
+
+			dir := filepath.Join(t.TempDir(), "repo")
+			g := newGitRepository(gitBackendCLI, "github.com", "owner", "repo", "", "Cloud Deploy", nil)
+			if _, err := g.cloneRepo(dir, "secret", tc.opts); err != nil {
+				t.Fatalf("Failed to clone: %v", err)
+			}
+
+			if got := mustRunGit(t, dir, "rev-list", "--count", "HEAD"); got != tc.expectedCommits {
+				t.Errorf("Commit count mismatch\nExpected: %s\n     Got: %s", tc.expectedCommits, got)
+			}
+			for _, p := range tc.expectedPaths {
+				if _, err := os.Stat(filepath.Join(dir, p)); err != nil {
+					t.Errorf("Expected %s to be checked out: %v", p, err)
+				}
+			}
+			for _, p := range tc.unexpectedPaths {
+				if _, err := os.Stat(filepath.Join(dir, p)); err == nil {
+					t.Errorf("Expected %s to not be checked out", p)
+				}
+			}
+
+			// Feature branches can be committed and pushed from the limited clone.
+			if err := g.config(); err != nil {
+				t.Fatalf("Failed to configure: %v", err)
+			}
+			if _, err := g.checkoutBranch("feature"); err != nil {
+				t.Fatalf("Failed to checkout feature branch: %v", err)
+			}
+			writeTestFile(t, dir, "output/cluster1.yaml", "kind: ConfigMap\n")
+			if _, err := g.add(); err != nil {
+				t.Fatalf("Failed to add: %v", err)
+			}
+			if _, err := g.commit("hydrate cluster1"); err != nil {
+				t.Fatalf("Failed to commit: %v", err)
+			}
+			if _, err := g.push("feature"); err != nil {
+				t.Fatalf("Failed to push: %v", err)
+			}
+			op, err := g.checkIfExists("feature")
+			if err != nil {
+				t.Fatalf("Failed to check if branch exists: %v", err)
+			}
+			if len(op) == 0 {
+				t.Error("Expected feature branch to exist on the remote")
+			}
+			if got := mustRunGit(t, dir, "show", "--name-only", "--format=", "HEAD"); got != "output/cluster1.yaml" {
+				t.Errorf("Expected only the hydrated file in the commit, got: %s", got)
+			}
+		})
+	}
+}
+
+// TestGitBackendsPull checks that both git backends fast-forward when pulling, refuse to merge diverged
+// branches, and configure the same committer email.
+func TestGitBackendsPull(t *testing.T) {
+	for _, backend := range []string{gitBackendCLI, gitBackendNative} {
+		t.Run(backend, func(t *testing.T) {
+			root := t.TempDir()
+			bare := createBareRemote(t, root, "owner", "repo", map[string]string{"source_of_truth.csv": "cluster_name\ncluster1\n"}, 1)
+			other := t.TempDir()
+			mustRunGit(t, "", "clone", bare, other)
+			pushOther := func(content string) {
+				writeTestFile(t, other, "history.txt", content)
+				mustRunGit(t, other, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-a", "-m", content)
+				mustRunGit(t, other, "push", "origin", "main")
+			}
+
+			dir := filepath.Join(t.TempDir(), "repo")
+			info := repoInfo{dir: dir, repoName: "repo", username: "Cloud Deploy"}
+			var g gitRepository = &cliGitRepository{repoInfo: info}
+			if backend == gitBackendNative {
+				repo, err := git.PlainClone(dir, false, &git.CloneOptions{URL: bare})
+				if err != nil {
+					t.Fatalf("Failed to clone: %v", err)
+				}
+				g = &nativeGitRepository{repoInfo: info, repo: repo}
+			} else {
+				mustRunGit(t, "", "clone", bare, dir)
+			}
+			if err := g.config(); err != nil {
+				t.Fatalf("Failed to configure: %v", err)
+			}
+			if got := mustRunGit(t, dir, "config", "user.email"); got != "<>" {
+				t.Errorf("Expected the email to default to <>, got: %s", got)
+			}
+
+			pushOther("fast-forward\n")
+			if _, err := g.pull("main"); err != nil {
+				t.Fatalf("Failed to pull: %v", err)
+			}
+			if got, err := os.ReadFile(filepath.Join(dir, "history.txt")); err != nil || string(got) != "fast-forward\n" {
+				t.Errorf("Expected the remote commit to be pulled, got: %s %v", got, err)
+			}
+
+			pushOther("remote\n")
+			writeTestFile(t, dir, "output/cluster1.yaml", "kind: ConfigMap\n")
+			if _, err := g.add(); err != nil {
+				t.Fatalf("Failed to add: %v", err)
+			}
+			if _, err := g.commit("hydrate cluster1"); err != nil {
+				t.Fatalf("Failed to commit: %v", err)
+			}
+			head := mustRunGit(t, dir, "rev-parse", "HEAD")
+			if _, err := g.pull("main"); !errors.Is(err, errPullDiverged) {
+				t.Fatalf("Expected pulling a diverged branch to fail with errPullDiverged, got: %v", err)
+			}
+			if got := mustRunGit(t, dir, "rev-parse", "HEAD"); got != head {
+				t.Errorf("Expected the diverged branch to be left unchanged at %s, got: %s", head, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+)
+
+// Name of the file the local artifact store writes the deploy result to.
+const localResultFile = "results.json"
+
+// localSecretAccessor implements SecretAccessor with files in a local directory. The payload of a secret
+// version is the content of the file at the version resource name relative to the directory, e.g.
+// "{dir}/projects/{project-number}/secrets/{secret-name}/versions/{version-number}".
+type localSecretAccessor struct {
+	dir string
+}
+
+// AccessSecretVersion reads the payload of the secret version from the local directory.
+func (s *localSecretAccessor) AccessSecretVersion(ctx context.Context, name string) ([]byte, error) {
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("invalid secret version name %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to access secret version %s: %v", name, err)
+	}
+	return data, nil
+}
+
+// cliSecretAccessor implements SecretAccessor for the command line, where secrets are referenced as
+// "file:{path}" or "env:{variable}" instead of by secret version name.
+type cliSecretAccessor struct{}
+
+// AccessSecretVersion reads the secret from the referenced file or environment variable. Trailing newlines
+// of files are removed.
+func (s *cliSecretAccessor) AccessSecretVersion(ctx context.Context, name string) ([]byte, error) {
+	if path, ok := strings.CutPrefix(name, "file:"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret file: %v", err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	if env, ok := strings.CutPrefix(name, "env:"); ok {
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("secret environment variable %s is not set", env)
+		}
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("secret %q must be of the form \"file:{path}\" or \"env:{variable}\"", name)
+}
+
+// stdoutArtifactStore implements ArtifactStore by writing the deploy result as JSON to w. Artifacts are
+// not kept.
+type stdoutArtifactStore struct {
+	w io.Writer
+}
+
+// UploadArtifact discards the artifact and returns its object suffix.
+func (s *stdoutArtifactStore) UploadArtifact(ctx context.Context, objectSuffix string, content *clouddeploy.GCSUploadContent) (string, error) {
+	fmt.Printf("Not keeping deploy artifact %s, no results directory is set\n", objectSuffix)
+	return objectSuffix, nil
+}
+
+// UploadResult writes the deploy result as JSON.
+func (s *stdoutArtifactStore) UploadResult(ctx context.Context, result *clouddeploy.DeployResult) (string, error) {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("error marshalling deploy result: %v", err)
+	}
+	if _, err := fmt.Fprintf(s.w, "%s\n", data); err != nil {
+		return "", err
+	}
+	return "stdout", nil
+}
+
+// localArtifactStore implements ArtifactStore with files in a local directory.
+type localArtifactStore struct {
+	dir string
+}
+
+// UploadArtifact writes the content to the file at objectSuffix relative to the directory.
+func (s *localArtifactStore) UploadArtifact(ctx context.Context, objectSuffix string, content *clouddeploy.GCSUploadContent) (string, error) {
+	if len(objectSuffix) == 0 || !filepath.IsLocal(objectSuffix) {
+		return "", fmt.Errorf("invalid artifact object suffix %q", objectSuffix)
+	}
+	data := content.Data
+	if len(data) == 0 && len(content.LocalPath) != 0 {
+		var err error
+		if data, err = os.ReadFile(content.LocalPath); err != nil {
+			return "", err
+		}
+	}
+	return s.write(objectSuffix, data)
+}
+
+// UploadResult writes the deploy result as JSON to the results file in the directory.
+func (s *localArtifactStore) UploadResult(ctx context.Context, result *clouddeploy.DeployResult) (string, error) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling deploy result: %v", err)
+	}
+	return s.write(localResultFile, data)
+}
+
+// write writes the data to the file at name relative to the directory and returns the file path.
+func (s *localArtifactStore) write(name string, data []byte) (string, error) {
+	path := filepath.Join(s.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// localLockStore implements lockStore with files in a local directory. The lock object "gs://{bucket}/{name}"
+// is stored at "{dir}/{bucket}/{name}", while a lock object under the gitLockDir parameter is the path of its
+// file. The generation is the modification time of the file. It only prevents concurrent rollouts on the
+// same machine.
+type localLockStore struct {
+	dir string
+}
+
+func (s *localLockStore) path(uri string) (string, error) {
+	if !strings.HasPrefix(uri, "gs://") {
+		return filepath.Clean(uri), nil
+	}
+	bucket, name, err := parseGCSURI(uri)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid lock object name %q", name)
+	}
+	return filepath.Join(s.dir, bucket, name), nil
+}
+
+func (s *localLockStore) create(ctx context.Context, uri string, data []byte) (int64, error) {
+	path, err := s.path(uri)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		return 0, fmt.Errorf("%w: %v", errLockPrecondition, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return s.generation(path)
+}
+
+func (s *localLockStore) read(ctx context.Context, uri string) ([]byte, int64, error) {
+	path, err := s.path(uri)
+	if err != nil {
+		return nil, 0, err
+	}
+	gen, err := s.generation(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, localLockError(err)
+	}
+	return data, gen, nil
+}
+
+func (s *localLockStore) update(ctx context.Context, uri string, data []byte, generation int64) (int64, error) {
+	path, err := s.path(uri)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.checkGeneration(path, generation); err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return 0, err
+	}
+	gen, err := s.generation(path)
+	if err != nil {
+		return 0, err
+	}
+	if gen == generation {
+		// The modification time has a coarse resolution on some file systems, bump it so the new content
+		// has a new generation.
+		gen++
+		if err := os.Chtimes(path, time.Now(), time.Unix(0, gen)); err != nil {
+			return 0, err
+		}
+	}
+	return gen, nil
+}
+
+func (s *localLockStore) delete(ctx context.Context, uri string, generation int64) error {
+	path, err := s.path(uri)
+	if err != nil {
+		return err
+	}
+	if err := s.checkGeneration(path, generation); err != nil {
+		return err
+	}
+	return localLockError(os.Remove(path))
+}
+
+// generation returns the generation of the lock file.
+func (s *localLockStore) generation(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, localLockError(err)
+	}
+	return info.ModTime().UnixNano(), nil
+}
+
+// checkGeneration returns errLockPrecondition if the generation of the lock file does not match.
+func (s *localLockStore) checkGeneration(path string, generation int64) error {
+	gen, err := s.generation(path)
+	if err != nil {
+		return err
+	}
+	if gen != generation {
+		return fmt.Errorf("%w: generation %d does not match %d", errLockPrecondition, gen, generation)
+	}
+	return nil
+}
+
+// localLockError maps file system errors to the lockStore errors.
+func localLockError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %v", errLockNotFound, err)
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+)
+
+func TestLocalSecretAccessor(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeTestFile(t, dir, "projects/1/secrets/git/versions/1", "token")
+	s := &localSecretAccessor{dir: dir}
+
+	got, err := s.AccessSecretVersion(ctx, "projects/1/secrets/git/versions/1")
+	if err != nil {
+		t.Fatalf("Failed to access secret version: %v", err)
+	}
+	if string(got) != "token" {
+		t.Errorf("Secret payload mismatch\nExpected: token\n     Got: %s", got)
+	}
+	if _, err := s.AccessSecretVersion(ctx, "projects/1/secrets/git/versions/2"); err == nil {
+		t.Error("Expected error accessing missing secret version")
+	}
+	if _, err := s.AccessSecretVersion(ctx, "../secret"); err == nil {
+		t.Error("Expected error accessing secret version outside of the directory")
+	}
+}
+
+func TestLocalArtifactStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := &localArtifactStore{dir: dir}
+
+	srcDir := t.TempDir()
+	writeTestFile(t, srcDir, "source_of_truth.csv", "cluster_name\ncluster1\n")
+	src := filepath.Join(srcDir, "source_of_truth.csv")
+	uri, err := s.UploadArtifact(ctx, "sot/source_of_truth.csv", &clouddeploy.GCSUploadContent{LocalPath: src})
+	if err != nil {
+		t.Fatalf("Failed to upload artifact: %v", err)
+	}
+	if want := filepath.Join(dir, "sot", "source_of_truth.csv"); uri != want {
+		t.Errorf("Artifact path mismatch\nExpected: %s\n     Got: %s", want, uri)
+	}
+	if got, _ := os.ReadFile(uri); string(got) != "cluster_name\ncluster1\n" {
+		t.Errorf("Unexpected artifact content: %s", got)
+	}
+	if _, err := s.UploadArtifact(ctx, "../escape", &clouddeploy.GCSUploadContent{Data: []byte("x")}); err == nil {
+		t.Error("Expected error uploading artifact outside of the directory")
+	}
+}
+
+func TestLocalLockStore(t *testing.T) {
+	ctx := context.Background()
+	store := &localLockStore{dir: t.TempDir()}
+	now := time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)
+
+	first := testLock(store, "rollout-1", &now)
+	if err := first.acquire(ctx, 0); err != nil {
+		t.Fatalf("Failed to acquire free lock: %v", err)
+	}
+	second := testLock(store, "rollout-2", &now)
+	if err := second.acquire(ctx, 0); err == nil || !strings.Contains(err.Error(), "held by rollout rollout-1") {
+		t.Fatalf("Expected lock held error, got: %v", err)
+	}
+	if err := first.refresh(ctx); err != nil {
+		t.Fatalf("Failed to refresh lock: %v", err)
+	}
+
+	// A writer holding an outdated generation cannot modify the lock.
+	if _, err := store.update(ctx, first.uri, []byte("{}"), first.generation-1); !errors.Is(err, errLockPrecondition) {
+		t.Errorf("Expected precondition error, got: %v", err)
+	}
+
+	if err := first.release(ctx); err != nil {
+		t.Fatalf("Failed to release lock: %v", err)
+	}
+	if _, _, err := store.read(ctx, first.uri); !errors.Is(err, errLockNotFound) {
+		t.Errorf("Expected lock to be deleted, got: %v", err)
+	}
+	if err := second.acquire(ctx, 0); err != nil {
+		t.Fatalf("Failed to acquire released lock: %v", err)
+	}
+}
+
+func TestLocalLockStoreLockDir(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := &localLockStore{}
+	lock := newRolloutLock(store, dir, "github.com/owner/repo", "prod", "rollout-1", "target", time.Minute)
+	if err := lock.acquire(ctx, 0); err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+	// A lock under the lock directory is the path of its file.
+	if _, err := os.Stat(filepath.Join(dir, "github.com", "owner", "repo", "prod.lock")); err != nil {
+		t.Errorf("Expected the lock file in the lock directory: %v", err)
+	}
+	if err := lock.release(ctx); err != nil {
+		t.Fatalf("Failed to release lock: %v", err)
+	}
+}
+
+func TestDeployerProcessUploadsFailedResult(t *testing.T) {
+	dir := t.TempDir()
+	d := &deployer{
+		req:       &clouddeploy.DeployRequest{Rollout: "rollout-1"},
+		params:    &params{gitSecret: "projects/1/secrets/git/versions/1"},
+		secrets:   &localSecretAccessor{dir: filepath.Join(dir, "secrets")},
+		artifacts: &localArtifactStore{dir: filepath.Join(dir, "artifacts")},
+	}
+
+	// The failure is reported to Cloud Deploy through the uploaded result.
+	if err := d.process(context.Background()); err != nil {
+		t.Fatalf("Unexpected error processing failed deploy: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "artifacts", localResultFile))
+	if err != nil {
+		t.Fatalf("Expected deploy result to be uploaded: %v", err)
+	}
+	res := &clouddeploy.DeployResult{}
+	if err := json.Unmarshal(data, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.ResultStatus != clouddeploy.DeployFailed {
+		t.Errorf("Expected failed result, got: %v", res.ResultStatus)
+	}
+	if !strings.Contains(res.FailureMessage, "projects/1/secrets/git/versions/1") {
+		t.Errorf("Expected failure message to mention the secret, got: %s", res.FailureMessage)
+	}
+	if res.Metadata[clouddeploy.CustomTargetSourceMetadataKey] != gitDeployerSampleName {
+		t.Errorf("Expected result metadata to identify the deployer, got: %v", res.Metadata)
+	}
+
+	// The result cannot be uploaded when the artifact directory is a file.
+	d.artifacts = &localArtifactStore{dir: filepath.Join(dir, "artifacts", localResultFile)}
+	if err := d.process(context.Background()); err == nil || !strings.Contains(err.Error(), "error uploading failed deploy results") {
+		t.Errorf("Expected upload error, got: %v", err)
+	}
+}
@@ -0,0 +1,347 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// Directory in the deploy output bucket where lock objects are stored by default.
+	defaultLockDir = "git-deployer-locks"
+	// How often a held lock is checked while waiting for it.
+	defaultLockPollInterval = 15 * time.Second
+)
+
+var (
+	// errLockNotFound is returned by a lockStore when the lock object does not exist.
+	errLockNotFound = errors.New("lock not found")
+	// errLockPrecondition is returned by a lockStore when the lock object was created, changed or deleted
+	// by someone else.
+	errLockPrecondition = errors.New("lock was modified concurrently")
+	// errLockLost is wrapped by the error refresh returns when the lock is no longer held by the rollout.
+	errLockLost = errors.New("lock is no longer held by this rollout")
+)
+
+// lockStore stores lock objects, identified by a Cloud Storage URI, with generation preconditions so that
+// concurrent writers cannot overwrite each other.
+type lockStore interface {
+	// create creates the object if it does not exist and returns its generation. Returns errLockPrecondition
+	// if the object exists.
+	create(ctx context.Context, uri string, data []byte) (int64, error)
+	// read returns the object data and generation. Returns errLockNotFound if the object does not exist.
+	read(ctx context.Context, uri string) ([]byte, int64, error)
+	// update replaces the object if its generation matches and returns the new generation. Returns
+	// errLockPrecondition if the generation does not match.
+	update(ctx context.Context, uri string, data []byte, generation int64) (int64, error)
+	// delete deletes the object if its generation matches. Returns errLockPrecondition if the generation
+	// does not match.
+	delete(ctx context.Context, uri string, generation int64) error
+}
+
+// lockRecord is the content of a lock object.
+type lockRecord struct {
+	// Holder is the name of the rollout holding the lock.
+	Holder  string    `json:"holder"`
+	Target  string    `json:"target"`
+	Expires time.Time `json:"expires"`
+}
+
+// rolloutLock is an advisory lock preventing concurrent rollouts from updating the same cluster group.
+// A lock that has not been refreshed within its TTL is considered stale and is taken over.
+type rolloutLock struct {
+	store  lockStore
+	uri    string
+	holder string
+	target string
+	ttl    time.Duration
+	// How often a held lock is checked while waiting for it.
+	pollInterval time.Duration
+	// Generation of the lock object while the lock is held, 0 otherwise.
+	generation int64
+	now        func() time.Time
+}
+
+// newRolloutLock returns the lock for the cluster group in the output repository. The lock object is
+// stored under lockPath, e.g. "gs://{bucket}/{dir}/{output-repo}/{cluster-group}.lock".
+func newRolloutLock(store lockStore, lockPath, outputRepo, clusterGroup, holder, target string, ttl time.Duration) *rolloutLock {
+	return &rolloutLock{
+		store:        store,
+		uri:          fmt.Sprintf("%s/%s/%s.lock", strings.TrimSuffix(lockPath, "/"), outputRepo, url.PathEscape(clusterGroup)),
+		holder:       holder,
+		target:       target,
+		ttl:          ttl,
+		pollInterval: defaultLockPollInterval,
+		now:          time.Now,
+	}
+}
+
+// defaultLockPath returns the default lock path in the bucket of the provided Cloud Storage URI.
+func defaultLockPath(gcsURI string) (string, error) {
+	bucket, _, err := parseGCSURI(gcsURI)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("gs://%s/%s", bucket, defaultLockDir), nil
+}
+
+// acquire acquires the lock, waiting up to the wait timeout if it is held by another rollout. A stale lock
+// or one already held by the same rollout, e.g. from a previous attempt, is taken over.
+func (l *rolloutLock) acquire(ctx context.Context, wait time.Duration) error {
+	deadline := l.now().Add(wait)
+	for {
+		current, err := l.tryAcquire(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to acquire lock %s: %v", l.uri, err)
+		}
+		if current == nil {
+			return nil
+		}
+		if !l.now().Before(deadline) {
+			return fmt.Errorf("lock %s is held by rollout %s for target %s until %s, gave up waiting after %s", l.uri, current.Holder, current.Target, current.Expires.Format(time.RFC3339), wait)
+		}
+		fmt.Printf("Lock %s is held by rollout %s until %s, waiting\n", l.uri, current.Holder, current.Expires.Format(time.RFC3339))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(min(l.pollInterval, deadline.Sub(l.now()))):
+		}
+	}
+}
+
+// tryAcquire makes a single attempt to acquire the lock. Returns the current lock record if the lock is
+// held by another rollout.
+func (l *rolloutLock) tryAcquire(ctx context.Context) (*lockRecord, error) {
+	data, err := l.record()
+	if err != nil {
+		return nil, err
+	}
+	gen, err := l.store.create(ctx, l.uri, data)
+	if err == nil {
+		l.generation = gen
+		fmt.Printf("Acquired lock %s\n", l.uri)
+		return nil, nil
+	}
+	if !errors.Is(err, errLockPrecondition) {
+		return nil, err
+	}
+
+	existing, gen, err := l.store.read(ctx, l.uri)
+	if errors.Is(err, errLockNotFound) {
+		// Released since the create attempt.
+		return l.tryAcquire(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	current := &lockRecord{}
+	if err := json.Unmarshal(existing, current); err != nil {
+		fmt.Printf("Lock %s has unreadable content, treating it as stale: %v\n", l.uri, err)
+	}
+	if current.Holder != l.holder && l.now().Before(current.Expires) {
+		return current, nil
+	}
+
+	if current.Holder != l.holder {
+		fmt.Printf("Taking over stale lock %s held by rollout %s which expired at %s\n", l.uri, current.Holder, current.Expires.Format(time.RFC3339))
+	}
+	gen, err = l.store.update(ctx, l.uri, data, gen)
+	if errors.Is(err, errLockPrecondition) {
+		// Another rollout took over the lock first.
+		return current, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.generation = gen
+	fmt.Printf("Acquired lock %s\n", l.uri)
+	return nil, nil
+}
+
+// refresh extends the expiry of the held lock. Returns an error if the lock is no longer held, e.g. it
+// expired and was taken over by another rollout.
+func (l *rolloutLock) refresh(ctx context.Context) error {
+	data, err := l.record()
+	if err != nil {
+		return err
+	}
+	gen, err := l.store.update(ctx, l.uri, data, l.generation)
+	if errors.Is(err, errLockPrecondition) || errors.Is(err, errLockNotFound) {
+		return fmt.Errorf("%w, lock %s may have expired and been taken over", errLockLost, l.uri)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to refresh lock %s: %v", l.uri, err)
+	}
+	l.generation = gen
+	return nil
+}
+
+// keepAlive refreshes the held lock every third of its TTL in the background until stop is called, so it
+// does not become stale during long steps, e.g. waiting for maintenance windows. The returned context is
+// cancelled if the lock is lost or the refreshes keep failing until it is about to become stale, with the
+// refresh error as cause. stop must be called before the lock is released.
+func (l *rolloutLock) keepAlive(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		interval := l.ttl / 3
+		refreshed := l.now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			err := l.refresh(ctx)
+			if err == nil {
+				refreshed = l.now()
+				continue
+			}
+			fmt.Printf("Failed to refresh lock: %v\n", err)
+			// Retried on the next tick unless the lock would become stale before then.
+			if errors.Is(err, errLockLost) || !l.now().Before(refreshed.Add(l.ttl-interval)) {
+				cancel(err)
+				return
+			}
+		}
+	}()
+	return ctx, func() {
+		close(done)
+		<-stopped
+		cancel(nil)
+	}
+}
+
+// release releases the held lock. A lock that was taken over is left untouched.
+func (l *rolloutLock) release(ctx context.Context) error {
+	if l.generation == 0 {
+		return nil
+	}
+	err := l.store.delete(ctx, l.uri, l.generation)
+	l.generation = 0
+	if err != nil && !errors.Is(err, errLockPrecondition) && !errors.Is(err, errLockNotFound) {
+		return fmt.Errorf("unable to release lock %s: %v", l.uri, err)
+	}
+	fmt.Printf("Released lock %s\n", l.uri)
+	return nil
+}
+
+// record returns the lock object content for this rollout.
+func (l *rolloutLock) record() ([]byte, error) {
+	return json.Marshal(&lockRecord{Holder: l.holder, Target: l.target, Expires: l.now().Add(l.ttl)})
+}
+
+// gcsLockStore implements lockStore with Cloud Storage objects.
+type gcsLockStore struct {
+	client *storage.Client
+}
+
+func (s *gcsLockStore) object(uri string) (*storage.ObjectHandle, error) {
+	bucket, name, err := parseGCSURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	return s.client.Bucket(bucket).Object(name), nil
+}
+
+func (s *gcsLockStore) create(ctx context.Context, uri string, data []byte) (int64, error) {
+	return s.write(ctx, uri, data, storage.Conditions{DoesNotExist: true})
+}
+
+func (s *gcsLockStore) read(ctx context.Context, uri string) ([]byte, int64, error) {
+	obj, err := s.object(uri)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		return nil, 0, gcsLockError(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, r.Attrs.Generation, nil
+}
+
+func (s *gcsLockStore) update(ctx context.Context, uri string, data []byte, generation int64) (int64, error) {
+	return s.write(ctx, uri, data, storage.Conditions{GenerationMatch: generation})
+}
+
+func (s *gcsLockStore) delete(ctx context.Context, uri string, generation int64) error {
+	obj, err := s.object(uri)
+	if err != nil {
+		return err
+	}
+	return gcsLockError(obj.If(storage.Conditions{GenerationMatch: generation}).Delete(ctx))
+}
+
+// write writes the object with the provided preconditions and returns its generation.
+func (s *gcsLockStore) write(ctx context.Context, uri string, data []byte, conds storage.Conditions) (int64, error) {
+	obj, err := s.object(uri)
+	if err != nil {
+		return 0, err
+	}
+	w := obj.If(conds).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return 0, gcsLockError(err)
+	}
+	if err := w.Close(); err != nil {
+		return 0, gcsLockError(err)
+	}
+	return w.Attrs().Generation, nil
+}
+
+// gcsLockError maps Cloud Storage errors to the lockStore errors.
+func gcsLockError(err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("%w: %v", errLockNotFound, err)
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		return fmt.Errorf("%w: %v", errLockPrecondition, err)
+	}
+	return err
+}
+
+// parseGCSURI returns the bucket and object name of a Cloud Storage URI of the form "gs://{bucket}/{name}".
+func parseGCSURI(uri string) (string, string, error) {
+	path, ok := strings.CutPrefix(uri, "gs://")
+	if !ok {
+		return "", "", fmt.Errorf("invalid Cloud Storage URI %q, must start with \"gs://\"", uri)
+	}
+	bucket, name, _ := strings.Cut(path, "/")
+	if len(bucket) == 0 {
+		return "", "", fmt.Errorf("invalid Cloud Storage URI %q, bucket is missing", uri)
+	}
+	return bucket, name, nil
+}
@@ -0,0 +1,245 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memLockStore is an in-memory lockStore.
+type memLockStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	gens    map[string]int64
+	nextGen int64
+}
+
+func newMemLockStore() *memLockStore {
+	return &memLockStore{objects: map[string][]byte{}, gens: map[string]int64{}}
+}
+
+func (s *memLockStore) create(ctx context.Context, uri string, data []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[uri]; ok {
+		return 0, errLockPrecondition
+	}
+	return s.put(uri, data), nil
+}
+
+func (s *memLockStore) read(ctx context.Context, uri string) ([]byte, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[uri]
+	if !ok {
+		return nil, 0, errLockNotFound
+	}
+	return data, s.gens[uri], nil
+}
+
+func (s *memLockStore) update(ctx context.Context, uri string, data []byte, generation int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gens[uri] != generation {
+		return 0, errLockPrecondition
+	}
+	return s.put(uri, data), nil
+}
+
+func (s *memLockStore) delete(ctx context.Context, uri string, generation int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gens[uri] != generation {
+		return errLockPrecondition
+	}
+	delete(s.objects, uri)
+	delete(s.gens, uri)
+	return nil
+}
+
+func (s *memLockStore) put(uri string, data []byte) int64 {
+	s.nextGen++
+	s.objects[uri] = data
+	s.gens[uri] = s.nextGen
+	return s.nextGen
+}
+
+// testLock returns a lock on the store for the holder using the provided clock.
+func testLock(store lockStore, holder string, now *time.Time) *rolloutLock {
+	l := newRolloutLock(store, "gs://bucket/locks/", "github.com/owner/repo", "prod clusters", holder, "target", time.Minute)
+	l.pollInterval = time.Millisecond
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestRolloutLock(t *testing.T) {
+	ctx := context.Background()
+	store := newMemLockStore()
+	now := time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)
+
+	first := testLock(store, "rollout-1", &now)
+	if want := "gs://bucket/locks/github.com/owner/repo/prod%20clusters.lock"; first.uri != want {
+		t.Errorf("Lock URI mismatch\nExpected: %s\n     Got: %s", want, first.uri)
+	}
+	if err := first.acquire(ctx, 0); err != nil {
+		t.Fatalf("Failed to acquire free lock: %v", err)
+	}
+
+	// A second rollout fails while the lock is held.
+	second := testLock(store, "rollout-2", &now)
+	err := second.acquire(ctx, 0)
+	if err == nil || !strings.Contains(err.Error(), "held by rollout rollout-1") {
+		t.Fatalf("Expected lock held error, got: %v", err)
+	}
+
+	// A retry of the same rollout takes over its own lock.
+	retry := testLock(store, "rollout-1", &now)
+	if err := retry.acquire(ctx, 0); err != nil {
+		t.Fatalf("Failed to re-acquire own lock: %v", err)
+	}
+	if err := first.refresh(ctx); err == nil {
+		t.Error("Expected refresh of superseded lock to fail")
+	}
+
+	// Refreshing extends the expiry, so the lock is still held after the original TTL.
+	now = now.Add(50 * time.Second)
+	if err := retry.refresh(ctx); err != nil {
+		t.Fatalf("Failed to refresh lock: %v", err)
+	}
+	now = now.Add(50 * time.Second)
+	if err := second.acquire(ctx, 0); err == nil {
+		t.Fatal("Expected refreshed lock to still be held")
+	}
+
+	// Once stale the lock is taken over, and the previous holder can neither refresh nor release it.
+	now = now.Add(time.Minute)
+	if err := second.acquire(ctx, 0); err != nil {
+		t.Fatalf("Failed to take over stale lock: %v", err)
+	}
+	if err := retry.refresh(ctx); err == nil {
+		t.Error("Expected refresh of taken over lock to fail")
+	}
+	if err := retry.release(ctx); err != nil {
+		t.Errorf("Unexpected error releasing taken over lock: %v", err)
+	}
+	if _, _, err := store.read(ctx, second.uri); err != nil {
+		t.Errorf("Expected lock to still be held by the new holder: %v", err)
+	}
+
+	if err := second.release(ctx); err != nil {
+		t.Fatalf("Failed to release lock: %v", err)
+	}
+	if _, _, err := store.read(ctx, second.uri); err != errLockNotFound {
+		t.Errorf("Expected lock to be deleted, got: %v", err)
+	}
+}
+
+func TestRolloutLockWaits(t *testing.T) {
+	ctx := context.Background()
+	store := newMemLockStore()
+	now := time.Now()
+
+	first := testLock(store, "rollout-1", &now)
+	if err := first.acquire(ctx, 0); err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+	second := testLock(store, "rollout-2", &now)
+	second.now = time.Now
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		first.release(ctx)
+	}()
+	if err := second.acquire(ctx, 10*time.Second); err != nil {
+		t.Fatalf("Failed to acquire lock after it was released: %v", err)
+	}
+}
+
+func TestParseGCSURI(t *testing.T) {
+	testCases := []struct {
+		uri            string
+		expectedBucket string
+		expectedName   string
+		expectError    bool
+	}{
+		{"gs://bucket/dir/object", "bucket", "dir/object", false},
+		{"gs://bucket", "bucket", "", false},
+		{"gs:///object", "", "", true},
+		{"bucket/object", "", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.uri, func(t *testing.T) {
+			bucket, name, err := parseGCSURI(tc.uri)
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("Expected an error, but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if bucket != tc.expectedBucket || name != tc.expectedName {
+				t.Errorf("Mismatch\nExpected: %s %s\n     Got: %s %s", tc.expectedBucket, tc.expectedName, bucket, name)
+			}
+		})
+	}
+}
+
+func TestRolloutLockKeepAlive(t *testing.T) {
+	ctx := context.Background()
+	store := newMemLockStore()
+	lock := newRolloutLock(store, "gs://bucket/locks", "github.com/owner/repo", "prod", "rollout-1", "target", 30*time.Millisecond)
+	if err := lock.acquire(ctx, 0); err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+
+	// The lock is refreshed in the background, so it is still held after several TTLs.
+	held, stop := lock.keepAlive(ctx)
+	time.Sleep(100 * time.Millisecond)
+	other := newRolloutLock(store, "gs://bucket/locks", "github.com/owner/repo", "prod", "rollout-2", "target", time.Minute)
+	if err := other.acquire(ctx, 0); err == nil {
+		t.Fatal("Expected the refreshed lock to still be held")
+	}
+	stop()
+	if err := held.Err(); err == nil {
+		t.Error("Expected the context to be cancelled once stopped")
+	}
+
+	// The context is cancelled with the refresh error once the lock is lost.
+	lost, stop := lock.keepAlive(ctx)
+	defer stop()
+	_, gen, err := store.read(ctx, lock.uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.update(ctx, lock.uri, []byte("{}"), gen); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lost.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the context to be cancelled after the lock was lost")
+	}
+	if err := context.Cause(lost); !errors.Is(err, errLockLost) {
+		t.Errorf("Expected the cause to wrap errLockLost, got: %v", err)
+	}
+}
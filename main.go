@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/storage"
@@ -28,10 +29,20 @@ const (
 	// The name of the Git deployer sample, this is passed back to Cloud Deploy
 	// as metadata in the deploy results.
 	gitDeployerSampleName = "clouddeploy-git-ops-sample"
+	// Environment variable for running the deployer outside of Cloud Deploy. When set, secrets are read from,
+	// and artifacts, results and locks are written to, this local directory instead of Google Cloud.
+	localDirEnvKey = "GIT_DEPLOYER_LOCAL_DIR"
 )
 
 func main() {
-	if err := do(); err != nil {
+	var err error
+	if len(os.Args) > 1 {
+		// Run from the command line, e.g. "git-deployer deploy --cluster-group=prod --platform-revision=v2".
+		err = runCommand(context.Background(), os.Args[1:], os.Stdout)
+	} else {
+		err = do()
+	}
+	if err != nil {
 		fmt.Printf("err: %v\n", err)
 		os.Exit(1)
 	}
@@ -40,9 +51,14 @@ func main() {
 
 func do() error {
 	ctx := context.Background()
-	gcsClient, err := storage.NewClient(ctx)
-	if err != nil {
-		return fmt.Errorf("unable to create cloud storage client: %v", err)
+	localDir := os.Getenv(localDirEnvKey)
+	var gcsClient *storage.Client
+	if len(localDir) == 0 {
+		var err error
+		gcsClient, err = storage.NewClient(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to create cloud storage client: %v", err)
+		}
 	}
 	req, err := clouddeploy.DetermineRequest(ctx, gcsClient, []string{})
 	if err != nil {
@@ -52,7 +68,7 @@ func do() error {
 	if err != nil {
 		return fmt.Errorf("unable to determine params: %v", err)
 	}
-	h, err := createRequestHandler(ctx, req, params, gcsClient)
+	h, err := createRequestHandler(ctx, req, params, gcsClient, localDir)
 	if err != nil {
 		return err
 	}
@@ -65,30 +81,52 @@ type requestHandler interface {
 	process(ctx context.Context) error
 }
 
-// createRequestHandler creates a requestHandler for the provided Cloud Deploy request.
-func createRequestHandler(ctx context.Context, cloudDeployRequest interface{}, params *params, gcsClient *storage.Client) (requestHandler, error) {
-	// The git deployer only supports deploy. If a render request is received then a not supported result will be
-	// uploaded to Cloud Storage in order to provide Cloud Deploy with context on why the render failed.
+// createRequestHandler creates a requestHandler for the provided Cloud Deploy request. If localDir is set then
+// the deployer uses the local directory instead of Cloud Storage and Secret Manager.
+func createRequestHandler(ctx context.Context, cloudDeployRequest interface{}, params *params, gcsClient *storage.Client, localDir string) (requestHandler, error) {
 	switch r := cloudDeployRequest.(type) {
 	case *clouddeploy.RenderRequest:
-		fmt.Println("Rendering empty manifest, since git-deployer targets do not require it")
+		if len(localDir) != 0 {
+			return nil, fmt.Errorf("render requests are not supported when %s is set", localDirEnvKey)
+		}
+		smClient, err := secretmanager.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create secret manager client: %v", err)
+		}
+
 		return &renderer{
 			req:       r,
 			params:    params,
 			gcsClient: gcsClient,
+			secrets:   &secretManagerAccessor{client: smClient},
 		}, nil
 
 	case *clouddeploy.DeployRequest:
+		if len(localDir) != 0 {
+			fmt.Printf("Using local directory %s for secrets, artifacts and locks\n", localDir)
+			return &deployer{
+				req:       r,
+				params:    params,
+				secrets:   &localSecretAccessor{dir: filepath.Join(localDir, "secrets")},
+				artifacts: &localArtifactStore{dir: filepath.Join(localDir, "artifacts")},
+				lockStore: &localLockStore{dir: filepath.Join(localDir, "locks")},
+			}, nil
+		}
 		smClient, err := secretmanager.NewClient(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("unable to create secret manager client: %v", err)
 		}
 
+		var locks lockStore = &gcsLockStore{client: gcsClient}
+		if len(params.gitLockDir) != 0 {
+			locks = &localLockStore{}
+		}
 		return &deployer{
 			req:       r,
 			params:    params,
-			gcsClient: gcsClient,
-			smClient:  smClient,
+			secrets:   &secretManagerAccessor{client: smClient},
+			artifacts: &gcsArtifactStore{req: r, gcsClient: gcsClient},
+			lockStore: locks,
 		}, nil
 
 	default:
@@ -101,6 +139,7 @@ type renderer struct {
 	req       *clouddeploy.RenderRequest
 	params    *params
 	gcsClient *storage.Client
+	secrets   SecretAccessor
 }
 
 // process processes a render request and uploads succeeded or failed results to GCS for Cloud Deploy.
@@ -133,9 +172,31 @@ func (r *renderer) process(ctx context.Context) error {
 	return nil
 }
 
-// Creates an empty render result so users can specify an empty skaffold.yaml without extraneous manifests.
+// render clones the source repository and hydrates the clusters the release would update with the revisions
+// of the release. The hydrated manifests are concatenated and uploaded as the rendered manifest, so release
+// reviewers can preview the rollout.
 func (r *renderer) render(ctx context.Context) (*clouddeploy.RenderResult, error) {
-	manifest := []byte("# Empty manifest generated by git-deployer")
+	workspace, err := os.MkdirTemp("", "git-deployer-render-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create workspace: %v", err)
+	}
+	defer os.RemoveAll(workspace)
+
+	// The preview only reads the source repository, so it needs neither a deploy request nor a lock.
+	preview := &deployer{params: r.params, secrets: r.secrets}
+	outputDir := filepath.Join(workspace, "rendered")
+	clusters, err := preview.renderPreview(ctx, outputDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render preview: %v", err)
+	}
+	fmt.Printf("Rendered manifests of clusters %v\n", clusters)
+
+	manifest := []byte(fmt.Sprintf("# No clusters in cluster group %s would be updated by git-deployer\n", r.params.hydrationClusterGroup))
+	if len(clusters) != 0 {
+		if manifest, err = concatenateManifests(outputDir); err != nil {
+			return nil, fmt.Errorf("unable to read rendered manifests: %v", err)
+		}
+	}
 
 	mURI, err := r.req.UploadArtifact(ctx, r.gcsClient, "manifest.yaml", &clouddeploy.GCSUploadContent{Data: manifest})
 	if err != nil {
@@ -0,0 +1,332 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	// Time zones of maintenance windows are available even if the image has no time zone database.
+	_ "time/tzdata"
+)
+
+// deferredClustersMetadataKey is the deploy result metadata key listing the clusters that were not updated
+// because their maintenance window does not open in time, with the reason of each.
+const deferredClustersMetadataKey = "deferred-clusters"
+
+// maintenanceWindow is a recurring window during which a cluster may be changed, e.g.
+// "TZ=Europe/Berlin 0 2 * * SAT,SUN 4h" for 02:00 to 06:00 Berlin time on weekends. The window opens at the
+// times matching the cron fields minute, hour, day of month, month and day of week in the time zone, UTC if
+// not provided, and stays open for the duration.
+type maintenanceWindow struct {
+	spec string
+	loc  *time.Location
+	// Allowed values of the cron fields, as bit sets.
+	minute, hour, dom, month, dow uint64
+	// Whether the day of month and day of week fields are "*". If both are restricted, either matches.
+	domAny, dowAny bool
+	duration       time.Duration
+}
+
+// cronField describes the values of a cron field.
+type cronField struct {
+	name     string
+	min, max int
+	// Names of the values starting at min, if any.
+	names []string
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDOM    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12, names: []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}}
+	// Both 0 and 7 are Sunday.
+	cronDOW = cronField{name: "day of week", min: 0, max: 7, names: []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}}
+)
+
+// parseMaintenanceWindow parses a window of the form "[TZ={time zone}] {minute} {hour} {day of month} {month}
+// {day of week} {duration}". Cron fields are "*", values, ranges "a-b", steps "*/n" or "a-b/n", and comma
+// separated lists of these. Months and days of week can also be three letter names, e.g. "MON-FRI".
+func parseMaintenanceWindow(spec string) (*maintenanceWindow, error) {
+	fields := strings.Fields(spec)
+	w := &maintenanceWindow{spec: strings.Join(fields, " "), loc: time.UTC}
+	if len(fields) != 0 {
+		if tz, ok := strings.CutPrefix(fields[0], "TZ="); ok {
+			loc, err := time.LoadLocation(tz)
+			if err != nil {
+				return nil, fmt.Errorf("invalid time zone %q: %v", tz, err)
+			}
+			w.loc = loc
+			fields = fields[1:]
+		}
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("expected 5 cron fields and a duration, got %q", spec)
+	}
+	var err error
+	for _, f := range []struct {
+		set   *uint64
+		field cronField
+		value string
+	}{
+		{&w.minute, cronMinute, fields[0]},
+		{&w.hour, cronHour, fields[1]},
+		{&w.dom, cronDOM, fields[2]},
+		{&w.month, cronMonth, fields[3]},
+		{&w.dow, cronDOW, fields[4]},
+	} {
+		if *f.set, err = parseCronField(f.value, f.field); err != nil {
+			return nil, err
+		}
+	}
+	// Sunday is matched as 0.
+	if w.dow&(1<<7) != 0 {
+		w.dow |= 1
+	}
+	w.domAny, w.dowAny = fields[2] == "*", fields[4] == "*"
+	if w.duration, err = time.ParseDuration(fields[5]); err != nil || w.duration < time.Minute {
+		return nil, fmt.Errorf("invalid duration %q, expected at least 1m", fields[5])
+	}
+	return w, nil
+}
+
+// parseCronField returns the set of values of the cron field.
+func parseCronField(value string, f cronField) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(value, ",") {
+		expr, stepValue, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepValue); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q of %s %q", stepValue, f.name, value)
+			}
+		}
+		lo, hi := f.min, f.max
+		if expr != "*" {
+			first, last, isRange := strings.Cut(expr, "-")
+			var err error
+			if lo, err = f.parseValue(first); err != nil {
+				return 0, fmt.Errorf("invalid %s %q: %v", f.name, value, err)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = f.parseValue(last); err != nil {
+					return 0, fmt.Errorf("invalid %s %q: %v", f.name, value, err)
+				}
+			} else if hasStep {
+				hi = f.max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid %s %q: range %s is descending", f.name, value, expr)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// parseValue parses a number or name of the field.
+func (f cronField) parseValue(s string) (int, error) {
+	if i := slices.Index(f.names, strings.ToUpper(s)); i != -1 {
+		return f.min + i, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("%d is not between %d and %d", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+func (w *maintenanceWindow) String() string {
+	return w.spec
+}
+
+// opensAt returns whether the window opens at the minute of t.
+func (w *maintenanceWindow) opensAt(t time.Time) bool {
+	t = t.In(w.loc)
+	if w.minute&(1<<t.Minute()) == 0 || w.hour&(1<<t.Hour()) == 0 || w.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	domMatch, dowMatch := w.dom&(1<<t.Day()) != 0, w.dow&(1<<int(t.Weekday())) != 0
+	if w.domAny || w.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// openings returns the start times of the windows open at any time between from and until.
+func (w *maintenanceWindow) openings(from, until time.Time) []time.Time {
+	var starts []time.Time
+	for t := from.Add(-w.duration).Truncate(time.Minute).Add(time.Minute); !t.After(until); t = t.Add(time.Minute) {
+		if w.opensAt(t) {
+			starts = append(starts, t)
+		}
+	}
+	return starts
+}
+
+// openAt returns whether a window starting at one of the start times is open at t.
+func (w *maintenanceWindow) openAt(starts []time.Time, t time.Time) bool {
+	return slices.ContainsFunc(starts, func(s time.Time) bool { return !s.After(t) && t.Before(s.Add(w.duration)) })
+}
+
+// isOpen returns whether the window is open at t.
+func (w *maintenanceWindow) isOpen(t time.Time) bool {
+	return w.openAt(w.openings(t, t), t)
+}
+
+// earliestStart returns the earliest time between now and until from which a window stays open for the
+// duration, given the start times of the windows, and whether there is one.
+func (w *maintenanceWindow) earliestStart(starts []time.Time, now, until time.Time, duration time.Duration) (time.Time, bool) {
+	for _, s := range starts {
+		t := s
+		if t.Before(now) {
+			t = now
+		}
+		if t.After(until) {
+			break
+		}
+		if !t.Add(duration).After(s.Add(w.duration)) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// maintenanceSchedule is when the next part of a batch can be rolled out within the maintenance windows of
+// its clusters.
+type maintenanceSchedule struct {
+	// Time from which the windows of the clusters stay open for the rollout.
+	start    time.Time
+	clusters []string
+	// Clusters whose window opens later, which are rolled out in later parts of the batch.
+	remaining []string
+	// Clusters whose window does not open in time.
+	deferred []clusterExclusion
+}
+
+// scheduleMaintenance returns the next part of the batch to roll out: the clusters whose maintenance windows
+// all stay open for the rollout duration from the earliest time between now and until at which the window of
+// any of the clusters does. Clusters without a window can always be changed. The other clusters remain to be
+// scheduled once this part is rolled out, and clusters whose window does not open for the rollout duration
+// before until are deferred.
+func scheduleMaintenance(clusters []string, windows map[string]*maintenanceWindow, now, until time.Time, duration time.Duration) *maintenanceSchedule {
+	s := &maintenanceSchedule{start: now}
+	openings := map[string][]time.Time{}
+	var candidates []string
+	windowed := false
+	for _, name := range clusters {
+		w := windows[name]
+		if w == nil {
+			candidates = append(candidates, name)
+			continue
+		}
+		openings[name] = w.openings(now, until)
+		start, ok := w.earliestStart(openings[name], now, until, duration)
+		if !ok {
+			s.deferred = append(s.deferred, clusterExclusion{name: name, reason: fmt.Sprintf("maintenance window %s does not open for %s before %s", w, duration, until.Format(time.RFC3339))})
+			continue
+		}
+		if !windowed || start.Before(s.start) {
+			s.start = start
+		}
+		windowed = true
+		candidates = append(candidates, name)
+	}
+	// Clusters without a window are rolled out with the earliest part.
+	for _, name := range candidates {
+		w := windows[name]
+		if w == nil {
+			s.clusters = append(s.clusters, name)
+			continue
+		}
+		if start, ok := w.earliestStart(openings[name], s.start, s.start, duration); ok && start.Equal(s.start) {
+			s.clusters = append(s.clusters, name)
+		} else {
+			s.remaining = append(s.remaining, name)
+		}
+	}
+	return s
+}
+
+// closedWindows returns the clusters whose maintenance window is not open at t.
+func closedWindows(clusters []string, windows map[string]*maintenanceWindow, t time.Time) []string {
+	var closed []string
+	for _, name := range clusters {
+		if w := windows[name]; w != nil && !w.isOpen(t) {
+			closed = append(closed, name)
+		}
+	}
+	return closed
+}
+
+// maintenanceWindows returns the maintenance windows of the clusters from the window column of the table.
+// Clusters with an empty window have none.
+func maintenanceWindows(table *sotTable, windowColumn string) (map[string]*maintenanceWindow, error) {
+	if !slices.Contains(table.columns, windowColumn) {
+		return nil, fmt.Errorf("source of truth has no maintenance window column %q", windowColumn)
+	}
+	windows := map[string]*maintenanceWindow{}
+	for _, c := range table.clusters {
+		spec := strings.TrimSpace(c.fields[windowColumn])
+		if len(spec) == 0 {
+			continue
+		}
+		w, err := parseMaintenanceWindow(spec)
+		if err != nil {
+			pos := fmt.Sprintf("line %d", c.line)
+			if len(c.file) != 0 {
+				pos = c.file + " " + pos
+			}
+			return nil, fmt.Errorf("%s: invalid maintenance window of cluster %q: %v", pos, c.name(), err)
+		}
+		windows[c.name()] = w
+	}
+	return windows, nil
+}
+
+// maintenanceWindows returns the maintenance windows of the clusters, or nil if the source of truth has no
+// maintenance window column.
+func (d *deployer) maintenanceWindows(sot sourceOfTruth) (map[string]*maintenanceWindow, error) {
+	if len(d.params.hydrationMaintenanceWindowColumn) == 0 {
+		return nil, nil
+	}
+	table, _, err := sot.load()
+	if err != nil {
+		return nil, err
+	}
+	return maintenanceWindows(table, d.params.hydrationMaintenanceWindowColumn)
+}
+
+// waitForMaintenance waits until the start time. Returns the cause of the cancellation if the context is
+// cancelled, e.g. because the rollout lock was lost.
+func waitForMaintenance(ctx context.Context, start time.Time) error {
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-time.After(time.Until(start)):
+		return nil
+	}
+}
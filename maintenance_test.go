@@ -0,0 +1,210 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mustParseTime parses an RFC 3339 time.
+func mustParseTime(t *testing.T, s string) time.Time {
+	t.Helper()
+	tm, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+func TestMaintenanceWindowOpenAt(t *testing.T) {
+	testCases := []struct {
+		spec string
+		// Times the window is open and closed at.
+		open, closed []string
+	}{
+		{
+			// Saturday 2023-12-16 and Sunday 2023-12-17, 02:00 to 06:00 in Berlin, which is UTC+1 in winter.
+			spec:   "TZ=Europe/Berlin 0 2 * * SAT,SUN 4h",
+			open:   []string{"2023-12-16T01:00:00Z", "2023-12-17T04:59:59Z"},
+			closed: []string{"2023-12-16T00:59:00Z", "2023-12-16T05:00:00Z", "2023-12-18T02:00:00Z"},
+		},
+		{
+			spec:   "30 */6 * * MON-FRI 30m",
+			open:   []string{"2023-12-18T00:30:00Z", "2023-12-18T18:45:00Z", "2023-12-22T12:59:00Z"},
+			closed: []string{"2023-12-18T01:00:00Z", "2023-12-18T03:30:00Z", "2023-12-23T00:30:00Z"},
+		},
+		{
+			// Windows spanning midnight are open on the next day.
+			spec:   "0 22 1 * * 4h",
+			open:   []string{"2024-01-01T23:00:00Z", "2024-01-02T01:59:00Z"},
+			closed: []string{"2024-01-02T02:00:00Z", "2024-01-02T22:30:00Z"},
+		},
+		{
+			// Both day of month and day of week are restricted, so either matches, and 7 is Sunday.
+			spec:   "0 0 15 * 7 1h",
+			open:   []string{"2023-12-15T00:10:00Z", "2023-12-17T00:10:00Z"},
+			closed: []string{"2023-12-16T00:10:00Z"},
+		},
+	}
+	for _, tc := range testCases {
+		w, err := parseMaintenanceWindow(tc.spec)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tc.spec, err)
+		}
+		check := func(times []string, want bool) {
+			for _, s := range times {
+				tm := mustParseTime(t, s)
+				if got := w.openAt(w.openings(tm, tm), tm); got != want {
+					t.Errorf("Expected window %q open at %s to be %v, got: %v", tc.spec, s, want, got)
+				}
+			}
+		}
+		check(tc.open, true)
+		check(tc.closed, false)
+	}
+}
+
+func TestParseMaintenanceWindowErrors(t *testing.T) {
+	for spec, want := range map[string]string{
+		"":                             "expected 5 cron fields and a duration",
+		"0 2 * * *":                    "expected 5 cron fields and a duration",
+		"TZ=Mars/Olympus 0 2 * * * 1h": "invalid time zone",
+		"60 2 * * * 1h":                "invalid minute",
+		"0 2 * * FUN 1h":               "invalid day of week",
+		"0 5-2 * * * 1h":               "descending",
+		"*/0 2 * * * 1h":               "invalid step",
+		"0 2 * * * 30s":                "invalid duration",
+		"0 2 * * * forever":            "invalid duration",
+	} {
+		_, err := parseMaintenanceWindow(spec)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q error parsing %q, got: %v", want, spec, err)
+		}
+	}
+}
+
+func TestScheduleMaintenance(t *testing.T) {
+	windows := map[string]*maintenanceWindow{}
+	for name, spec := range map[string]string{
+		// Open from 01:00 to 03:00 and from 02:00 to 04:00 on every day.
+		"early": "0 1 * * * 2h",
+		"late":  "0 2 * * * 2h",
+		// Open at 05:00 for an hour, not overlapping the others.
+		"dawn": "0 5 * * * 1h",
+		// Only open once a year.
+		"yearly": "0 0 1 1 * 1h",
+		// Too short for the rollout duration.
+		"short": "0 6 * * * 10m",
+	} {
+		w, err := parseMaintenanceWindow(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		windows[name] = w
+	}
+	now := mustParseTime(t, "2023-12-18T00:00:00Z")
+	until := now.Add(12 * time.Hour)
+
+	testCases := []struct {
+		clusters  []string
+		start     string
+		expected  []string
+		remaining []string
+		deferred  []string
+	}{
+		{[]string{"unconstrained"}, "2023-12-18T00:00:00Z", []string{"unconstrained"}, nil, nil},
+		{[]string{"early", "late", "unconstrained"}, "2023-12-18T01:00:00Z", []string{"early", "unconstrained"}, []string{"late"}, nil},
+		{[]string{"early", "dawn", "late"}, "2023-12-18T01:00:00Z", []string{"early"}, []string{"dawn", "late"}, nil},
+		{[]string{"yearly", "dawn"}, "2023-12-18T05:00:00Z", []string{"dawn"}, nil, []string{"yearly"}},
+		{[]string{"yearly", "short"}, "2023-12-18T00:00:00Z", nil, nil, []string{"yearly", "short"}},
+	}
+	for _, tc := range testCases {
+		s := scheduleMaintenance(tc.clusters, windows, now, until, 30*time.Minute)
+		var deferred []string
+		for _, e := range s.deferred {
+			deferred = append(deferred, e.name)
+		}
+		if got := s.start.Format(time.RFC3339); got != tc.start || !reflect.DeepEqual(s.clusters, tc.expected) || !reflect.DeepEqual(s.remaining, tc.remaining) || !reflect.DeepEqual(deferred, tc.deferred) {
+			t.Errorf("Schedule of %v mismatch\nExpected: %s %v remaining %v deferred %v\n     Got: %s %v remaining %v deferred %v", tc.clusters, tc.start, tc.expected, tc.remaining, tc.deferred, got, s.clusters, s.remaining, deferred)
+		}
+	}
+
+	// The window of a cluster opening after until is not waited for.
+	s := scheduleMaintenance([]string{"dawn"}, windows, now, now.Add(4*time.Hour), 30*time.Minute)
+	if len(s.deferred) != 1 || !strings.Contains(s.deferred[0].reason, "does not open for 30m0s before 2023-12-18T04:00:00Z") {
+		t.Errorf("Expected dawn to be deferred, got: %v", s.deferred)
+	}
+
+	// A window that closes during the rollout is not used, the next one is.
+	s = scheduleMaintenance([]string{"early"}, windows, mustParseTime(t, "2023-12-18T02:45:00Z"), now.Add(48*time.Hour), 30*time.Minute)
+	if got := s.start.Format(time.RFC3339); got != "2023-12-19T01:00:00Z" || len(s.clusters) != 1 {
+		t.Errorf("Expected early to be scheduled in the next window, got: %s %v", got, s.clusters)
+	}
+}
+
+func TestScheduleMaintenanceNonOverlappingBatchmates(t *testing.T) {
+	windows := map[string]*maintenanceWindow{}
+	for name, spec := range map[string]string{
+		"night":   "0 1 * * * 1h",
+		"morning": "0 7 * * * 1h",
+	} {
+		w, err := parseMaintenanceWindow(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		windows[name] = w
+	}
+	now := mustParseTime(t, "2023-12-18T00:00:00Z")
+	until := now.Add(12 * time.Hour)
+
+	// Both windows open before until, so neither cluster is deferred and they are rolled out in turn.
+	first := scheduleMaintenance([]string{"morning", "night"}, windows, now, until, 20*time.Minute)
+	if got := first.start.Format(time.RFC3339); got != "2023-12-18T01:00:00Z" || !slices.Equal(first.clusters, []string{"night"}) || !slices.Equal(first.remaining, []string{"morning"}) || len(first.deferred) != 0 {
+		t.Fatalf("Unexpected first part: %s %v remaining %v deferred %v", got, first.clusters, first.remaining, first.deferred)
+	}
+	second := scheduleMaintenance(first.remaining, windows, first.start.Add(20*time.Minute), until, 20*time.Minute)
+	if got := second.start.Format(time.RFC3339); got != "2023-12-18T07:00:00Z" || !slices.Equal(second.clusters, []string{"morning"}) || len(second.remaining) != 0 || len(second.deferred) != 0 {
+		t.Errorf("Unexpected second part: %s %v remaining %v deferred %v", got, second.clusters, second.remaining, second.deferred)
+	}
+	if closed := closedWindows([]string{"night", "morning"}, windows, first.start.Add(20*time.Minute)); !slices.Equal(closed, []string{"morning"}) {
+		t.Errorf("Expected only the morning window to be closed, got: %v", closed)
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	table := &sotTable{columns: append(slices.Clone(sotColumns), "maintenance_window")}
+	for i, c := range [][]string{{"cluster1", "0 2 * * * 4h"}, {"cluster2", ""}} {
+		table.clusters = append(table.clusters, &sotCluster{line: i + 2, fields: map[string]string{clusterNameColumn: c[0], "maintenance_window": c[1]}})
+	}
+	windows, err := maintenanceWindows(table, "maintenance_window")
+	if err != nil {
+		t.Fatalf("Failed to determine maintenance windows: %v", err)
+	}
+	if len(windows) != 1 || windows["cluster1"].String() != "0 2 * * * 4h" {
+		t.Errorf("Expected a window for cluster1 only, got: %v", windows)
+	}
+
+	table.clusters[1].fields["maintenance_window"] = "0 2 * *"
+	if _, err := maintenanceWindows(table, "maintenance_window"); err == nil || !strings.Contains(err.Error(), `line 3: invalid maintenance window of cluster "cluster2"`) {
+		t.Errorf("Expected invalid window error, got: %v", err)
+	}
+	if _, err := maintenanceWindows(table, "window"); err == nil {
+		t.Error("Expected error for missing maintenance window column")
+	}
+}
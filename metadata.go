@@ -0,0 +1,144 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// notesRef is the ref holding the git notes with the rollout metadata of deployer commits.
+const notesRef = "refs/notes/cloud-deploy"
+
+// rolloutBatch describes the batch of clusters currently being rolled out.
+type rolloutBatch struct {
+	// 1-based number of the batch.
+	number   int
+	total    int
+	clusters []string
+	// Wave of the batch, empty if the clusters are not grouped into waves.
+	wave string
+	// Numbers of the earlier batches that were skipped since all of their clusters were deferred, so the
+	// batch numbers of the rollout are not consecutive.
+	skipped []int
+}
+
+// commitTrailers returns the git trailers identifying the rollout and batch of a deployer commit, so the
+// rollout history can be reconstructed from the git log.
+func (d *deployer) commitTrailers() string {
+	trailers := [][]string{
+		{"Cloud-Deploy-Pipeline", d.req.Pipeline},
+		{"Cloud-Deploy-Release", d.req.Release},
+		{"Cloud-Deploy-Rollout", d.req.Rollout},
+		{"Cloud-Deploy-Target", d.req.Target},
+		{"Cluster-Group", d.params.hydrationClusterGroup},
+	}
+	if d.batch != nil {
+		trailers = append(trailers,
+			[]string{"Batch", fmt.Sprintf("%d/%d", d.batch.number, d.batch.total)},
+			[]string{"Clusters", strings.Join(d.batch.clusters, ",")},
+		)
+		if len(d.batch.wave) != 0 {
+			trailers = append(trailers, []string{"Wave", d.batch.wave})
+		}
+		if len(d.batch.skipped) != 0 {
+			skipped := make([]string, len(d.batch.skipped))
+			for i, n := range d.batch.skipped {
+				skipped[i] = strconv.Itoa(n)
+			}
+			trailers = append(trailers, []string{"Skipped-Batches", strings.Join(skipped, ",")})
+		}
+	}
+	var b strings.Builder
+	for _, t := range trailers {
+		fmt.Fprintf(&b, "%s: %s\n", t[0], t[1])
+	}
+	return b.String()
+}
+
+// rolloutNote is the JSON content of the git note attached to deployer commits.
+type rolloutNote struct {
+	Project          string   `json:"project"`
+	Location         string   `json:"location"`
+	Pipeline         string   `json:"pipeline"`
+	Release          string   `json:"release"`
+	Rollout          string   `json:"rollout"`
+	Target           string   `json:"target"`
+	Phase            string   `json:"phase,omitempty"`
+	ClusterGroup     string   `json:"clusterGroup"`
+	Batch            int      `json:"batch,omitempty"`
+	TotalBatches     int      `json:"totalBatches,omitempty"`
+	Clusters         []string `json:"clusters,omitempty"`
+	Wave             string   `json:"wave,omitempty"`
+	SkippedBatches   []int    `json:"skippedBatches,omitempty"`
+	PlatformRevision string   `json:"platformRevision,omitempty"`
+	WorkloadRevision string   `json:"workloadRevision,omitempty"`
+	SourceRepo       string   `json:"sourceRepo"`
+	OutputRepo       string   `json:"outputRepo"`
+}
+
+// rolloutNote returns the git note content with the full rollout metadata of the current batch.
+func (d *deployer) rolloutNote() ([]byte, error) {
+	n := &rolloutNote{
+		Project:          d.req.Project,
+		Location:         d.req.Location,
+		Pipeline:         d.req.Pipeline,
+		Release:          d.req.Release,
+		Rollout:          d.req.Rollout,
+		Target:           d.req.Target,
+		Phase:            d.req.Phase,
+		ClusterGroup:     d.params.hydrationClusterGroup,
+		PlatformRevision: d.params.hydrationPlatformRevision,
+		WorkloadRevision: d.params.hydrationWorkloadRevision,
+		SourceRepo:       d.params.gitSourceRepo,
+		OutputRepo:       d.params.gitOutputRepo,
+	}
+	if d.batch != nil {
+		n.Batch, n.TotalBatches, n.Clusters, n.Wave, n.SkippedBatches = d.batch.number, d.batch.total, d.batch.clusters, d.batch.wave, d.batch.skipped
+	}
+	return json.MarshalIndent(n, "", "  ")
+}
+
+// pushRolloutNote attaches the rollout note to the commit the deployer pushed and pushes it, retrying when
+// the remote notes ref moved concurrently. No note is attached if commit is empty, since the deployer did
+// not create the commit. Failures are only logged since the note duplicates the commit trailers.
+func (d *deployer) pushRolloutNote(gitRepo gitRepository, commit string) {
+	if !d.params.gitEnableNotes {
+		return
+	}
+	if len(commit) == 0 {
+		fmt.Println("Not attaching a git note since no commit was pushed")
+		return
+	}
+	note, err := d.rolloutNote()
+	if err != nil {
+		fmt.Printf("Unable to create git note: %v\n", err)
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		_, err := gitRepo.pushNote(notesRef, commit, string(note))
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, errPushRejected) || attempt > d.params.gitPushRetries {
+			fmt.Printf("Unable to push git note to %s: %v\n", notesRef, err)
+			return
+		}
+		fmt.Printf("Push of %s was rejected because the remote ref moved, retrying (%d/%d)\n", notesRef, attempt, d.params.gitPushRetries)
+	}
+}
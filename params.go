@@ -26,29 +26,59 @@ import (
 // Cloud Deploy transforms a deploy parameter "customTarget/gitRepo" into an
 // environment variable of the form "CLOUD_DEPLOY_customTarget_gitRepo".
 const (
-	gitSourceRepoEnvKey                   = "CLOUD_DEPLOY_customTarget_gitSourceRepo"
-	gitSourceBranchEnvKey                 = "CLOUD_DEPLOY_customTarget_gitSourceBranch"
-	gitSecretEnvKey                       = "CLOUD_DEPLOY_customTarget_gitSecret"
-	gitUsernameEnvKey                     = "CLOUD_DEPLOY_customTarget_gitUsername"
-	gitEmailEnvKey                        = "CLOUD_DEPLOY_customTarget_gitEmail"
-	gitCommitMessageEnvKey                = "CLOUD_DEPLOY_customTarget_gitCommitMessage"
-	gitOutputRepoEnvKey                   = "CLOUD_DEPLOY_customTarget_gitOutputRepo"
-	gitOutputBranchEnvKey                 = "CLOUD_DEPLOY_customTarget_gitOutputBranch"
-	gitPullRequestTitleEnvKey             = "CLOUD_DEPLOY_customTarget_gitPullRequestTitle"
-	gitPullRequestBodyEnvKey              = "CLOUD_DEPLOY_customTarget_gitPullRequestBody"
-	gitEnablePullRequestMergeEnvKey       = "CLOUD_DEPLOY_customTarget_gitEnablePullRequestMerge"
-	hydrationSourceOfTruthEnvKey          = "CLOUD_DEPLOY_customTarget_hydrationSourceOfTruth"
-	hydrationBaseDirEnvKey                = "CLOUD_DEPLOY_customTarget_hydrationBaseDir"
-	hydrationOverlayDirEnvKey             = "CLOUD_DEPLOY_customTarget_hydrationOverlayDir"
-	hydrationOutputDirEnvKey              = "CLOUD_DEPLOY_customTarget_hydrationOutputDir"
-	hydrationClusterGroupEnvKey           = "CLOUD_DEPLOY_customTarget_hydrationClusterGroup"
-	hydrationBatchSizeEnvKey              = "CLOUD_DEPLOY_customTarget_hydrationBatchSize"
-	hydrationWaitTimeBetweenBatchesEnvKey = "CLOUD_DEPLOY_customTarget_hydrationWaitTimeBetweenBatches"
-	hydrationPlatformRevisionEnvKey       = "platform-revision"
-	hydrationWorkloadRevisionEnvKey       = "workload-revision"
+	gitSourceRepoEnvKey                     = "CLOUD_DEPLOY_customTarget_gitSourceRepo"
+	gitSourceBranchEnvKey                   = "CLOUD_DEPLOY_customTarget_gitSourceBranch"
+	gitSecretEnvKey                         = "CLOUD_DEPLOY_customTarget_gitSecret"
+	gitUsernameEnvKey                       = "CLOUD_DEPLOY_customTarget_gitUsername"
+	gitEmailEnvKey                          = "CLOUD_DEPLOY_customTarget_gitEmail"
+	gitCommitMessageEnvKey                  = "CLOUD_DEPLOY_customTarget_gitCommitMessage"
+	gitOutputRepoEnvKey                     = "CLOUD_DEPLOY_customTarget_gitOutputRepo"
+	gitOutputBranchEnvKey                   = "CLOUD_DEPLOY_customTarget_gitOutputBranch"
+	gitPullRequestTitleEnvKey               = "CLOUD_DEPLOY_customTarget_gitPullRequestTitle"
+	gitPullRequestBodyEnvKey                = "CLOUD_DEPLOY_customTarget_gitPullRequestBody"
+	gitEnablePullRequestMergeEnvKey         = "CLOUD_DEPLOY_customTarget_gitEnablePullRequestMerge"
+	gitBackendEnvKey                        = "CLOUD_DEPLOY_customTarget_gitBackend"
+	gitCloneDepthEnvKey                     = "CLOUD_DEPLOY_customTarget_gitCloneDepth"
+	gitCloneSingleBranchEnvKey              = "CLOUD_DEPLOY_customTarget_gitCloneSingleBranch"
+	gitSparseCheckoutEnvKey                 = "CLOUD_DEPLOY_customTarget_gitSparseCheckout"
+	gitSigningKeySecretEnvKey               = "CLOUD_DEPLOY_customTarget_gitSigningKeySecret"
+	gitPushRetriesEnvKey                    = "CLOUD_DEPLOY_customTarget_gitPushRetries"
+	gitEnableNotesEnvKey                    = "CLOUD_DEPLOY_customTarget_gitEnableNotes"
+	gitLockGCSPathEnvKey                    = "CLOUD_DEPLOY_customTarget_gitLockGCSPath"
+	gitLockDirEnvKey                        = "CLOUD_DEPLOY_customTarget_gitLockDir"
+	gitLockTTLEnvKey                        = "CLOUD_DEPLOY_customTarget_gitLockTTL"
+	gitRateLimitMaxWaitEnvKey               = "CLOUD_DEPLOY_customTarget_gitRateLimitMaxWait"
+	gitLockWaitTimeoutEnvKey                = "CLOUD_DEPLOY_customTarget_gitLockWaitTimeout"
+	gitEnableDeploymentsEnvKey              = "CLOUD_DEPLOY_customTarget_gitEnableDeployments"
+	gitDeploymentEnvironmentEnvKey          = "CLOUD_DEPLOY_customTarget_gitDeploymentEnvironment"
+	gitEnableTagEnvKey                      = "CLOUD_DEPLOY_customTarget_gitEnableTag"
+	gitTagNameEnvKey                        = "CLOUD_DEPLOY_customTarget_gitTagName"
+	hydrationSourceOfTruthEnvKey            = "CLOUD_DEPLOY_customTarget_hydrationSourceOfTruth"
+	hydrationSourceOfTruthFormatEnvKey      = "CLOUD_DEPLOY_customTarget_hydrationSourceOfTruthFormat"
+	hydrationBaseDirEnvKey                  = "CLOUD_DEPLOY_customTarget_hydrationBaseDir"
+	hydrationOverlayDirEnvKey               = "CLOUD_DEPLOY_customTarget_hydrationOverlayDir"
+	hydrationOutputDirEnvKey                = "CLOUD_DEPLOY_customTarget_hydrationOutputDir"
+	hydrationClusterGroupEnvKey             = "CLOUD_DEPLOY_customTarget_hydrationClusterGroup"
+	hydrationBatchSizeEnvKey                = "CLOUD_DEPLOY_customTarget_hydrationBatchSize"
+	hydrationWaitTimeBetweenBatchesEnvKey   = "CLOUD_DEPLOY_customTarget_hydrationWaitTimeBetweenBatches"
+	hydrationWaveColumnEnvKey               = "CLOUD_DEPLOY_customTarget_hydrationWaveColumn"
+	hydrationWaveBatchSizesEnvKey           = "CLOUD_DEPLOY_customTarget_hydrationWaveBatchSizes"
+	hydrationBatchStrategyEnvKey            = "CLOUD_DEPLOY_customTarget_hydrationBatchStrategy"
+	hydrationTopologyColumnEnvKey           = "CLOUD_DEPLOY_customTarget_hydrationTopologyColumn"
+	hydrationMaxClustersPerDomainEnvKey     = "CLOUD_DEPLOY_customTarget_hydrationMaxClustersPerDomain"
+	hydrationMaintenanceWindowColumnEnvKey  = "CLOUD_DEPLOY_customTarget_hydrationMaintenanceWindowColumn"
+	hydrationMaintenanceWindowMaxWaitEnvKey = "CLOUD_DEPLOY_customTarget_hydrationMaintenanceWindowMaxWait"
+	hydrationDeployTimeoutEnvKey            = "CLOUD_DEPLOY_customTarget_hydrationDeployTimeout"
+	hydrationMaintenanceBatchDurationEnvKey = "CLOUD_DEPLOY_customTarget_hydrationMaintenanceBatchDuration"
+	hydrationPlatformRevisionEnvKey         = "platform-revision"
+	hydrationWorkloadRevisionEnvKey         = "workload-revision"
 
 	matchClustersHavingAnyListedTagEnvKey  = "match-clusters-having-any-listed-tag"
 	matchClustersHavingAllListedTagsEnvKey = "match-clusters-having-all-listed-tags"
+	matchClustersExpressionEnvKey          = "match-clusters-expression"
+	matchClusterNamesEnvKey                = "match-cluster-names"
+	excludeClusterNamesEnvKey              = "exclude-cluster-names"
+	excludeClustersHavingTagsEnvKey        = "exclude-clusters-having-tags"
 )
 
 const (
@@ -69,6 +99,35 @@ const (
 
 	// Default output dir
 	defaultOutputDir = "output"
+
+	// Default template of the output repository tag name
+	defaultTagName = "{cluster-group}/{release}"
+
+	// Default number of times a rejected push is retried
+	defaultPushRetries = 3
+
+	// Default time after which a rollout lock that is not refreshed can be taken over
+	defaultLockTTL = 15 * time.Minute
+	// Minimum rollout lock TTL, so the lock is not refreshed more often than every 20 seconds
+	minLockTTL = time.Minute
+
+	// Default total time a Git provider API request may be paused because of rate limits
+	defaultRateLimitMaxWait = 5 * time.Minute
+
+	// Default time to wait for a rollout lock held by another rollout
+	defaultLockWaitTimeout = 10 * time.Minute
+
+	// Default maximum number of clusters of the same failure domain per batch
+	defaultMaxClustersPerDomain = 1
+
+	// Default maximum time to wait for the maintenance windows of a batch
+	defaultMaintenanceWindowMaxWait = time.Hour
+
+	// Default execution timeout of Cloud Deploy jobs
+	defaultDeployTimeout = time.Hour
+
+	// Default time a batch takes to be published within the maintenance windows of its clusters
+	defaultMaintenanceBatchDuration = 10 * time.Minute
 )
 
 type params struct {
@@ -79,12 +138,16 @@ type params struct {
 	// The name of the Secret Manager SecretVersion resource used for cloning the Git repository
 	// and optionally opening pull requests.
 	gitSecret string
+	// The name of the Secret Manager SecretVersion resource holding the unencrypted OpenPGP or SSH private
+	// key used to sign commits. If not provided then commits are not signed.
+	gitSigningKeySecret string
 	// The committer username. If not provided then defaults to "Cloud Deploy".
 	gitUsername string
 	// The commiter email. If not provided then the email address is left empty.
 	gitEmail string
 	// The commit message to use. If not provided then defaults to:
 	// "Delivery Pipeline: {pipeline-id} Release: {release-id} Rollout: {rollout-id}"
+	// Trailers with the rollout metadata are always appended.
 	gitCommitMessage string
 	// The URI of the source Git repository, e.g. "github.com/{owner}/{repository}".
 	gitOutputRepo string
@@ -103,18 +166,72 @@ type params struct {
 	gitPullRequestBody string
 	// Whether to merge the pull request opened against the gitDestintionBranch.
 	enablePullRequestMerge bool
+	// The git backend used for git operations, either "cli" or "native". If not provided then defaults to "cli".
+	gitBackend string
+	// Number of commits of history to clone, 0 clones the full history.
+	gitCloneDepth int
+	// Whether to only clone the source and output branches.
+	gitCloneSingleBranch bool
+	// Whether to only check out the source of truth, base, overlay and output paths.
+	gitSparseCheckout bool
+	// Number of times a push rejected because the remote branch moved is retried after rebasing.
+	gitPushRetries int
+	// Whether to attach a git note with the rollout metadata as JSON to every commit.
+	gitEnableNotes bool
+	// Cloud Storage path under which the rollout lock objects are stored, e.g. "gs://{bucket}/{dir}". If not
+	// provided then defaults to the "git-deployer-locks" directory in the bucket of the deploy output.
+	gitLockGCSPath string
+	// Local directory under which the rollout lock files are stored instead of Cloud Storage, so rollouts are
+	// only serialized on the same machine.
+	gitLockDir string
+	// Time after which a rollout lock that has not been refreshed is considered stale and can be taken over.
+	gitLockTTL time.Duration
+	// Total time a Git provider API request may be paused because of rate limits, the provider default if 0.
+	gitRateLimitMaxWait time.Duration
+	// Time to wait for a rollout lock held by another rollout before failing.
+	gitLockWaitTimeout time.Duration
+	// Whether to record a GitHub Deployment or GitLab environment deployment for the merge commit of each batch.
+	enableDeployments bool
+	// The environment name used for the deployments. If not provided then defaults to the cluster group.
+	gitDeploymentEnvironment string
+	// Whether to tag the merge commit of the last batch in the output repository.
+	enableTag bool
+	// Template of the tag name, which can reference {cluster-group}, {pipeline}, {release}, {rollout} and
+	// {target}. If not provided then defaults to "{cluster-group}/{release}".
+	gitTagName string
 	// Cluster Group of this target
 	hydrationClusterGroup string
 	// target platform revision being rolled out
 	hydrationPlatformRevision string
 	// target workload revision being rolled out
 	hydrationWorkloadRevision string
-	// number of clusters to include per batch
-	hydrationBatchSize int
+	// number or percentage of clusters to include per batch, by batch if the schedule is progressive
+	hydrationBatchSize batchSchedule
 	// time to wait between batches
 	hydrationWaitTimeBetweenBatches time.Duration
+	// source of truth column grouping the clusters into waves rolled out in order, no waves if empty
+	hydrationWaveColumn string
+	// number of clusters to include per batch by wave, overriding hydrationBatchSize
+	hydrationWaveBatchSizes map[string]batchSchedule
+	// strategy grouping the clusters of a wave into batches, either sequential or topology
+	hydrationBatchStrategy string
+	// source of truth column with the failure domain of the clusters for the topology strategy, e.g. region
+	hydrationTopologyColumn string
+	// maximum number of clusters of the same failure domain per batch for the topology strategy
+	hydrationMaxClustersPerDomain int
+	// source of truth column with the maintenance windows of the clusters, no windows if empty
+	hydrationMaintenanceWindowColumn string
+	// maximum time to wait for the maintenance windows of a batch to open
+	hydrationMaintenanceWindowMaxWait time.Duration
+	// execution timeout of the Cloud Deploy deploy job, after which clusters are not waited for
+	hydrationDeployTimeout time.Duration
+	// time a batch takes to be published, the maintenance windows of its clusters must stay open for it and
+	// the wait between batches
+	hydrationMaintenanceBatchDuration time.Duration
 	// path to source of truth in source repository
 	hydrationSourceOfTruth string
+	// format of the source of truth, determined from its path if empty
+	hydrationSourceOfTruthFormat string
 	// path to base templates
 	hydrationBaseDir string
 	// path to overlays
@@ -125,66 +242,101 @@ type params struct {
 	matchClustersHavingAnyListedTag []string
 	// match clusters having all of these tags
 	matchClustersHavingAllListedTags []string
+	// match clusters for which this selector expression is true, nil if not provided
+	matchClustersExpression selectorExpr
+	// only update the selected clusters matching any of these name patterns
+	matchClusterNames []clusterNamePattern
+	// exclude the selected clusters matching any of these name patterns
+	excludeClusterNames []clusterNamePattern
+	// exclude the selected clusters having any of these tags
+	excludeClustersHavingTags []string
+}
+
+// clusterFilter returns the filter of the selected clusters, or nil if no filter parameters are provided.
+func (p *params) clusterFilter() *clusterFilter {
+	if len(p.matchClusterNames) == 0 && len(p.excludeClusterNames) == 0 && len(p.excludeClustersHavingTags) == 0 {
+		return nil
+	}
+	return &clusterFilter{matchNames: p.matchClusterNames, excludeNames: p.excludeClusterNames, excludeTags: p.excludeClustersHavingTags}
 }
 
 // determineParams returns the params provided in the execution environment via environment variables.
 func determineParams() (*params, error) {
+	return determineParamsFrom(os.LookupEnv)
+}
+
+// determineParamsFrom returns the params provided by lookup, which returns the value of a parameter given its
+// environment variable name and whether it is set.
+func determineParamsFrom(lookup func(key string) (string, bool)) (*params, error) {
+	getenv := func(key string) string {
+		v, _ := lookup(key)
+		return v
+	}
 	params := &params{}
 	// Required parameters:
-	sourceRepo := os.Getenv(gitSourceRepoEnvKey)
+	sourceRepo := getenv(gitSourceRepoEnvKey)
 	if len(sourceRepo) == 0 {
 		return nil, fmt.Errorf("parameter %q is required", gitSourceRepoEnvKey)
 	}
 	params.gitSourceRepo = sourceRepo
 
-	outputRepo := os.Getenv(gitOutputRepoEnvKey)
+	outputRepo := getenv(gitOutputRepoEnvKey)
 	if len(outputRepo) == 0 {
 		return nil, fmt.Errorf("parameter %q is required", gitOutputRepoEnvKey)
 	}
 	params.gitOutputRepo = outputRepo
 
-	secret := os.Getenv(gitSecretEnvKey)
+	secret := getenv(gitSecretEnvKey)
 	if len(secret) == 0 {
 		return nil, fmt.Errorf("parameter %q is required", gitSecretEnvKey)
 	}
 	params.gitSecret = secret
 
-	srcBranch := os.Getenv(gitSourceBranchEnvKey)
+	srcBranch := getenv(gitSourceBranchEnvKey)
 	if len(srcBranch) == 0 {
 		return nil, fmt.Errorf("parameter %q is required", gitSourceBranchEnvKey)
 	}
 	params.gitSourceBranch = srcBranch
 
-	outputBranch := os.Getenv(gitOutputBranchEnvKey)
+	outputBranch := getenv(gitOutputBranchEnvKey)
 	if len(outputBranch) == 0 {
 		return nil, fmt.Errorf("parameter %q is required", gitOutputBranchEnvKey)
 	}
 	params.gitOutputBranch = outputBranch
 
-	clusterGroup := os.Getenv(hydrationClusterGroupEnvKey)
+	clusterGroup := getenv(hydrationClusterGroupEnvKey)
 	if len(clusterGroup) == 0 {
 		return nil, fmt.Errorf("parameter %q is required", hydrationClusterGroupEnvKey)
 	}
 	params.hydrationClusterGroup = clusterGroup
 
-	platformRevision := os.Getenv(hydrationPlatformRevisionEnvKey)
-	workloadRevision := os.Getenv(hydrationWorkloadRevisionEnvKey)
+	platformRevision := getenv(hydrationPlatformRevisionEnvKey)
+	workloadRevision := getenv(hydrationWorkloadRevisionEnvKey)
 	if len(platformRevision) == 0 && len(workloadRevision) == 0 {
 		return nil, fmt.Errorf("at least one of parameter %q and %q is required", hydrationPlatformRevisionEnvKey, hydrationWorkloadRevisionEnvKey)
 	}
 
+	if err := validateRevision(platformRevision); err != nil {
+		return nil, fmt.Errorf("parameter %q is not a valid revision: %v", hydrationPlatformRevisionEnvKey, err)
+	}
+	if err := validateRevision(workloadRevision); err != nil {
+		return nil, fmt.Errorf("parameter %q is not a valid revision: %v", hydrationWorkloadRevisionEnvKey, err)
+	}
+
 	params.hydrationPlatformRevision = platformRevision
 	params.hydrationWorkloadRevision = workloadRevision
 
-	batchSize, err := strconv.Atoi(os.Getenv(hydrationBatchSizeEnvKey))
-	if err != nil {
+	batchSize := getenv(hydrationBatchSizeEnvKey)
+	if len(batchSize) == 0 {
 		return nil, fmt.Errorf("parameter %q is required", hydrationBatchSizeEnvKey)
 	}
-
-	params.hydrationBatchSize = batchSize
+	var err error
+	if params.hydrationBatchSize, err = parseBatchSchedule(batchSize); err != nil {
+		return nil, fmt.Errorf("parameter %q is not valid: %v", hydrationBatchSizeEnvKey, err)
+	}
 
 	waitTime := defaultWaitTimeBetweenBatches
-	st := os.Getenv(hydrationWaitTimeBetweenBatchesEnvKey)
+	st := getenv(hydrationWaitTimeBetweenBatchesEnvKey)
 	if len(st) != 0 {
 		var err error
 		waitTime, err = time.ParseDuration(st)
@@ -195,39 +347,191 @@ func determineParams() (*params, error) {
 
 	params.hydrationWaitTimeBetweenBatches = waitTime
 
+	params.hydrationWaveColumn = getenv(hydrationWaveColumnEnvKey)
+	if params.hydrationWaveBatchSizes, err = parseWaveBatchSizes(getenv(hydrationWaveBatchSizesEnvKey)); err != nil {
+		return nil, fmt.Errorf("parameter %q is not valid: %v", hydrationWaveBatchSizesEnvKey, err)
+	}
+	if len(params.hydrationWaveBatchSizes) != 0 && len(params.hydrationWaveColumn) == 0 {
+		return nil, fmt.Errorf("parameter %q requires %q", hydrationWaveBatchSizesEnvKey, hydrationWaveColumnEnvKey)
+	}
+
+	params.hydrationBatchStrategy = getenv(hydrationBatchStrategyEnvKey)
+	if len(params.hydrationBatchStrategy) == 0 {
+		params.hydrationBatchStrategy = batchStrategySequential
+	}
+	params.hydrationTopologyColumn = getenv(hydrationTopologyColumnEnvKey)
+	params.hydrationMaxClustersPerDomain = defaultMaxClustersPerDomain
+	if v := getenv(hydrationMaxClustersPerDomainEnvKey); len(v) != 0 {
+		if params.hydrationMaxClustersPerDomain, err = strconv.Atoi(v); err != nil || params.hydrationMaxClustersPerDomain < 1 {
+			return nil, fmt.Errorf("parameter %q must be a positive number", hydrationMaxClustersPerDomainEnvKey)
+		}
+	}
+	switch params.hydrationBatchStrategy {
+	case batchStrategySequential:
+		if len(params.hydrationTopologyColumn) != 0 {
+			return nil, fmt.Errorf("parameter %q requires %q to be %s", hydrationTopologyColumnEnvKey, hydrationBatchStrategyEnvKey, batchStrategyTopology)
+		}
+	case batchStrategyTopology:
+		if len(params.hydrationTopologyColumn) == 0 {
+			return nil, fmt.Errorf("parameter %q is required by the %s batch strategy", hydrationTopologyColumnEnvKey, batchStrategyTopology)
+		}
+	default:
+		return nil, fmt.Errorf("parameter %q must be one of %s or %s", hydrationBatchStrategyEnvKey, batchStrategySequential, batchStrategyTopology)
+	}
+
+	params.hydrationMaintenanceWindowColumn = getenv(hydrationMaintenanceWindowColumnEnvKey)
+	params.hydrationMaintenanceWindowMaxWait = defaultMaintenanceWindowMaxWait
+	if mw := getenv(hydrationMaintenanceWindowMaxWaitEnvKey); len(mw) != 0 {
+		if params.hydrationMaintenanceWindowMaxWait, err = time.ParseDuration(mw); err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", hydrationMaintenanceWindowMaxWaitEnvKey, err)
+		}
+	}
+	params.hydrationDeployTimeout = defaultDeployTimeout
+	if dt := getenv(hydrationDeployTimeoutEnvKey); len(dt) != 0 {
+		if params.hydrationDeployTimeout, err = time.ParseDuration(dt); err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", hydrationDeployTimeoutEnvKey, err)
+		}
+	}
+	params.hydrationMaintenanceBatchDuration = defaultMaintenanceBatchDuration
+	if bd := getenv(hydrationMaintenanceBatchDurationEnvKey); len(bd) != 0 {
+		if params.hydrationMaintenanceBatchDuration, err = time.ParseDuration(bd); err != nil || params.hydrationMaintenanceBatchDuration < 0 {
+			return nil, fmt.Errorf("parameter %q must be a non-negative duration, got %q", hydrationMaintenanceBatchDurationEnvKey, bd)
+		}
+	}
+
 	// Optional parameters:
-	params.gitUsername = os.Getenv(gitUsernameEnvKey)
+	params.gitUsername = getenv(gitUsernameEnvKey)
 	if len(params.gitUsername) == 0 {
 		params.gitUsername = defaultUsername
 	}
 
-	params.hydrationSourceOfTruth = os.Getenv(hydrationSourceOfTruthEnvKey)
+	params.hydrationSourceOfTruth = getenv(hydrationSourceOfTruthEnvKey)
 	if len(params.hydrationSourceOfTruth) == 0 {
 		params.hydrationSourceOfTruth = defaultSourceOfTruth
 	}
 
-	params.hydrationBaseDir = os.Getenv(hydrationBaseDirEnvKey)
+	params.hydrationSourceOfTruthFormat = getenv(hydrationSourceOfTruthFormatEnvKey)
+	switch params.hydrationSourceOfTruthFormat {
+	case "", sotFormatCSV, sotFormatYAML, sotFormatJSON, sotFormatYAMLDir:
+	default:
+		return nil, fmt.Errorf("parameter %q must be one of %s, %s, %s or %s", hydrationSourceOfTruthFormatEnvKey, sotFormatCSV, sotFormatYAML, sotFormatJSON, sotFormatYAMLDir)
+	}
+
+	params.hydrationBaseDir = getenv(hydrationBaseDirEnvKey)
 	if len(params.hydrationBaseDir) == 0 {
 		params.hydrationBaseDir = defaultBaseDir
 	}
 
-	params.hydrationOverlaysDir = os.Getenv(hydrationOverlayDirEnvKey)
+	params.hydrationOverlaysDir = getenv(hydrationOverlayDirEnvKey)
 	if len(params.hydrationOverlaysDir) == 0 {
 		params.hydrationOverlaysDir = defaultOverlayDir
 	}
 
-	params.hydrationOutputDir = os.Getenv(hydrationOutputDirEnvKey)
+	params.hydrationOutputDir = getenv(hydrationOutputDirEnvKey)
 	if len(params.hydrationOutputDir) == 0 {
 		params.hydrationOutputDir = defaultOutputDir
 	}
 
-	params.gitEmail = os.Getenv(gitEmailEnvKey)
-	params.gitCommitMessage = os.Getenv(gitCommitMessageEnvKey)
-	params.gitPullRequestTitle = os.Getenv(gitPullRequestTitleEnvKey)
-	params.gitPullRequestBody = os.Getenv(gitPullRequestBodyEnvKey)
+	params.gitBackend = getenv(gitBackendEnvKey)
+	switch params.gitBackend {
+	case "":
+		params.gitBackend = gitBackendCLI
+	case gitBackendCLI, gitBackendNative:
+	default:
+		return nil, fmt.Errorf("parameter %q must be one of %q or %q, got %q", gitBackendEnvKey, gitBackendCLI, gitBackendNative, params.gitBackend)
+	}
+
+	if cd := getenv(gitCloneDepthEnvKey); len(cd) != 0 {
+		depth, err := strconv.Atoi(cd)
+		if err != nil || depth < 0 {
+			return nil, fmt.Errorf("parameter %q must be a non-negative integer, got %q", gitCloneDepthEnvKey, cd)
+		}
+		params.gitCloneDepth = depth
+	}
+
+	if sb, ok := lookup(gitCloneSingleBranchEnvKey); ok {
+		var err error
+		params.gitCloneSingleBranch, err = strconv.ParseBool(sb)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", gitCloneSingleBranchEnvKey, err)
+		}
+	}
+
+	if sc, ok := lookup(gitSparseCheckoutEnvKey); ok {
+		var err error
+		params.gitSparseCheckout, err = strconv.ParseBool(sc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", gitSparseCheckoutEnvKey, err)
+		}
+	}
+	if params.gitSparseCheckout && params.gitBackend == gitBackendNative {
+		return nil, fmt.Errorf("parameter %q is not supported by the %s git backend", gitSparseCheckoutEnvKey, gitBackendNative)
+	}
+
+	if en, ok := lookup(gitEnableNotesEnvKey); ok {
+		var err error
+		params.gitEnableNotes, err = strconv.ParseBool(en)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", gitEnableNotesEnvKey, err)
+		}
+	}
+	if params.gitEnableNotes && params.gitBackend == gitBackendNative {
+		return nil, fmt.Errorf("parameter %q is not supported by the %s git backend", gitEnableNotesEnvKey, gitBackendNative)
+	}
+
+	params.gitPushRetries = defaultPushRetries
+	if pr := getenv(gitPushRetriesEnvKey); len(pr) != 0 {
+		retries, err := strconv.Atoi(pr)
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("parameter %q must be a non-negative integer, got %q", gitPushRetriesEnvKey, pr)
+		}
+		params.gitPushRetries = retries
+	}
+
+	params.gitLockGCSPath = getenv(gitLockGCSPathEnvKey)
+	if len(params.gitLockGCSPath) != 0 && !strings.HasPrefix(params.gitLockGCSPath, "gs://") {
+		return nil, fmt.Errorf("parameter %q must be a Cloud Storage path of the form \"gs://{bucket}/{dir}\", got %q", gitLockGCSPathEnvKey, params.gitLockGCSPath)
+	}
+	params.gitLockDir = getenv(gitLockDirEnvKey)
+	if len(params.gitLockDir) != 0 && len(params.gitLockGCSPath) != 0 {
+		return nil, fmt.Errorf("parameters %q and %q cannot both be provided", gitLockDirEnvKey, gitLockGCSPathEnvKey)
+	}
+	params.gitLockTTL = defaultLockTTL
+	if ttl := getenv(gitLockTTLEnvKey); len(ttl) != 0 {
+		var err error
+		params.gitLockTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", gitLockTTLEnvKey, err)
+		}
+		if params.gitLockTTL < minLockTTL {
+			return nil, fmt.Errorf("parameter %q must be at least %s, got %q", gitLockTTLEnvKey, minLockTTL, ttl)
+		}
+	}
+	params.gitRateLimitMaxWait = defaultRateLimitMaxWait
+	if rw := getenv(gitRateLimitMaxWaitEnvKey); len(rw) != 0 {
+		var err error
+		params.gitRateLimitMaxWait, err = time.ParseDuration(rw)
+		if err != nil || params.gitRateLimitMaxWait < 0 {
+			return nil, fmt.Errorf("parameter %q must be a non-negative duration, got %q", gitRateLimitMaxWaitEnvKey, rw)
+		}
+	}
+	params.gitLockWaitTimeout = defaultLockWaitTimeout
+	if wt := getenv(gitLockWaitTimeoutEnvKey); len(wt) != 0 {
+		var err error
+		params.gitLockWaitTimeout, err = time.ParseDuration(wt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", gitLockWaitTimeoutEnvKey, err)
+		}
+	}
+
+	params.gitSigningKeySecret = getenv(gitSigningKeySecretEnvKey)
+	params.gitEmail = getenv(gitEmailEnvKey)
+	params.gitCommitMessage = getenv(gitCommitMessageEnvKey)
+	params.gitPullRequestTitle = getenv(gitPullRequestTitleEnvKey)
+	params.gitPullRequestBody = getenv(gitPullRequestBodyEnvKey)
 
 	enablePRMerge := false
-	prm, ok := os.LookupEnv(gitEnablePullRequestMergeEnvKey)
+	prm, ok := lookup(gitEnablePullRequestMergeEnvKey)
 	if ok {
 		var err error
 		enablePRMerge, err = strconv.ParseBool(prm)
@@ -237,17 +541,78 @@ func determineParams() (*params, error) {
 	}
 	params.enablePullRequestMerge = enablePRMerge
 
+	enableDeployments := false
+	ed, ok := lookup(gitEnableDeploymentsEnvKey)
+	if ok {
+		var err error
+		enableDeployments, err = strconv.ParseBool(ed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", gitEnableDeploymentsEnvKey, err)
+		}
+	}
+	// A deployment is created for the merge commit, so the pull request must be merged.
+	if enableDeployments && !enablePRMerge {
+		return nil, fmt.Errorf("parameter %q requires parameter %q to be true", gitEnableDeploymentsEnvKey, gitEnablePullRequestMergeEnvKey)
+	}
+	params.enableDeployments = enableDeployments
+
+	params.gitDeploymentEnvironment = getenv(gitDeploymentEnvironmentEnvKey)
+	if len(params.gitDeploymentEnvironment) == 0 {
+		params.gitDeploymentEnvironment = params.hydrationClusterGroup
+	}
+
+	if et, ok := lookup(gitEnableTagEnvKey); ok {
+		var err error
+		params.enableTag, err = strconv.ParseBool(et)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", gitEnableTagEnvKey, err)
+		}
+	}
+	// The tag is created on the merge commit, so the pull request must be merged.
+	if params.enableTag && !enablePRMerge {
+		return nil, fmt.Errorf("parameter %q requires parameter %q to be true", gitEnableTagEnvKey, gitEnablePullRequestMergeEnvKey)
+	}
+	params.gitTagName = getenv(gitTagNameEnvKey)
+	if len(params.gitTagName) == 0 {
+		params.gitTagName = defaultTagName
+	}
+
 	params.matchClustersHavingAnyListedTag = []string{}
-	anyListedTagValue := os.Getenv(matchClustersHavingAnyListedTagEnvKey)
+	anyListedTagValue := getenv(matchClustersHavingAnyListedTagEnvKey)
 	if len(anyListedTagValue) > 0 && anyListedTagValue != "" {
 		params.matchClustersHavingAnyListedTag = strings.Split(anyListedTagValue, ",")
 	}
 
 	params.matchClustersHavingAllListedTags = []string{}
-	allListedTagValue := os.Getenv(matchClustersHavingAllListedTagsEnvKey)
+	allListedTagValue := getenv(matchClustersHavingAllListedTagsEnvKey)
 	if len(matchClustersHavingAllListedTagsEnvKey) > 0 && allListedTagValue != "" {
 		params.matchClustersHavingAllListedTags = strings.Split(allListedTagValue, ",")
 	}
 
+	if len(params.matchClustersHavingAnyListedTag) != 0 && len(params.matchClustersHavingAllListedTags) != 0 {
+		return nil, fmt.Errorf("parameter %q cannot be combined with %q, use %q to combine tag conditions", matchClustersHavingAnyListedTagEnvKey, matchClustersHavingAllListedTagsEnvKey, matchClustersExpressionEnvKey)
+	}
+
+	if expr := getenv(matchClustersExpressionEnvKey); len(expr) != 0 {
+		if len(params.matchClustersHavingAnyListedTag) != 0 || len(params.matchClustersHavingAllListedTags) != 0 {
+			return nil, fmt.Errorf("parameter %q cannot be combined with %q or %q", matchClustersExpressionEnvKey, matchClustersHavingAnyListedTagEnvKey, matchClustersHavingAllListedTagsEnvKey)
+		}
+		if params.matchClustersExpression, err = parseSelector(expr); err != nil {
+			return nil, fmt.Errorf("parameter %q is not a valid expression: %v", matchClustersExpressionEnvKey, err)
+		}
+	}
+
+	if params.matchClusterNames, err = parseClusterNamePatterns(getenv(matchClusterNamesEnvKey)); err != nil {
+		return nil, fmt.Errorf("parameter %q is not valid: %v", matchClusterNamesEnvKey, err)
+	}
+	if params.excludeClusterNames, err = parseClusterNamePatterns(getenv(excludeClusterNamesEnvKey)); err != nil {
+		return nil, fmt.Errorf("parameter %q is not valid: %v", excludeClusterNamesEnvKey, err)
+	}
+	for _, tag := range strings.Split(getenv(excludeClustersHavingTagsEnvKey), ",") {
+		if tag = strings.TrimSpace(tag); len(tag) != 0 {
+			params.excludeClustersHavingTags = append(params.excludeClustersHavingTags, tag)
+		}
+	}
+
 	return params, nil
 }
@@ -0,0 +1,129 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testParamsLookup returns a lookup of the required parameters, overridden by the provided parameters. An
+// empty override unsets the parameter.
+func testParamsLookup(overrides map[string]string) func(string) (string, bool) {
+	env := map[string]string{
+		gitSourceRepoEnvKey:             "github.com/owner/platform",
+		gitSourceBranchEnvKey:           "main",
+		gitOutputRepoEnvKey:             "github.com/owner/hydrated",
+		gitOutputBranchEnvKey:           "main",
+		gitSecretEnvKey:                 "env:TOKEN",
+		gitLockGCSPathEnvKey:            "gs://bucket/locks",
+		hydrationClusterGroupEnvKey:     "prod",
+		hydrationBatchSizeEnvKey:        "1",
+		hydrationPlatformRevisionEnvKey: "v2",
+	}
+	for k, v := range overrides {
+		env[k] = v
+	}
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok && len(v) != 0
+	}
+}
+
+func TestRateLimitMaxWaitParam(t *testing.T) {
+	p, err := determineParamsFrom(testParamsLookup(nil))
+	if err != nil {
+		t.Fatalf("Failed to determine params: %v", err)
+	}
+	if p.gitRateLimitMaxWait != defaultRateLimitMaxWait {
+		t.Errorf("Expected default rate limit wait %v, got: %v", defaultRateLimitMaxWait, p.gitRateLimitMaxWait)
+	}
+
+	p, err = determineParamsFrom(testParamsLookup(map[string]string{gitRateLimitMaxWaitEnvKey: "2m"}))
+	if err != nil {
+		t.Fatalf("Failed to determine params: %v", err)
+	}
+	if p.gitRateLimitMaxWait != 2*time.Minute {
+		t.Errorf("Expected rate limit wait 2m, got: %v", p.gitRateLimitMaxWait)
+	}
+
+	// The budget is independent of the lock TTL, since the lock is not refreshed through the provider API.
+	p, err = determineParamsFrom(testParamsLookup(map[string]string{gitRateLimitMaxWaitEnvKey: "30m", gitLockTTLEnvKey: "5m"}))
+	if err != nil {
+		t.Fatalf("Failed to determine params: %v", err)
+	}
+	if p.gitRateLimitMaxWait != 30*time.Minute {
+		t.Errorf("Expected rate limit wait 30m, got: %v", p.gitRateLimitMaxWait)
+	}
+
+	for _, overrides := range []map[string]string{
+		{gitRateLimitMaxWaitEnvKey: "-1m"},
+		{gitRateLimitMaxWaitEnvKey: "soon"},
+	} {
+		if _, err := determineParamsFrom(testParamsLookup(overrides)); err == nil || !strings.Contains(err.Error(), gitRateLimitMaxWaitEnvKey) {
+			t.Errorf("Expected rate limit wait error for %v, got: %v", overrides, err)
+		}
+	}
+}
+
+func TestLockTTLParam(t *testing.T) {
+	// The lock is refreshed in the background, so waiting between batches for longer than the TTL is fine.
+	p, err := determineParamsFrom(testParamsLookup(map[string]string{gitLockTTLEnvKey: "15m", hydrationWaitTimeBetweenBatchesEnvKey: "30m"}))
+	if err != nil {
+		t.Fatalf("Failed to determine params: %v", err)
+	}
+	if p.gitLockTTL != 15*time.Minute {
+		t.Errorf("Expected lock TTL 15m, got: %v", p.gitLockTTL)
+	}
+
+	for _, ttl := range []string{"0s", "-5m", "30s", "soon"} {
+		if _, err := determineParamsFrom(testParamsLookup(map[string]string{gitLockTTLEnvKey: ttl})); err == nil || !strings.Contains(err.Error(), gitLockTTLEnvKey) {
+			t.Errorf("Expected lock TTL error for %s, got: %v", ttl, err)
+		}
+	}
+}
+
+func TestLockDirParam(t *testing.T) {
+	p, err := determineParamsFrom(testParamsLookup(map[string]string{gitLockGCSPathEnvKey: "", gitLockDirEnvKey: "/var/lock/git-deployer"}))
+	if err != nil {
+		t.Fatalf("Failed to determine params: %v", err)
+	}
+	if p.gitLockDir != "/var/lock/git-deployer" {
+		t.Errorf("Expected lock dir /var/lock/git-deployer, got: %s", p.gitLockDir)
+	}
+
+	if _, err := determineParamsFrom(testParamsLookup(map[string]string{gitLockDirEnvKey: "/var/lock/git-deployer"})); err == nil || !strings.Contains(err.Error(), "cannot both be provided") {
+		t.Errorf("Expected an error when both lock locations are provided, got: %v", err)
+	}
+}
+
+func TestListedTagsParams(t *testing.T) {
+	p, err := determineParamsFrom(testParamsLookup(map[string]string{matchClustersHavingAllListedTagsEnvKey: "us,canary"}))
+	if err != nil {
+		t.Fatalf("Failed to determine params: %v", err)
+	}
+	if got := strings.Join(p.matchClustersHavingAllListedTags, ","); got != "us,canary" {
+		t.Errorf("Expected all listed tags us,canary, got: %s", got)
+	}
+
+	_, err = determineParamsFrom(testParamsLookup(map[string]string{
+		matchClustersHavingAnyListedTagEnvKey:  "us",
+		matchClustersHavingAllListedTagsEnvKey: "canary",
+	}))
+	if err == nil || !strings.Contains(err.Error(), "cannot be combined") {
+		t.Errorf("Expected combination error, got: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// rolloutPlan describes the batches a deploy would roll out, without changing any repository.
+type rolloutPlan struct {
+	// All clusters that would be updated, in rollout order.
+	clusters []string
+	// Clusters excluded by the cluster name and tag filters.
+	excluded []clusterExclusion
+	batches  []planBatch
+}
+
+// planBatch is a batch of a rolloutPlan.
+type planBatch struct {
+	// Feature branch the batch would be pushed to.
+	branch   string
+	clusters []string
+	// Wave of the batch, empty if the clusters are not grouped into waves.
+	wave string
+}
+
+// previewWorkspace is a read-only clone of the source repository for previewing a deploy.
+type previewWorkspace struct {
+	repo gitRepository
+	sot  sourceOfTruth
+	// Temporary directory containing the clone.
+	dir     string
+	cleanup func()
+}
+
+// openPreviewWorkspace clones the source repository into a new temporary directory. Nothing is ever
+// committed or pushed from the preview workspace.
+func (d *deployer) openPreviewWorkspace(ctx context.Context) (*previewWorkspace, error) {
+	fmt.Printf("Accessing SecretVersion %s\n", d.params.gitSecret)
+	s, err := d.secrets.AccessSecretVersion(ctx, d.params.gitSecret)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access git secret: %v", err)
+	}
+	gitSourceRepo, err := d.newRepository(d.params.gitSourceRepo, nil)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "git-deployer-preview-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create workspace: %v", err)
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			fmt.Printf("Failed to remove workspace %s: %v\n", dir, err)
+		}
+	}
+	srcPaths := []string{d.params.hydrationSourceOfTruth, d.params.hydrationBaseDir, d.params.hydrationOverlaysDir}
+	if err := d.setupGitWorkspace(ctx, string(s), gitSourceRepo, filepath.Join(dir, "source"), d.params.gitSourceBranch, srcPaths); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("unable to set up git workspace: %v", err)
+	}
+	sot, err := openSourceOfTruth(gitSourceRepo.info().dir, d.params.hydrationSourceOfTruth, d.params.hydrationSourceOfTruthFormat)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	return &previewWorkspace{repo: gitSourceRepo, sot: sot, dir: dir, cleanup: cleanup}, nil
+}
+
+// clusters returns the clusters the deploy would update and the clusters excluded by the filters, determined
+// from the source of truth after validating it.
+func (w *previewWorkspace) clusters(p *params) ([]string, []clusterExclusion, error) {
+	if err := validateSourceOfTruth(w.sot, p.hydrationSourceOfTruth); err != nil {
+		return nil, nil, err
+	}
+	clusters, excluded, err := w.sot.selectClusters(p.hydrationClusterGroup, p.matchClustersHavingAnyListedTag, p.matchClustersHavingAllListedTags, p.matchClustersExpression, p.clusterFilter())
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to determine clusters to be updated: %v", err)
+	}
+	return clusters, excluded, nil
+}
+
+// plan determines the clusters and batches the deploy would roll out.
+func (d *deployer) plan(ctx context.Context) (*rolloutPlan, error) {
+	w, err := d.openPreviewWorkspace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer w.cleanup()
+
+	clusters, excluded, err := w.clusters(d.params)
+	if err != nil {
+		return nil, err
+	}
+	waves, err := d.planWaves(w.sot, clusters)
+	if err != nil {
+		return nil, fmt.Errorf("unable to group clusters into waves: %v", err)
+	}
+	// Maintenance windows are only validated, since whether they are open depends on when the deploy runs.
+	if _, err := d.maintenanceWindows(w.sot); err != nil {
+		return nil, fmt.Errorf("unable to determine maintenance windows: %v", err)
+	}
+	plan := &rolloutPlan{clusters: []string{}, excluded: excluded}
+	for _, b := range waveBatches(waves) {
+		plan.clusters = append(plan.clusters, b.clusters...)
+		plan.batches = append(plan.batches, planBatch{branch: d.batchBranch(b.number, b.total), clusters: b.clusters, wave: b.wave})
+	}
+	return plan, nil
+}
+
+// renderPreview hydrates the manifests the deploy would produce into outputDir, which must be empty or not
+// exist, and returns the clusters that would be updated. The source of truth is updated with the deploy
+// revisions for all of these clusters at once, as if every batch had completed, and only these clusters are
+// hydrated.
+func (d *deployer) renderPreview(ctx context.Context, outputDir string) ([]string, error) {
+	entries, err := os.ReadDir(outputDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(entries) != 0 {
+		return nil, fmt.Errorf("output directory %s must be empty", outputDir)
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, err
+	}
+
+	w, err := d.openPreviewWorkspace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer w.cleanup()
+
+	clusters, _, err := w.clusters(d.params)
+	if err != nil || len(clusters) == 0 {
+		return nil, err
+	}
+	if err := w.sot.updateRevisions(clusters, d.params.hydrationPlatformRevision, d.params.hydrationWorkloadRevision); err != nil {
+		return nil, fmt.Errorf("unable to update platform revision: %v", err)
+	}
+	table, _, err := w.sot.load()
+	if err != nil {
+		return nil, err
+	}
+	table.clusters = slices.DeleteFunc(table.clusters, func(c *sotCluster) bool {
+		return !slices.Contains(clusters, c.name())
+	})
+	sotPath := filepath.Join(w.dir, defaultSourceOfTruth)
+	if err := writeHydrationCSV(table, sotPath); err != nil {
+		return nil, fmt.Errorf("unable to write source of truth for hydration: %v", err)
+	}
+	if err := runHydrationCLI(w.repo.info().dir, d.params.hydrationBaseDir, d.params.hydrationOverlaysDir, outputDir, "", sotPath); err != nil {
+		return nil, fmt.Errorf("unable to hydrate: %v", err)
+	}
+	return clusters, nil
+}
+
+// concatenateManifests returns the YAML files in dir as a single multi-document YAML, in lexical order of
+// their paths. Each document is preceded by a comment with the path of its file relative to dir.
+func concatenateManifests(dir string) ([]byte, error) {
+	var b bytes.Buffer
+	err := filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() || (filepath.Ext(path) != ".yaml" && filepath.Ext(path) != ".yml") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "---\n# Source: %s\n", filepath.ToSlash(rel))
+		b.Write(bytes.TrimPrefix(data, []byte("---\n")))
+		if len(data) != 0 && data[len(data)-1] != '\n' {
+			b.WriteByte('\n')
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestConcatenateManifests(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "cluster2.yaml", "kind: ConfigMap\n")
+	writeTestFile(t, dir, "cluster1/namespace.yml", "---\nkind: Namespace")
+	writeTestFile(t, dir, "cluster1/README.md", "not a manifest\n")
+
+	got, err := concatenateManifests(dir)
+	if err != nil {
+		t.Fatalf("Failed to concatenate manifests: %v", err)
+	}
+	want := "---\n# Source: cluster1/namespace.yml\nkind: Namespace\n" +
+		"---\n# Source: cluster2.yaml\nkind: ConfigMap\n"
+	if string(got) != want {
+		t.Errorf("Concatenated manifests mismatch\nExpected: %s\n     Got: %s", want, got)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultRequestTimeout is the timeout of a single API request when no HTTP client is provided.
+	defaultRequestTimeout = 30 * time.Second
+
+	// defaultRateLimitWait is the wait when a rate limit is reported without any hint on when it resets.
+	// GitHub recommends waiting at least one minute for secondary rate limits.
+	defaultRateLimitWait = time.Minute
+)
+
+// APIError is returned when a Git provider API responds with an unexpected status code.
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s body: %q, status got: %v", e.Method, e.URL, e.Body, e.StatusCode)
+}
+
+// retryPolicy configures the exponential backoff used when retrying API requests.
+type retryPolicy struct {
+	// Backoff before the first retry, doubled on every subsequent retry.
+	initialBackoff time.Duration
+	// Upper bound of a single backoff.
+	maxBackoff time.Duration
+	// Total time after which no more retries are attempted, not counting rate limit pauses.
+	maxElapsed time.Duration
+	// Total time a request may be paused because of rate limits.
+	maxRateLimitWait time.Duration
+}
+
+// defaultRetryPolicy is used by providers that don't configure a retry policy.
+var defaultRetryPolicy = retryPolicy{
+	initialBackoff:   2 * time.Second,
+	maxBackoff:       30 * time.Second,
+	maxElapsed:       2 * time.Minute,
+	maxRateLimitWait: 5 * time.Minute,
+}
+
+// withMaxRateLimitWait returns the policy with the rate limit budget, or the policy itself if the budget is
+// not positive.
+func (p retryPolicy) withMaxRateLimitWait(maxRateLimitWait time.Duration) retryPolicy {
+	if maxRateLimitWait > 0 {
+		p.maxRateLimitWait = maxRateLimitWait
+	}
+	return p
+}
+
+// backoff returns the time to wait before the provided retry attempt, starting at 0. Full jitter is
+// applied so concurrent deployers don't retry in lockstep.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	b := p.maxBackoff
+	if attempt < 32 {
+		b = min(p.initialBackoff<<attempt, p.maxBackoff)
+	}
+	if b <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(b))) + 1
+}
+
+// apiClient makes JSON requests against a Git provider API.
+type apiClient struct {
+	httpClient *http.Client
+	retry      retryPolicy
+	header     http.Header
+}
+
+// newAPIClient returns an apiClient that sends the provided headers with every request. A default HTTP
+// client and retry policy are used when not provided.
+func newAPIClient(httpClient *http.Client, retry retryPolicy, header http.Header) *apiClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultRequestTimeout}
+	}
+	if retry.initialBackoff == 0 && retry.maxBackoff == 0 && retry.maxElapsed == 0 {
+		retry = defaultRetryPolicy.withMaxRateLimitWait(retry.maxRateLimitWait)
+	}
+	return &apiClient{
+		httpClient: httpClient,
+		retry:      retry,
+		header:     header,
+	}
+}
+
+// call makes the API request and unmarshals the response into out, if provided. The request is retried
+// with exponential backoff for as long as the failure is classified as retryable. When the provider reports
+// a rate limit the request is paused until the limit resets instead.
+func (c *apiClient) call(ctx context.Context, method, reqURL string, payload any, wantStatus int, out any) error {
+	start := time.Now()
+	var paused time.Duration
+	for attempt := 0; ; attempt++ {
+		err := c.do(ctx, method, reqURL, payload, wantStatus, out)
+		if err == nil || !isRetryable(method, err) || ctx.Err() != nil {
+			return err
+		}
+		if wait, ok := rateLimitWait(err, time.Now()); ok {
+			if paused+wait > c.retry.maxRateLimitWait {
+				return fmt.Errorf("rate limit resets in %v which exceeds the remaining wait budget of %v: %w", wait, c.retry.maxRateLimitWait-paused, err)
+			}
+			paused += wait
+			fmt.Printf("Rate limit reached for %s %s, pausing for %v until %s\n", method, reqURL, wait.Round(time.Second), time.Now().Add(wait).Format(time.RFC3339))
+			if err := sleep(ctx, wait); err != nil {
+				return err
+			}
+			continue
+		}
+		wait := c.retry.backoff(attempt)
+		if time.Since(start)-paused+wait > c.retry.maxElapsed {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+		}
+		fmt.Printf("Retrying %s %s in %v: %v\n", method, reqURL, wait.Round(time.Millisecond), err)
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// do makes a single API request.
+func (c *apiClient) do(ctx context.Context, method, reqURL string, payload any, wantStatus int, out any) error {
+	var body io.Reader
+	if payload != nil {
+		p, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("unable to marshal json for request: %v", err)
+		}
+		body = bytes.NewReader(p)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return fmt.Errorf("unable to create new request: %v", err)
+	}
+	for k, vs := range c.header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	r, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response body: %w", err)
+	}
+	if resp.StatusCode != wantStatus {
+		return &APIError{
+			Method:     method,
+			URL:        reqURL,
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       r,
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(r, out); err != nil {
+		return fmt.Errorf("unable to unmarshal response: %v", err)
+	}
+	return nil
+}
+
+// isRetryable reports whether a failed request may succeed when retried. Transport errors, server errors,
+// conflicts, pull requests that are not mergeable yet and rate limits are retried. Anything else, such as
+// authentication errors or missing resources, fails fast. Requests that are not idempotent, such as opening a
+// pull request or creating a deployment, are only retried if they were not processed, i.e. the connection
+// could not be established or a rate limit rejected them, since retrying a request that timed out after the
+// provider processed it would create a duplicate.
+func isRetryable(method string, err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		if isRateLimited(apiErr) {
+			return true
+		}
+		if !isIdempotent(method) {
+			return false
+		}
+		switch {
+		case apiErr.StatusCode >= http.StatusInternalServerError:
+			return true
+		case apiErr.StatusCode == http.StatusMethodNotAllowed,
+			apiErr.StatusCode == http.StatusConflict:
+			return true
+		}
+		return false
+	}
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return false
+	}
+	if isIdempotent(method) {
+		return true
+	}
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return (errors.As(err, &opErr) && opErr.Op == "dial") || errors.As(err, &dnsErr)
+}
+
+// isIdempotent reports whether repeating a request with the method has the same effect as making it once.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isRateLimited reports whether the API rejected the request because of a primary or secondary rate limit.
+func isRateLimited(apiErr *APIError) bool {
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		return apiErr.Header.Get("Retry-After") != "" ||
+			apiErr.Header.Get("X-RateLimit-Remaining") == "0" ||
+			apiErr.Header.Get("RateLimit-Remaining") == "0" ||
+			strings.Contains(strings.ToLower(string(apiErr.Body)), "rate limit")
+	}
+	return false
+}
+
+// rateLimitWait returns how long to wait before retrying a request that was rejected by a rate limit. The
+// wait is derived from the "Retry-After" header, the GitHub "X-RateLimit-Reset" header or the GitLab
+// "RateLimit-Reset" header, in that order. Returns false if the error is not caused by a rate limit.
+func rateLimitWait(err error, now time.Time) (time.Duration, bool) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !isRateLimited(apiErr) {
+		return 0, false
+	}
+	h := apiErr.Header
+	if ra := h.Get("Retry-After"); ra != "" {
+		if secs, err := strconv.Atoi(ra); err == nil {
+			return max(time.Duration(secs)*time.Second, 0), true
+		}
+		if t, err := http.ParseTime(ra); err == nil {
+			return max(t.Sub(now), 0), true
+		}
+	}
+	for _, prefix := range []string{"X-RateLimit-", "RateLimit-"} {
+		if h.Get(prefix+"Remaining") != "0" {
+			continue
+		}
+		if reset, err := strconv.ParseInt(h.Get(prefix+"Reset"), 10, 64); err == nil {
+			// Add a second since the reset time is truncated to whole seconds.
+			return max(time.Unix(reset, 0).Sub(now)+time.Second, 0), true
+		}
+	}
+	return defaultRateLimitWait, true
+}
+
+// sleep waits for the provided duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
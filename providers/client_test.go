@@ -0,0 +1,382 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRetryPolicy keeps the backoff short so tests run quickly.
+var testRetryPolicy = retryPolicy{
+	initialBackoff:   time.Millisecond,
+	maxBackoff:       5 * time.Millisecond,
+	maxElapsed:       time.Second,
+	maxRateLimitWait: time.Second,
+}
+
+// redirectClient returns an HTTP client that sends every request to the test server regardless of the
+// host in the request URL.
+func redirectClient(server *httptest.Server) *http.Client {
+	target, _ := url.Parse(server.URL)
+	return &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			return http.DefaultTransport.RoundTrip(req)
+		}),
+	}
+}
+
+// recordedRequest is a request received by a recordingServer.
+type recordedRequest struct {
+	method  string
+	path    string
+	payload map[string]any
+}
+
+// recordingServer returns a test server that records the requests it receives and responds to each with the
+// next of the provided status codes and bodies.
+func recordingServer(t *testing.T, responses ...recordedResponse) (*httptest.Server, *[]recordedRequest) {
+	t.Helper()
+	var requests []recordedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := recordedRequest{method: r.Method, path: r.URL.EscapedPath()}
+		if err := json.NewDecoder(r.Body).Decode(&req.payload); err != nil && err != io.EOF {
+			t.Errorf("Failed to decode request payload: %v", err)
+		}
+		if len(requests) >= len(responses) {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp := responses[len(requests)]
+		requests = append(requests, req)
+		w.WriteHeader(resp.status)
+		fmt.Fprint(w, resp.body)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// recordedResponse is a response of a recordingServer.
+type recordedResponse struct {
+	status int
+	body   string
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestIsRetryable(t *testing.T) {
+	dialErr := &url.Error{Op: "Post", URL: "https://api.github.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	dnsErr := &url.Error{Op: "Post", URL: "https://api.github.com", Err: &net.DNSError{Err: "no such host", Name: "api.github.com"}}
+	resetErr := &url.Error{Op: "Post", URL: "https://api.github.com", Err: errors.New("connection reset")}
+	testCases := []struct {
+		name     string
+		method   string
+		err      error
+		expected bool
+	}{
+		{"Server error", http.MethodPut, &APIError{StatusCode: http.StatusBadGateway}, true},
+		{"Not mergeable yet", http.MethodPut, &APIError{StatusCode: http.StatusMethodNotAllowed}, true},
+		{"Conflict", http.MethodPut, &APIError{StatusCode: http.StatusConflict}, true},
+		{"Too many requests", http.MethodPut, &APIError{StatusCode: http.StatusTooManyRequests}, true},
+		{"Rate limited forbidden", http.MethodGet, &APIError{StatusCode: http.StatusForbidden, Header: http.Header{"X-Ratelimit-Remaining": {"0"}}}, true},
+		{"Secondary rate limit", http.MethodGet, &APIError{StatusCode: http.StatusForbidden, Header: http.Header{"Retry-After": {"60"}}}, true},
+		{"Forbidden", http.MethodGet, &APIError{StatusCode: http.StatusForbidden}, false},
+		{"Unauthorized", http.MethodGet, &APIError{StatusCode: http.StatusUnauthorized}, false},
+		{"Not found", http.MethodGet, &APIError{StatusCode: http.StatusNotFound}, false},
+		{"Unprocessable", http.MethodPatch, &APIError{StatusCode: http.StatusUnprocessableEntity}, false},
+		{"Wrapped server error", http.MethodPut, fmt.Errorf("wrapped: %w", &APIError{StatusCode: http.StatusServiceUnavailable}), true},
+		{"Transport error", http.MethodPut, resetErr, true},
+		{"Other error", http.MethodPut, errors.New("unable to marshal json"), false},
+		// A POST that may have been processed is not retried, since it would create a duplicate.
+		{"POST server error", http.MethodPost, &APIError{StatusCode: http.StatusBadGateway}, false},
+		{"POST conflict", http.MethodPost, &APIError{StatusCode: http.StatusConflict}, false},
+		{"POST transport error", http.MethodPost, resetErr, false},
+		{"POST rate limited", http.MethodPost, &APIError{StatusCode: http.StatusTooManyRequests}, true},
+		{"POST dial error", http.MethodPost, dialErr, true},
+		{"POST DNS error", http.MethodPost, dnsErr, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isRetryable(tc.method, tc.err); got != tc.expected {
+				t.Errorf("isRetryable(%s, %v) = %v, want %v", tc.method, tc.err, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestOpenPullRequestNotRetried(t *testing.T) {
+	server, requests := recordingServer(t,
+		recordedResponse{http.StatusBadGateway, `{}`},
+		recordedResponse{http.StatusCreated, `{"number": 3}`},
+	)
+	p := &GitHubProvider{Repository: "repo", Owner: "owner", HTTPClient: redirectClient(server), retry: testRetryPolicy}
+	if _, err := p.OpenPullRequest(context.Background(), "feature", "main", "title", "body"); err == nil {
+		t.Error("Expected an error, but got none")
+	}
+	if len(*requests) != 1 {
+		t.Errorf("Expected the pull request to be opened once, got %d requests", len(*requests))
+	}
+}
+
+func TestMergePullRequestRetries(t *testing.T) {
+	testCases := []struct {
+		name          string
+		statuses      []int
+		expectedCalls int
+		expectError   bool
+	}{
+		{
+			name:          "Succeeds immediately",
+			statuses:      []int{http.StatusOK},
+			expectedCalls: 1,
+		},
+		{
+			name:          "Retries until mergeable",
+			statuses:      []int{http.StatusMethodNotAllowed, http.StatusInternalServerError, http.StatusOK},
+			expectedCalls: 3,
+		},
+		{
+			name:          "Fails fast on unauthorized",
+			statuses:      []int{http.StatusUnauthorized, http.StatusOK},
+			expectedCalls: 1,
+			expectError:   true,
+		},
+		{
+			name:          "Fails fast on not found",
+			statuses:      []int{http.StatusConflict, http.StatusNotFound, http.StatusOK},
+			expectedCalls: 2,
+			expectError:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got, want := r.URL.Path, "/repos/owner/repo/pulls/7/merge"; got != want {
+					t.Errorf("Request path mismatch\nExpected: %s\n     Got: %s", want, got)
+				}
+				status := tc.statuses[min(calls, len(tc.statuses)-1)]
+				calls++
+				w.WriteHeader(status)
+				fmt.Fprint(w, `{"sha": "abc123"}`)
+			}))
+			defer server.Close()
+
+			p := &GitHubProvider{
+				Repository: "repo",
+				Owner:      "owner",
+				Token:      "token",
+				HTTPClient: redirectClient(server),
+				retry:      testRetryPolicy,
+			}
+			mr, err := p.MergePullRequest(context.Background(), 7)
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("Expected an error, but got none")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if mr.Sha != "abc123" {
+					t.Errorf("Merge SHA mismatch\nExpected: abc123\n     Got: %s", mr.Sha)
+				}
+			}
+			if calls != tc.expectedCalls {
+				t.Errorf("Call count mismatch\nExpected: %d\n     Got: %d", tc.expectedCalls, calls)
+			}
+		})
+	}
+}
+
+func TestCallRespectsContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := &GitLabProvider{
+		Repository: "repo",
+		Owner:      "owner",
+		HTTPClient: redirectClient(server),
+		retry:      testRetryPolicy,
+	}
+	if _, err := p.OpenPullRequest(ctx, "feature", "main", "title", "body"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context canceled error, got: %v", err)
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	testCases := []struct {
+		name          string
+		err           error
+		expectedWait  time.Duration
+		expectLimited bool
+	}{
+		{
+			name:          "Retry-After seconds",
+			err:           &APIError{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"30"}}},
+			expectedWait:  30 * time.Second,
+			expectLimited: true,
+		},
+		{
+			name:          "Retry-After date",
+			err:           &APIError{StatusCode: http.StatusForbidden, Header: http.Header{"Retry-After": {now.Add(90 * time.Second).UTC().Format(http.TimeFormat)}}},
+			expectedWait:  90 * time.Second,
+			expectLimited: true,
+		},
+		{
+			name:          "GitHub reset",
+			err:           &APIError{StatusCode: http.StatusForbidden, Header: http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"1700000120"}}},
+			expectedWait:  121 * time.Second,
+			expectLimited: true,
+		},
+		{
+			name:          "GitLab reset",
+			err:           &APIError{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {"1700000010"}}},
+			expectedWait:  11 * time.Second,
+			expectLimited: true,
+		},
+		{
+			name:          "Reset in the past",
+			err:           &APIError{StatusCode: http.StatusForbidden, Header: http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"1600000000"}}},
+			expectedWait:  0,
+			expectLimited: true,
+		},
+		{
+			name:          "Secondary rate limit without headers",
+			err:           &APIError{StatusCode: http.StatusForbidden, Body: []byte(`{"message": "You have exceeded a secondary rate limit"}`)},
+			expectedWait:  defaultRateLimitWait,
+			expectLimited: true,
+		},
+		{
+			name:          "Remaining quota",
+			err:           &APIError{StatusCode: http.StatusForbidden, Header: http.Header{"X-Ratelimit-Remaining": {"10"}, "X-Ratelimit-Reset": {"1700000120"}}},
+			expectLimited: false,
+		},
+		{
+			name:          "Server error",
+			err:           &APIError{StatusCode: http.StatusBadGateway, Header: http.Header{"Retry-After": {"30"}}},
+			expectLimited: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			wait, ok := rateLimitWait(tc.err, now)
+			if ok != tc.expectLimited {
+				t.Fatalf("Rate limited mismatch\nExpected: %v\n     Got: %v", tc.expectLimited, ok)
+			}
+			if wait != tc.expectedWait {
+				t.Errorf("Wait mismatch\nExpected: %v\n     Got: %v", tc.expectedWait, wait)
+			}
+		})
+	}
+}
+
+func TestCallPausesForRateLimit(t *testing.T) {
+	testCases := []struct {
+		name          string
+		retryAfter    string
+		expectedCalls int
+		expectError   bool
+	}{
+		{
+			name:          "Waits and retries",
+			retryAfter:    "0",
+			expectedCalls: 2,
+		},
+		{
+			name:          "Wait exceeds budget",
+			retryAfter:    "3600",
+			expectedCalls: 1,
+			expectError:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					w.Header().Set("Retry-After", tc.retryAfter)
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{"number": 3}`)
+			}))
+			defer server.Close()
+
+			p := &GitHubProvider{
+				Repository: "repo",
+				Owner:      "owner",
+				HTTPClient: redirectClient(server),
+				retry:      testRetryPolicy,
+			}
+			pr, err := p.OpenPullRequest(context.Background(), "feature", "main", "title", "body")
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("Expected an error, but got none")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if pr.Number != 3 {
+					t.Errorf("Pull request number mismatch\nExpected: 3\n     Got: %d", pr.Number)
+				}
+			}
+			if calls != tc.expectedCalls {
+				t.Errorf("Call count mismatch\nExpected: %d\n     Got: %d", tc.expectedCalls, calls)
+			}
+		})
+	}
+}
+
+func TestMaxRateLimitWait(t *testing.T) {
+	server, requests := recordingServer(t, recordedResponse{http.StatusTooManyRequests, `{}`})
+	p := &GitHubProvider{Repository: "repo", Owner: "owner", HTTPClient: redirectClient(server), MaxRateLimitWait: time.Millisecond}
+	if _, err := p.MergePullRequest(context.Background(), 7); err == nil || !strings.Contains(err.Error(), "exceeds the remaining wait budget of 1ms") {
+		t.Errorf("Expected rate limit budget error, got: %v", err)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("Expected a single request, got: %d", len(*requests))
+	}
+}
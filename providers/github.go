@@ -15,11 +15,10 @@
 package provider
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"net/http"
+	"time"
 )
 
 // GithubProvider implements the GitProvider interface for interacting with the Github API.
@@ -27,88 +26,92 @@ type GitHubProvider struct {
 	Repository string
 	Token      string
 	Owner      string
+	// HTTPClient used for API requests. If not provided then a client with a default timeout is used.
+	HTTPClient *http.Client
+	// MaxRateLimitWait is the total time a request may be paused because of rate limits. If not provided then
+	// defaults to 5 minutes.
+	MaxRateLimitWait time.Duration
+
+	retry retryPolicy
+}
+
+// gitHubDeployment represents the response when creating a GitHub deployment.
+type gitHubDeployment struct {
+	ID int `json:"id"`
+}
+
+// api returns the client for calling the GitHub API.
+func (p *GitHubProvider) api() *apiClient {
+	return newAPIClient(p.HTTPClient, p.retry.withMaxRateLimitWait(p.MaxRateLimitWait), http.Header{
+		"Accept":               {"application/vnd.github+json"},
+		"Authorization":        {fmt.Sprintf("Bearer %s", p.Token)},
+		"X-GitHub-Api-Version": {"2022-11-28"},
+	})
 }
 
 // OpenPullRequest calls the GitHub API for opening a pull request from a source branch to a destination branch.
-func (p *GitHubProvider) OpenPullRequest(src, dst, title, body string) (*PullRequest, error) {
-	payload, err := json.Marshal(map[string]string{
+func (p *GitHubProvider) OpenPullRequest(ctx context.Context, src, dst, title, body string) (*PullRequest, error) {
+	payload := map[string]string{
 		"title": title,
 		"head":  src,
 		"base":  dst,
 		"body":  body,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("unable to marshal json for pull request: %v", err)
-	}
-	reader := bytes.NewReader(payload)
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://api.github.com/repos/%s/%s/pulls", p.Owner, p.Repository), reader)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create new request: %v", err)
-	}
-
-	req.Header.Add("Accept", "application/vnd.github+json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", p.Token))
-	req.Header.Add("X-GitHub-Api-Version", "2022-11-28")
-
-	resp, err := http.DefaultClient.Do(req)
-	defer resp.Body.Close()
-	if err != nil {
-		return nil, fmt.Errorf("unable to make request: %v", err)
 	}
 	var pr PullRequest
-	r, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read response body: %v", err)
-	}
-	if resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("create pull request body: %q, status got: %v want: %v", r, resp.StatusCode, http.StatusCreated)
+	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/pulls", p.Owner, p.Repository)
+	if err := p.api().call(ctx, http.MethodPost, url, payload, http.StatusCreated, &pr); err != nil {
+		return nil, fmt.Errorf("unable to open pull request: %w", err)
 	}
-	if err := json.Unmarshal(r, &pr); err != nil {
-		return nil, fmt.Errorf("unable to unmarshal open pull request response: %v", err)
-	}
-
 	return &pr, nil
 }
 
 // MergePullRequest calls the GitHub API for merging a pull request.
-func (p *GitHubProvider) MergePullRequest(prNo int) (*MergeResponse, error) {
-	call := func(prNo int) (*MergeResponse, error) {
-		payload, err := json.Marshal(map[string]string{
-			"merge_method": "merge",
-		})
-		if err != nil {
-			return nil, fmt.Errorf("unable to marshal json for merging pull request: %v", err)
-		}
-		reader := bytes.NewReader(payload)
-		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("https://api.github.com/repos/%s/%s/pulls/%d/merge", p.Owner, p.Repository, prNo), reader)
-		if err != nil {
-			return nil, fmt.Errorf("unable to create new request: %v", err)
-		}
-
-		req.Header.Add("Accept", "application/vnd.github+json")
-		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", p.Token))
-		req.Header.Add("X-GitHub-Api-Version", "2022-11-28")
-
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("unable to make request: %v", err)
-		}
-		defer resp.Body.Close()
+func (p *GitHubProvider) MergePullRequest(ctx context.Context, prNo int) (*MergeResponse, error) {
+	payload := map[string]string{
+		"merge_method": "merge",
+	}
+	var mr MergeResponse
+	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/pulls/%d/merge", p.Owner, p.Repository, prNo)
+	if err := p.api().call(ctx, http.MethodPut, url, payload, http.StatusOK, &mr); err != nil {
+		return nil, fmt.Errorf("unable to merge pull request: %w", err)
+	}
+	return &mr, nil
+}
 
-		var mr MergeResponse
-		r, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("unable to read response body: %v", err)
-		}
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("merge pull request body: %q, status got: %v want: %v", r, resp.StatusCode, http.StatusOK)
-		}
-		if err := json.Unmarshal(r, &mr); err != nil {
-			return nil, fmt.Errorf("unable to unmarshal merge pull request response: %v", err)
-		}
+// CreateDeployment calls the GitHub API for creating a deployment of the provided commit SHA to an environment.
+// The deployment is created in the in progress state.
+func (p *GitHubProvider) CreateDeployment(ctx context.Context, ref, sha, environment, description string) (*Deployment, error) {
+	payload := map[string]any{
+		"ref":         sha,
+		"environment": environment,
+		"description": description,
+		"auto_merge":  false,
+		// The commit has already been merged, skip the commit status checks GitHub performs by default.
+		"required_contexts": []string{},
+	}
+	var d gitHubDeployment
+	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/deployments", p.Owner, p.Repository)
+	if err := p.api().call(ctx, http.MethodPost, url, payload, http.StatusCreated, &d); err != nil {
+		return nil, fmt.Errorf("unable to create deployment: %w", err)
+	}
 
-		return &mr, nil
+	// GitHub deployments have no status until one is created.
+	if err := p.UpdateDeploymentStatus(ctx, d.ID, environment, DeploymentInProgress, description); err != nil {
+		return nil, err
 	}
+	return &Deployment{ID: d.ID}, nil
+}
 
-	return mergePullRequestWithRetries(prNo, call)
+// UpdateDeploymentStatus calls the GitHub API for creating a new status for a deployment.
+func (p *GitHubProvider) UpdateDeploymentStatus(ctx context.Context, deploymentID int, environment string, state DeploymentState, description string) error {
+	payload := map[string]string{
+		"state":       string(state),
+		"environment": environment,
+		"description": description,
+	}
+	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/deployments/%d/statuses", p.Owner, p.Repository, deploymentID)
+	if err := p.api().call(ctx, http.MethodPost, url, payload, http.StatusCreated, nil); err != nil {
+		return fmt.Errorf("unable to create deployment status: %w", err)
+	}
+	return nil
 }
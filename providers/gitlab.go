@@ -15,11 +15,10 @@
 package provider
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"net/http"
+	"time"
 )
 
 // GitLabProvider implements the GitProvider interface for interacting with the Gitlab API.
@@ -27,6 +26,13 @@ type GitLabProvider struct {
 	Repository string
 	Token      string
 	Owner      string
+	// HTTPClient used for API requests. If not provided then a client with a default timeout is used.
+	HTTPClient *http.Client
+	// MaxRateLimitWait is the total time a request may be paused because of rate limits. If not provided then
+	// defaults to 5 minutes.
+	MaxRateLimitWait time.Duration
+
+	retry retryPolicy
 }
 
 // gitLabMergeRequest represents the response when querying for a GitLab Merge request.
@@ -39,76 +45,88 @@ type gitLabMergeResponse struct {
 	Sha string `json:"merge_commit_sha"`
 }
 
+// gitLabDeployment represents the response when creating a GitLab deployment.
+type gitLabDeployment struct {
+	ID int `json:"id"`
+}
+
+// gitLabDeploymentStatuses maps deployment states onto the GitLab deployment status values.
+var gitLabDeploymentStatuses = map[DeploymentState]string{
+	DeploymentInProgress: "running",
+	DeploymentSuccess:    "success",
+	DeploymentFailure:    "failed",
+}
+
+// api returns the client for calling the GitLab API.
+func (p *GitLabProvider) api() *apiClient {
+	return newAPIClient(p.HTTPClient, p.retry.withMaxRateLimitWait(p.MaxRateLimitWait), http.Header{
+		"Content-Type":  {"application/json"},
+		"Authorization": {fmt.Sprintf("Bearer %s", p.Token)},
+	})
+}
+
+// projectURL returns the GitLab API URL of the project.
+func (p *GitLabProvider) projectURL() string {
+	return fmt.Sprintf("https://gitlab.com/api/v4/projects/%s%%2F%s", p.Owner, p.Repository)
+}
+
 // OpenPullRequest calls the GitLab API for opening a merge request from a source branch to a destination branch.
-func (p *GitLabProvider) OpenPullRequest(src, dst, title, body string) (*PullRequest, error) {
-	payload, err := json.Marshal(map[string]string{
+func (p *GitLabProvider) OpenPullRequest(ctx context.Context, src, dst, title, body string) (*PullRequest, error) {
+	payload := map[string]string{
 		"title":         title,
 		"source_branch": src,
 		"target_branch": dst,
 		"description":   body,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("unable to marshal json for merge request: %v", err)
 	}
-	reader := bytes.NewReader(payload)
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://gitlab.com/api/v4/projects/%s%%2F%s/merge_requests", p.Owner, p.Repository), reader)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create new request: %v", err)
+	var mr gitLabMergeRequest
+	url := fmt.Sprintf("%s/merge_requests", p.projectURL())
+	if err := p.api().call(ctx, http.MethodPost, url, payload, http.StatusCreated, &mr); err != nil {
+		return nil, fmt.Errorf("unable to open merge request: %w", err)
 	}
+	return &PullRequest{Number: mr.InternalID}, nil
+}
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", p.Token))
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("unable to make request: %v", err)
+// MergePullRequest calls the Gitlab API for merging a merge request.
+func (p *GitLabProvider) MergePullRequest(ctx context.Context, prNo int) (*MergeResponse, error) {
+	var mr gitLabMergeResponse
+	url := fmt.Sprintf("%s/merge_requests/%d/merge", p.projectURL(), prNo)
+	if err := p.api().call(ctx, http.MethodPut, url, nil, http.StatusOK, &mr); err != nil {
+		return nil, fmt.Errorf("unable to merge merge request: %w", err)
 	}
-	defer resp.Body.Close()
+	return &MergeResponse{Sha: mr.Sha}, nil
+}
 
-	var mr gitLabMergeRequest
-	r, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read response body: %v", err)
-	}
-	if resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("create pull request body: %q, status got: %v want: %v", r, resp.StatusCode, http.StatusCreated)
+// CreateDeployment calls the GitLab API for creating a deployment record of the provided commit SHA in an environment.
+// The deployment is created in the in progress state. The description is not supported by the GitLab deployments
+// API and is ignored.
+func (p *GitLabProvider) CreateDeployment(ctx context.Context, ref, sha, environment, description string) (*Deployment, error) {
+	payload := map[string]any{
+		"environment": environment,
+		"sha":         sha,
+		"ref":         ref,
+		"tag":         false,
+		"status":      gitLabDeploymentStatuses[DeploymentInProgress],
 	}
-	if err := json.Unmarshal(r, &mr); err != nil {
-		return nil, fmt.Errorf("unable to unmarshal open pull request response: %v", err)
+	var d gitLabDeployment
+	url := fmt.Sprintf("%s/deployments", p.projectURL())
+	if err := p.api().call(ctx, http.MethodPost, url, payload, http.StatusCreated, &d); err != nil {
+		return nil, fmt.Errorf("unable to create deployment: %w", err)
 	}
-
-	return &PullRequest{Number: mr.InternalID}, nil
+	return &Deployment{ID: d.ID}, nil
 }
 
-// MergePullRequest calls the Gitlab API for merging a merge request.
-func (p *GitLabProvider) MergePullRequest(prNo int) (*MergeResponse, error) {
-	call := func(prNo int) (*MergeResponse, error) {
-		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("https://gitlab.com/api/v4/projects/%s%%2F%s/merge_requests/%d/merge", p.Owner, p.Repository, prNo), nil)
-		if err != nil {
-			return nil, fmt.Errorf("unable to create new request: %v", err)
-		}
-
-		req.Header.Add("Content-Type", "application/json")
-		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", p.Token))
-
-		resp, err := http.DefaultClient.Do(req)
-		defer resp.Body.Close()
-		if err != nil {
-			return nil, fmt.Errorf("unable to make request: %v", err)
-		}
-		var mr gitLabMergeResponse
-		r, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("unable to read response body: %v", err)
-		}
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("merge pull request body: %q, status got: %v want: %v", r, resp.StatusCode, http.StatusOK)
-		}
-		if err := json.Unmarshal(r, &mr); err != nil {
-			return nil, fmt.Errorf("unable to unmarshal merge pull request response: %v", err)
-		}
-		return &MergeResponse{Sha: mr.Sha}, nil
+// UpdateDeploymentStatus calls the GitLab API for updating the status of a deployment.
+func (p *GitLabProvider) UpdateDeploymentStatus(ctx context.Context, deploymentID int, environment string, state DeploymentState, description string) error {
+	status, ok := gitLabDeploymentStatuses[state]
+	if !ok {
+		return fmt.Errorf("unsupported deployment state: %s", state)
 	}
-
-	return mergePullRequestWithRetries(prNo, call)
+	payload := map[string]string{
+		"status": status,
+	}
+	url := fmt.Sprintf("%s/deployments/%d", p.projectURL(), deploymentID)
+	if err := p.api().call(ctx, http.MethodPut, url, payload, http.StatusOK, nil); err != nil {
+		return fmt.Errorf("unable to update deployment: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,77 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestGitLabCreateDeployment(t *testing.T) {
+	server, requests := recordingServer(t, recordedResponse{http.StatusCreated, `{"id": 42}`})
+	p := &GitLabProvider{Repository: "repo", Owner: "owner", Token: "token", HTTPClient: redirectClient(server), retry: testRetryPolicy}
+
+	d, err := p.CreateDeployment(context.Background(), "main", "abc123", "prod", "Batch 1/2")
+	if err != nil {
+		t.Fatalf("Failed to create deployment: %v", err)
+	}
+	if d.ID != 42 {
+		t.Errorf("Deployment ID mismatch\nExpected: 42\n     Got: %d", d.ID)
+	}
+	want := []recordedRequest{{
+		method: http.MethodPost,
+		path:   "/api/v4/projects/owner%2Frepo/deployments",
+		payload: map[string]any{
+			"environment": "prod",
+			"sha":         "abc123",
+			"ref":         "main",
+			"tag":         false,
+			"status":      "running",
+		},
+	}}
+	if !reflect.DeepEqual(*requests, want) {
+		t.Errorf("Requests mismatch\nExpected: %+v\n     Got: %+v", want, *requests)
+	}
+}
+
+func TestGitLabUpdateDeploymentStatus(t *testing.T) {
+	for state, want := range map[DeploymentState]string{
+		DeploymentInProgress: "running",
+		DeploymentSuccess:    "success",
+		DeploymentFailure:    "failed",
+	} {
+		server, requests := recordingServer(t, recordedResponse{http.StatusOK, `{}`})
+		p := &GitLabProvider{Repository: "repo", Owner: "owner", Token: "token", HTTPClient: redirectClient(server), retry: testRetryPolicy}
+
+		if err := p.UpdateDeploymentStatus(context.Background(), 7, "prod", state, "Completed batch"); err != nil {
+			t.Fatalf("Failed to update deployment status to %s: %v", state, err)
+		}
+		wantRequests := []recordedRequest{{
+			method:  http.MethodPut,
+			path:    "/api/v4/projects/owner%2Frepo/deployments/7",
+			payload: map[string]any{"status": want},
+		}}
+		if !reflect.DeepEqual(*requests, wantRequests) {
+			t.Errorf("Requests of state %s mismatch\nExpected: %+v\n     Got: %+v", state, wantRequests, *requests)
+		}
+	}
+
+	p := &GitLabProvider{Repository: "repo", Owner: "owner", Token: "token", retry: testRetryPolicy}
+	if err := p.UpdateDeploymentStatus(context.Background(), 7, "prod", DeploymentState("queued"), ""); err == nil {
+		t.Error("Expected error for unsupported deployment state")
+	}
+}
@@ -15,14 +15,18 @@
 package provider
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"time"
 )
 
 // GitProvider interface provides methods for interacting with the API of a Git Provider.
 type GitProvider interface {
-	OpenPullRequest(src, dst, title, body string) (*PullRequest, error)
-	MergePullRequest(prNo int) (*MergeResponse, error)
+	OpenPullRequest(ctx context.Context, src, dst, title, body string) (*PullRequest, error)
+	MergePullRequest(ctx context.Context, prNo int) (*MergeResponse, error)
+	CreateDeployment(ctx context.Context, ref, sha, environment, description string) (*Deployment, error)
+	UpdateDeploymentStatus(ctx context.Context, deploymentID int, environment string, state DeploymentState, description string) error
 }
 
 // PullRequest represents a pull request resource from a Git provider.
@@ -35,41 +39,46 @@ type MergeResponse struct {
 	Sha string
 }
 
+// Deployment represents a deployment resource from a Git provider, i.e. a GitHub Deployment or a
+// GitLab environment deployment.
+type Deployment struct {
+	ID int
+}
+
+// DeploymentState is the state of a deployment. The values follow the GitHub deployment status
+// states and are translated by providers that use a different vocabulary.
+type DeploymentState string
+
+const (
+	DeploymentInProgress DeploymentState = "in_progress"
+	DeploymentSuccess    DeploymentState = "success"
+	DeploymentFailure    DeploymentState = "failure"
+)
+
 // CreateProvider returns an instance of the GitProvider. Returns an error if an unsupported
-// provider hostname is provided.
-func CreateProvider(hostname, repoName, owner, secret string) (GitProvider, error) {
+// provider hostname is provided. If httpClient is nil then a client with a default timeout is used. Requests
+// are paused for at most maxRateLimitWait in total because of rate limits, or a default if not positive.
+func CreateProvider(hostname, repoName, owner, secret string, httpClient *http.Client, maxRateLimitWait time.Duration) (GitProvider, error) {
 	var provider GitProvider
 	switch hostname {
 	case "github.com":
 		provider = &GitHubProvider{
-			Repository: repoName,
-			Token:      secret,
-			Owner:      owner,
+			Repository:       repoName,
+			Token:            secret,
+			Owner:            owner,
+			HTTPClient:       httpClient,
+			MaxRateLimitWait: maxRateLimitWait,
 		}
 	case "gitlab.com":
 		provider = &GitLabProvider{
-			Repository: repoName,
-			Token:      secret,
-			Owner:      owner,
+			Repository:       repoName,
+			Token:            secret,
+			Owner:            owner,
+			HTTPClient:       httpClient,
+			MaxRateLimitWait: maxRateLimitWait,
 		}
 	default:
 		return nil, fmt.Errorf("unsupported git provider: %s", hostname)
 	}
 	return provider, nil
 }
-
-func mergePullRequestWithRetries(prNo int, call func(prNo int) (*MergeResponse, error)) (*MergeResponse, error) {
-	endTime := time.Now().Add(2 * time.Minute)
-	startWait := time.Second * 2
-	var mr *MergeResponse
-	var err error
-	for attempts := 1; time.Now().Before(endTime); attempts++ {
-		mr, err = call(prNo)
-		if err != nil {
-			time.Sleep(startWait * time.Duration(attempts))
-			continue
-		}
-		return mr, err
-	}
-	return nil, err
-}
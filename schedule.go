@@ -0,0 +1,81 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// batchSize is the size of a batch, either a number of clusters or a percentage of the clusters being batched.
+type batchSize struct {
+	// Number of clusters, or percentage if percent is set. All remaining clusters if not positive.
+	n       int
+	percent bool
+}
+
+// clusters returns the number of clusters of the batch given the total number of clusters being batched.
+// Percentages are rounded up, so a batch has at least one cluster.
+func (s batchSize) clusters(total int) int {
+	if !s.percent {
+		return s.n
+	}
+	return (total*s.n + 99) / 100
+}
+
+func (s batchSize) String() string {
+	if s.percent {
+		return fmt.Sprintf("%d%%", s.n)
+	}
+	return strconv.Itoa(s.n)
+}
+
+// batchSchedule is the sizes of successive batches, e.g. "1,5,25%,100%" for a single canary cluster followed by
+// growing batches. The last size is repeated for the remaining batches.
+type batchSchedule []batchSize
+
+// parseBatchSchedule parses comma separated batch sizes, each a number of clusters, with 0 for all remaining
+// clusters, or a percentage of the clusters between 1% and 100%.
+func parseBatchSchedule(value string) (batchSchedule, error) {
+	var schedule batchSchedule
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		size := batchSize{}
+		if p, ok := strings.CutSuffix(s, "%"); ok {
+			n, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil || n < 1 || n > 100 {
+				return nil, fmt.Errorf("%q is not a percentage between 1%% and 100%%", s)
+			}
+			size = batchSize{n: n, percent: true}
+		} else {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%q is not a number of clusters or a percentage", s)
+			}
+			size.n = n
+		}
+		schedule = append(schedule, size)
+	}
+	return schedule, nil
+}
+
+func (s batchSchedule) String() string {
+	sizes := make([]string, len(s))
+	for i, size := range s {
+		sizes[i] = size.String()
+	}
+	return strings.Join(sizes, ",")
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseBatchSchedule(t *testing.T) {
+	testCases := map[string]batchSchedule{
+		"3":               {{n: 3}},
+		"0":               {{n: 0}},
+		"10%":             {{n: 10, percent: true}},
+		" 1, 5,25 %,100%": {{n: 1}, {n: 5}, {n: 25, percent: true}, {n: 100, percent: true}},
+	}
+	for value, want := range testCases {
+		got, err := parseBatchSchedule(value)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Schedule %q mismatch\nExpected: %v\n     Got: %v", value, want, got)
+		}
+	}
+	for _, value := range []string{"", "-1", "0%", "101%", "1.5", "ten", "1,,2", "%"} {
+		if _, err := parseBatchSchedule(value); err == nil {
+			t.Errorf("Expected error parsing %q", value)
+		}
+	}
+}
+
+func TestPlanBatchesSchedule(t *testing.T) {
+	clusters := make([]string, 10)
+	for i := range clusters {
+		clusters[i] = fmt.Sprintf("c%d", i+1)
+	}
+	testCases := []struct {
+		schedule string
+		clusters int
+		// Sizes of the batches.
+		expected []int
+	}{
+		{"3", 10, []int{3, 3, 3, 1}},
+		{"0", 10, []int{10}},
+		{"100%", 10, []int{10}},
+		// Percentages are rounded up.
+		{"10%", 10, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		{"25%", 10, []int{3, 3, 3, 1}},
+		{"33%", 3, []int{1, 1, 1}},
+		{"1%", 10, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		{"50%", 1, []int{1}},
+		// The last size is repeated.
+		{"1,5,25%,100%", 10, []int{1, 5, 3, 1}},
+		{"1,2", 10, []int{1, 2, 2, 2, 2, 1}},
+		{"1,0", 10, []int{1, 9}},
+		{"1,5,25%,100%", 2, []int{1, 1}},
+		{"2,5", 0, nil},
+	}
+	for _, tc := range testCases {
+		schedule, err := parseBatchSchedule(tc.schedule)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tc.schedule, err)
+		}
+		var sizes []int
+		var planned []string
+		for _, b := range planBatches(clusters[:tc.clusters], schedule) {
+			sizes = append(sizes, len(b))
+			planned = append(planned, b...)
+		}
+		if !reflect.DeepEqual(sizes, tc.expected) {
+			t.Errorf("Batches of %d clusters with schedule %q mismatch\nExpected: %v\n     Got: %v", tc.clusters, tc.schedule, tc.expected, sizes)
+		}
+		if !reflect.DeepEqual(planned, clusters[:tc.clusters]) && tc.clusters != 0 {
+			t.Errorf("Expected batches of schedule %q to contain the clusters in order, got: %v", tc.schedule, planned)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// selectorExpr is a parsed cluster selector expression, e.g. `region=us AND (canary OR tier!=critical) AND NOT
+// frozen`. The grammar is:
+//
+//	expr    = and { "OR" and }
+//	and     = not { "AND" not }
+//	not     = "NOT" not | "(" expr ")" | term
+//	term    = value [ ( "=" | "!=" ) value ]
+//	value   = word | quoted string
+//
+// Keywords are case-insensitive and values containing spaces, parentheses, '=', '!' or keywords are quoted,
+// e.g. "and". A value on its own matches clusters having it as a tag. A comparison `key=value` matches clusters
+// whose source of truth column key has the value, or having the tag value if key is cluster_tags. If the source
+// of truth has no column key, clusters having the tag `key=value` are matched.
+type selectorExpr interface {
+	matches(c *selectorCluster) bool
+	String() string
+}
+
+// selectorCluster is a cluster a selector expression is evaluated against.
+type selectorCluster struct {
+	tags []string
+	// Fields of the cluster by source of truth column.
+	fields map[string]string
+}
+
+// selectorOr matches clusters matched by either expression.
+type selectorOr struct{ left, right selectorExpr }
+
+func (e *selectorOr) matches(c *selectorCluster) bool {
+	return e.left.matches(c) || e.right.matches(c)
+}
+
+func (e *selectorOr) String() string {
+	return fmt.Sprintf("(%s OR %s)", e.left, e.right)
+}
+
+// selectorAnd matches clusters matched by both expressions.
+type selectorAnd struct{ left, right selectorExpr }
+
+func (e *selectorAnd) matches(c *selectorCluster) bool {
+	return e.left.matches(c) && e.right.matches(c)
+}
+
+func (e *selectorAnd) String() string {
+	return fmt.Sprintf("(%s AND %s)", e.left, e.right)
+}
+
+// selectorNot matches clusters not matched by the expression.
+type selectorNot struct{ expr selectorExpr }
+
+func (e *selectorNot) matches(c *selectorCluster) bool {
+	return !e.expr.matches(c)
+}
+
+func (e *selectorNot) String() string {
+	return fmt.Sprintf("NOT %s", e.expr)
+}
+
+// selectorTag matches clusters having the tag.
+type selectorTag struct{ tag string }
+
+func (e *selectorTag) matches(c *selectorCluster) bool {
+	return slices.Contains(c.tags, e.tag)
+}
+
+func (e *selectorTag) String() string {
+	return quoteSelectorValue(e.tag)
+}
+
+// selectorCompare matches clusters whose column has, or with negate does not have, the value.
+type selectorCompare struct {
+	key, value string
+	negate     bool
+}
+
+func (e *selectorCompare) matches(c *selectorCluster) bool {
+	var match bool
+	if e.key == clusterTagsColumn {
+		match = slices.Contains(c.tags, e.value)
+	} else if v, ok := c.fields[e.key]; ok {
+		match = v == e.value
+	} else {
+		match = slices.Contains(c.tags, e.key+"="+e.value)
+	}
+	return match != e.negate
+}
+
+func (e *selectorCompare) String() string {
+	op := "="
+	if e.negate {
+		op = "!="
+	}
+	return quoteSelectorValue(e.key) + op + quoteSelectorValue(e.value)
+}
+
+// quoteSelectorValue returns the value as it is written in an expression.
+func quoteSelectorValue(v string) string {
+	if len(v) == 0 || strings.IndexFunc(v, isSelectorSpecial) != -1 || selectorKeyword(v) != "" {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// Kinds of selector expression tokens.
+const (
+	selectorTokenEOF = iota
+	selectorTokenValue
+	selectorTokenKeyword
+	selectorTokenOperator
+)
+
+// selectorToken is a token of a selector expression.
+type selectorToken struct {
+	kind int
+	// Value, upper case keyword or operator.
+	text string
+	// 1-based position of the token in the expression.
+	pos int
+}
+
+func (t selectorToken) String() string {
+	if t.kind == selectorTokenEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q at position %d", t.text, t.pos)
+}
+
+func isSelectorSpecial(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(`()=!"`, r)
+}
+
+// selectorKeyword returns the upper case keyword if the word is one.
+func selectorKeyword(word string) string {
+	switch kw := strings.ToUpper(word); kw {
+	case "AND", "OR", "NOT":
+		return kw
+	}
+	return ""
+}
+
+// tokenizeSelector splits the expression into tokens.
+func tokenizeSelector(expr string) ([]selectorToken, error) {
+	var tokens []selectorToken
+	for i := 0; i < len(expr); {
+		r, size := utf8.DecodeRuneInString(expr[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '(' || r == ')' || r == '=':
+			tokens = append(tokens, selectorToken{kind: selectorTokenOperator, text: string(r), pos: i + 1})
+			i++
+		case r == '!':
+			if !strings.HasPrefix(expr[i:], "!=") {
+				return nil, fmt.Errorf("unexpected \"!\" at position %d, expected \"!=\"", i+1)
+			}
+			tokens = append(tokens, selectorToken{kind: selectorTokenOperator, text: "!=", pos: i + 1})
+			i += 2
+		case r == '"':
+			quoted, err := strconv.QuotedPrefix(expr[i:])
+			if err != nil {
+				return nil, fmt.Errorf("unterminated quoted value at position %d", i+1)
+			}
+			value, err := strconv.Unquote(quoted)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted value at position %d: %v", i+1, err)
+			}
+			tokens = append(tokens, selectorToken{kind: selectorTokenValue, text: value, pos: i + 1})
+			i += len(quoted)
+		default:
+			end := strings.IndexFunc(expr[i:], isSelectorSpecial)
+			if end == -1 {
+				end = len(expr) - i
+			}
+			word := expr[i : i+end]
+			if kw := selectorKeyword(word); kw != "" {
+				tokens = append(tokens, selectorToken{kind: selectorTokenKeyword, text: kw, pos: i + 1})
+			} else {
+				tokens = append(tokens, selectorToken{kind: selectorTokenValue, text: word, pos: i + 1})
+			}
+			i += end
+		}
+	}
+	return append(tokens, selectorToken{kind: selectorTokenEOF, pos: len(expr) + 1}), nil
+}
+
+// selectorParser is a recursive descent parser of selector expressions.
+type selectorParser struct {
+	tokens []selectorToken
+	next   int
+}
+
+// parseSelector parses the selector expression.
+func parseSelector(expr string) (selectorExpr, error) {
+	tokens, err := tokenizeSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &selectorParser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != selectorTokenEOF {
+		return nil, fmt.Errorf("unexpected %s", t)
+	}
+	return e, nil
+}
+
+func (p *selectorParser) peek() selectorToken {
+	return p.tokens[p.next]
+}
+
+func (p *selectorParser) advance() selectorToken {
+	t := p.tokens[p.next]
+	if t.kind != selectorTokenEOF {
+		p.next++
+	}
+	return t
+}
+
+func (p *selectorParser) parseOr() (selectorExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == selectorTokenKeyword && t.text == "OR"; t = p.peek() {
+		p.advance()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &selectorOr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *selectorParser) parseAnd() (selectorExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == selectorTokenKeyword && t.text == "AND"; t = p.peek() {
+		p.advance()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &selectorAnd{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *selectorParser) parseNot() (selectorExpr, error) {
+	t := p.advance()
+	switch {
+	case t.kind == selectorTokenKeyword && t.text == "NOT":
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &selectorNot{expr: e}, nil
+
+	case t.kind == selectorTokenOperator && t.text == "(":
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.advance(); c.kind != selectorTokenOperator || c.text != ")" {
+			return nil, fmt.Errorf("unexpected %s, expected \")\" closing \"(\" at position %d", c, t.pos)
+		}
+		return e, nil
+
+	case t.kind == selectorTokenValue:
+		op := p.peek()
+		if op.kind != selectorTokenOperator || (op.text != "=" && op.text != "!=") {
+			return &selectorTag{tag: t.text}, nil
+		}
+		p.advance()
+		v := p.advance()
+		if v.kind != selectorTokenValue {
+			return nil, fmt.Errorf("unexpected %s, expected a value after %q", v, op.text)
+		}
+		return &selectorCompare{key: t.text, value: v.text, negate: op.text == "!="}, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected %s, expected a tag, comparison, \"NOT\" or \"(\"", t)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	testCases := []struct {
+		expr     string
+		expected string
+	}{
+		{"canary", "canary"},
+		{"region=us AND (canary OR tier!=critical) AND NOT frozen", "((region=us AND (canary OR tier!=critical)) AND NOT frozen)"},
+		{"a or b and c", "(a OR (b AND c))"},
+		{"not not a", "NOT NOT a"},
+		{"(a OR b) AND c", "((a OR b) AND c)"},
+		{`team="data platform" AND "and"`, `(team="data platform" AND "and")`},
+		{"labels.region = us-central1", "labels.region=us-central1"},
+		{"  zone=europe-west1-b\tOR\nzone=us-east1-c ", "(zone=europe-west1-b OR zone=us-east1-c)"},
+	}
+	for _, tc := range testCases {
+		e, err := parseSelector(tc.expr)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", tc.expr, err)
+			continue
+		}
+		if got := e.String(); got != tc.expected {
+			t.Errorf("Parsed %q mismatch\nExpected: %s\n     Got: %s", tc.expr, tc.expected, got)
+		}
+		// The string of an expression parses to the same expression.
+		if again, err := parseSelector(e.String()); err != nil || again.String() != e.String() {
+			t.Errorf("Expected %s to parse to itself, got: %v, %v", e, again, err)
+		}
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	testCases := map[string]string{
+		"":                  `unexpected end of expression, expected a tag, comparison, "NOT" or "("`,
+		"a AND":             `unexpected end of expression, expected a tag, comparison, "NOT" or "("`,
+		"(a OR b":           `unexpected end of expression, expected ")" closing "(" at position 1`,
+		"a b":               `unexpected "b" at position 3`,
+		"a) OR b":           `unexpected ")" at position 2`,
+		"region=":           `unexpected end of expression, expected a value after "="`,
+		"region=(us)":       `unexpected "(" at position 8, expected a value after "="`,
+		"!canary":           `unexpected "!" at position 1, expected "!="`,
+		`team="data`:        "unterminated quoted value at position 6",
+		"AND a":             `unexpected "AND" at position 1, expected a tag, comparison, "NOT" or "("`,
+		"region=us=eu":      `unexpected "=" at position 10`,
+		"canary OR OR beta": `unexpected "OR" at position 11, expected a tag, comparison, "NOT" or "("`,
+	}
+	for expr, want := range testCases {
+		_, err := parseSelector(expr)
+		if err == nil || err.Error() != want {
+			t.Errorf("Parse %q error mismatch\nExpected: %s\n     Got: %v", expr, want, err)
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	clusters := map[string]*selectorCluster{
+		"us-canary": {tags: []string{"canary"}, fields: map[string]string{"region": "us", "tier": "critical"}},
+		"us-frozen": {tags: []string{"canary", "frozen"}, fields: map[string]string{"region": "us", "tier": "standard"}},
+		"us":        {tags: []string{""}, fields: map[string]string{"region": "us", "tier": "standard"}},
+		"us-crit":   {tags: []string{""}, fields: map[string]string{"region": "us", "tier": "critical"}},
+		"eu-canary": {tags: []string{"canary"}, fields: map[string]string{"region": "eu", "tier": "standard"}},
+		"tagged":    {tags: []string{"env=prod", "canary"}, fields: map[string]string{"region": "us"}},
+	}
+	testCases := []struct {
+		expr     string
+		expected []string
+	}{
+		{"region=us AND (canary OR tier!=critical) AND NOT frozen", []string{"tagged", "us", "us-canary"}},
+		{"canary", []string{"eu-canary", "tagged", "us-canary", "us-frozen"}},
+		{"cluster_tags=frozen", []string{"us-frozen"}},
+		// Clusters of a source of truth without the env column are matched by tag.
+		{"env=prod", []string{"tagged"}},
+		{"env!=prod AND region!=us", []string{"eu-canary"}},
+		{"NOT (canary OR region=eu)", []string{"us", "us-crit"}},
+	}
+	for _, tc := range testCases {
+		e, err := parseSelector(tc.expr)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tc.expr, err)
+		}
+		var got []string
+		for _, name := range []string{"eu-canary", "tagged", "us", "us-canary", "us-crit", "us-frozen"} {
+			if e.matches(clusters[name]) {
+				got = append(got, name)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Matches of %q mismatch\nExpected: %v\n     Got: %v", tc.expr, tc.expected, got)
+		}
+	}
+}
+
+func TestCSVSelectClustersExpression(t *testing.T) {
+	sourceOfTruth, err := createTempCSV("", [][]string{
+		{"cluster_name", "cluster_group", "cluster_tags", "platform_repository_revision", "workload_repository_revision", "region", "tier"},
+		{"cluster1", "prod", "canary", "v1", "v1", "us", "critical"},
+		{"cluster2", "prod", "canary,frozen", "v1", "v1", "us", "standard"},
+		{"cluster3", "prod", "", "v1", "v1", "us", "standard"},
+		{"cluster4", "prod", "canary", "v1", "v1", "eu", "standard"},
+		{"cluster5", "dev", "canary", "v1", "v1", "us", "standard"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test CSV: %v", err)
+	}
+	defer os.Remove(sourceOfTruth)
+
+	e, err := parseSelector("region=us AND (canary OR tier!=critical) AND NOT frozen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sot := &csvSourceOfTruth{path: sourceOfTruth}
+	got, _, err := sot.selectClusters("prod", nil, nil, e, nil)
+	if err != nil {
+		t.Fatalf("Failed to determine clusters: %v", err)
+	}
+	if want := []string{"cluster1", "cluster3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Clusters mismatch\nExpected: %v\n     Got: %v", want, got)
+	}
+}
+
+func TestMatchClustersExpressionParam(t *testing.T) {
+	env := map[string]string{
+		gitSourceRepoEnvKey:             "github.com/owner/platform",
+		gitSourceBranchEnvKey:           "main",
+		gitOutputRepoEnvKey:             "github.com/owner/hydrated",
+		gitOutputBranchEnvKey:           "main",
+		gitSecretEnvKey:                 "env:TOKEN",
+		gitLockGCSPathEnvKey:            "gs://bucket/locks",
+		hydrationClusterGroupEnvKey:     "prod",
+		hydrationBatchSizeEnvKey:        "1",
+		hydrationPlatformRevisionEnvKey: "v2",
+		matchClustersExpressionEnvKey:   "region=us AND NOT frozen",
+	}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	p, err := determineParamsFrom(lookup)
+	if err != nil {
+		t.Fatalf("Failed to determine params: %v", err)
+	}
+	if got, want := p.matchClustersExpression.String(), "(region=us AND NOT frozen)"; got != want {
+		t.Errorf("Expected expression %s, got: %s", want, got)
+	}
+
+	env[matchClustersExpressionEnvKey] = "region=us AND"
+	if _, err := determineParamsFrom(lookup); err == nil || !strings.Contains(err.Error(), "not a valid expression") {
+		t.Errorf("Expected invalid expression error, got: %v", err)
+	}
+	env[matchClustersExpressionEnvKey] = "region=us"
+	env[matchClustersHavingAnyListedTagEnvKey] = "canary"
+	if _, err := determineParamsFrom(lookup); err == nil || !strings.Contains(err.Error(), "cannot be combined") {
+		t.Errorf("Expected combination error, got: %v", err)
+	}
+}
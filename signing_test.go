@@ -0,0 +1,238 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"golang.org/x/crypto/ssh"
+)
+
+const testSignerEmail = "deploy@example.com"
+
+// generateSSHKey returns a PEM encoded ed25519 private key and its authorized_keys public key.
+func generateSSHKey(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(block), ssh.MarshalAuthorizedKey(sshPub)
+}
+
+// generateOpenPGPKey returns an armored OpenPGP private key and its armored public key.
+func generateOpenPGPKey(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	entity, err := openpgp.NewEntity("Cloud Deploy", "", testSignerEmail, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var priv, pub bytes.Buffer
+	w, err := armor.Encode(&priv, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	w, err = armor.Encode(&pub, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return priv.Bytes(), pub.Bytes()
+}
+
+func TestParseSigningKey(t *testing.T) {
+	sshKey, _ := generateSSHKey(t)
+	pgpKey, pgpPub := generateOpenPGPKey(t)
+
+	testCases := []struct {
+		name           string
+		data           []byte
+		expectedFormat string
+		expectError    bool
+	}{
+		{"SSH key", sshKey, signingFormatSSH, false},
+		{"OpenPGP key", pgpKey, signingFormatOpenPGP, false},
+		{"OpenPGP public key", pgpPub, "", true},
+		{"Garbage", []byte("not a key"), "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := parseSigningKey(tc.data)
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("Expected an error, but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if key.format != tc.expectedFormat {
+				t.Errorf("Format mismatch\nExpected: %s\n     Got: %s", tc.expectedFormat, key.format)
+			}
+		})
+	}
+}
+
+// verifyCommitArgs returns the git arguments for verifying the HEAD commit signature with the public key,
+// setting up the gpg keyring or SSH allowed signers file as needed.
+func verifyCommitArgs(t *testing.T, format string, pub []byte) []string {
+	t.Helper()
+	if format == signingFormatSSH {
+		if _, err := exec.LookPath("ssh-keygen"); err != nil {
+			t.Skip("ssh-keygen binary not available")
+		}
+		allowedSigners := filepath.Join(t.TempDir(), "allowed_signers")
+		if err := os.WriteFile(allowedSigners, []byte(fmt.Sprintf("%s namespaces=\"git\" %s", testSignerEmail, pub)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return []string{"-c", "gpg.format=ssh", "-c", "gpg.ssh.allowedSignersFile=" + allowedSigners, "verify-commit", "HEAD"}
+	}
+
+	pubPath := filepath.Join(t.TempDir(), "public.asc")
+	if err := os.WriteFile(pubPath, pub, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(gpgBin, "--batch", "--import", pubPath).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to import public key: %v\n%s", err, out)
+	}
+	return []string{"verify-commit", "HEAD"}
+}
+
+// useTempGnuPGHome isolates the gpg keyring used by the test. The directory is kept short since gpg-agent
+// sockets are created in it.
+func useTempGnuPGHome(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath(gpgBin); err != nil {
+		t.Skip("gpg binary not available")
+	}
+	home, err := os.MkdirTemp("", "gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+		os.RemoveAll(home)
+	})
+	t.Setenv("GNUPGHOME", home)
+}
+
+func TestSignedCommits(t *testing.T) {
+	testCases := []struct {
+		backend string
+		format  string
+	}{
+		{gitBackendCLI, signingFormatSSH},
+		{gitBackendCLI, signingFormatOpenPGP},
+		{gitBackendNative, signingFormatSSH},
+		{gitBackendNative, signingFormatOpenPGP},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s %s", tc.backend, tc.format), func(t *testing.T) {
+			useTempGnuPGHome(t)
+			var priv, pub []byte
+			if tc.format == signingFormatSSH {
+				priv, pub = generateSSHKey(t)
+			} else {
+				priv, pub = generateOpenPGPKey(t)
+			}
+			key, err := parseSigningKey(priv)
+			if err != nil {
+				t.Fatalf("Failed to parse signing key: %v", err)
+			}
+
+			var g gitRepository
+			var bare string
+			if tc.backend == gitBackendCLI {
+				root := t.TempDir()
+				bare = createBareRemote(t, root, "owner", "repo", map[string]string{"source_of_truth.csv": "cluster_name\n"}, 1)
+				redirectRemotes(t, root, "github.com", "owner", "secret")
+				g = newGitRepository(gitBackendCLI, "github.com", "owner", "repo", testSignerEmail, "Cloud Deploy", key)
+				if _, err := g.cloneRepo(filepath.Join(t.TempDir(), "repo"), "secret", cloneOptions{}); err != nil {
+					t.Fatalf("Failed to clone: %v", err)
+				}
+			} else {
+				ng, remoteDir := newNativeTestRepository(t)
+				if _, err := ng.push("main"); err != nil {
+					t.Fatalf("Failed to push main: %v", err)
+				}
+				ng.signingKey = key
+				g, bare = ng, remoteDir
+			}
+
+			if err := g.config(); err != nil {
+				t.Fatalf("Failed to configure: %v", err)
+			}
+			if tc.backend == gitBackendCLI && tc.format == signingFormatOpenPGP {
+				t.Cleanup(func() {
+					exec.Command("gpgconf", "--homedir", filepath.Join(g.info().dir, ".git", "gnupg"), "--kill", "gpg-agent").Run()
+				})
+				// The key is only imported into the keyring of the repository.
+				if out, err := exec.Command(gpgBin, "--batch", "--with-colons", "--list-secret-keys").CombinedOutput(); err != nil || bytes.Contains(out, []byte("sec:")) {
+					t.Errorf("Expected the default keyring to have no secret keys, got: %s %v", out, err)
+				}
+			}
+			if _, err := g.checkoutBranch("signed"); err != nil {
+				t.Fatalf("Failed to checkout branch: %v", err)
+			}
+			writeTestFile(t, g.info().dir, "output/cluster1.yaml", "kind: ConfigMap\n")
+			if _, err := g.add(); err != nil {
+				t.Fatalf("Failed to add: %v", err)
+			}
+			if _, err := g.commit("signed commit"); err != nil {
+				t.Fatalf("Failed to commit: %v", err)
+			}
+			if _, err := g.push("signed"); err != nil {
+				t.Fatalf("Failed to push: %v", err)
+			}
+
+			// Verify the signature of the pushed commit in a fresh clone of the bare repository.
+			verifyArgs := verifyCommitArgs(t, tc.format, pub)
+			if _, err := exec.LookPath(gitBin); err != nil {
+				t.Skip("git binary not available")
+			}
+			clone := t.TempDir()
+			mustRunGit(t, "", "clone", "--branch", "signed", bare, clone)
+			mustRunGit(t, clone, verifyArgs...)
+		})
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Columns of the source of truth used by the deployer.
+const (
+	clusterNameColumn      = "cluster_name"
+	clusterGroupColumn     = "cluster_group"
+	clusterTagsColumn      = "cluster_tags"
+	platformRevisionColumn = "platform_repository_revision"
+	workloadRevisionColumn = "workload_repository_revision"
+)
+
+// Formats of the source of truth.
+const (
+	sotFormatCSV     = "csv"
+	sotFormatYAML    = "yaml"
+	sotFormatJSON    = "json"
+	sotFormatYAMLDir = "yaml-dir"
+)
+
+// sotColumns are the columns every source of truth provides, in the order of the CSV written for the hydration
+// tool.
+var sotColumns = []string{clusterNameColumn, clusterGroupColumn, clusterTagsColumn, platformRevisionColumn, workloadRevisionColumn}
+
+// sourceOfTruth stores the clusters of the fleet with their platform and workload revisions. The source of truth
+// is read from disk by every method, so it reflects resets of the git workspace.
+type sourceOfTruth interface {
+	// load reads the clusters. Problems with the structure of the source of truth, e.g. rows with missing
+	// fields, are returned rather than failing on the first.
+	load() (*sotTable, []sotProblem, error)
+	// selectClusters returns the names of the clusters in the cluster group, having any of the anyTags or all
+	// of the allTags if provided, and for which the expression is true if not nil. The filter, if not nil, is
+	// applied to these clusters and the clusters it excludes are returned as well.
+	selectClusters(clusterGroup string, anyTags, allTags []string, expression selectorExpr, filter *clusterFilter) ([]string, []clusterExclusion, error)
+	// updateRevisions sets the non-empty revisions of the named clusters and saves the source of truth.
+	updateRevisions(clusterNames []string, platformRevision, workloadRevision string) error
+	// hydrationInput returns the path of the CSV source of truth read by the hydration tool. It is written into
+	// dir unless the source of truth already is a CSV file.
+	hydrationInput(dir string) (string, error)
+}
+
+// sotTable is the content of a source of truth as a table, as read by the hydration tool.
+type sotTable struct {
+	columns  []string
+	clusters []*sotCluster
+}
+
+// sotCluster is a cluster of the source of truth.
+type sotCluster struct {
+	// File of the cluster, relative to a source of truth directory.
+	file string
+	// 1-based line number of the cluster in the source of truth.
+	line int
+	// Fields of the cluster by column.
+	fields map[string]string
+}
+
+func (c *sotCluster) name() string {
+	return c.fields[clusterNameColumn]
+}
+
+// sotProblem is a problem found in the source of truth.
+type sotProblem struct {
+	// File of the problem, relative to a source of truth directory.
+	file string
+	// 1-based line number of the problem in the source of truth.
+	line    int
+	message string
+}
+
+// sotValidationError reports every problem found in the source of truth.
+type sotValidationError struct {
+	path     string
+	problems []sotProblem
+}
+
+func (e *sotValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "source of truth %s is invalid:", e.path)
+	for _, p := range e.problems {
+		b.WriteString("\n  ")
+		if len(p.file) != 0 {
+			fmt.Fprintf(&b, "%s ", p.file)
+		}
+		fmt.Fprintf(&b, "line %d: %s", p.line, p.message)
+	}
+	return b.String()
+}
+
+// openSourceOfTruth returns the source of truth at the path relative to repoDir. The format is one of
+// sotFormatCSV, sotFormatYAML, sotFormatJSON or sotFormatYAMLDir; if empty it is determined by the extension
+// of the path, or is sotFormatYAMLDir for a directory.
+func openSourceOfTruth(repoDir, path, format string) (sourceOfTruth, error) {
+	fullPath := filepath.Join(repoDir, path)
+	if len(format) == 0 {
+		format = sotFormat(fullPath)
+	}
+	switch format {
+	case sotFormatCSV:
+		return &csvSourceOfTruth{repoDir: repoDir, path: path}, nil
+	case sotFormatYAML, sotFormatJSON:
+		return &yamlSourceOfTruth{path: fullPath, json: format == sotFormatJSON}, nil
+	case sotFormatYAMLDir:
+		return &yamlDirSourceOfTruth{dir: fullPath}, nil
+	default:
+		return nil, fmt.Errorf("unable to determine the format of source of truth %s, must be one of %s, %s, %s or %s", path, sotFormatCSV, sotFormatYAML, sotFormatJSON, sotFormatYAMLDir)
+	}
+}
+
+// sotFormat returns the format of the source of truth at path, based on its extension.
+func sotFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return sotFormatCSV
+	case ".yaml", ".yml":
+		return sotFormatYAML
+	case ".json":
+		return sotFormatJSON
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return sotFormatYAMLDir
+	}
+	return ""
+}
+
+// validateSourceOfTruth checks that the source of truth has the required columns, every cluster has a unique
+// name and a cluster group, and that the tags and revisions are well-formed. Returns a *sotValidationError
+// reporting every problem found.
+func validateSourceOfTruth(sot sourceOfTruth, path string) error {
+	table, problems, err := sot.load()
+	if err != nil {
+		return err
+	}
+	if table != nil {
+		problems = append(problems, validateClusters(table.clusters)...)
+	}
+	if len(problems) != 0 {
+		return &sotValidationError{path: path, problems: problems}
+	}
+	return nil
+}
+
+// selectTableClusters returns the names of the clusters of the table in the cluster group, having any of the
+// anyTags or all of the allTags if provided, and for which the expression is true if not nil. The filter, if
+// not nil, is applied to these clusters and the clusters it excludes are returned as well.
+func selectTableClusters(table *sotTable, clusterGroup string, anyTags, allTags []string, expression selectorExpr, filter *clusterFilter) ([]string, []clusterExclusion, error) {
+	selection := newClusterSelection(filter)
+	for _, c := range table.clusters {
+		if c.fields[clusterGroupColumn] != clusterGroup {
+			continue
+		}
+		tags := splitTags(c.fields[clusterTagsColumn])
+		if expression != nil {
+			// Every column of the table is compared, even if the cluster has no value for it.
+			fields := map[string]string{}
+			for _, col := range table.columns {
+				fields[col] = c.fields[col]
+			}
+			if !expression.matches(&selectorCluster{tags: tags, fields: fields}) {
+				continue
+			}
+		}
+		switch {
+		case len(anyTags) > 0 && !matchesAnyTags(tags, anyTags):
+		case len(anyTags) == 0 && len(allTags) > 0 && !matchesAllTags(tags, allTags):
+		default:
+			selection.add(c.name(), tags)
+		}
+	}
+	return selection.result()
+}
+
+// writeHydrationCSV writes the clusters of the table to a CSV file at path, for the hydration tool.
+func writeHydrationCSV(table *sotTable, path string) error {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	if err := w.Write(table.columns); err != nil {
+		return err
+	}
+	for _, c := range table.clusters {
+		record := make([]string, len(table.columns))
+		for i, col := range table.columns {
+			record[i] = c.fields[col]
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b.Bytes(), 0644)
+}
+
+// csvSourceOfTruth is a source of truth in a CSV file with a header row.
+type csvSourceOfTruth struct {
+	repoDir string
+	// Path of the file relative to repoDir.
+	path string
+}
+
+// load reads the clusters of the CSV file. Missing columns and rows with the wrong number of fields are
+// reported as problems.
+func (s *csvSourceOfTruth) load() (*sotTable, []sotProblem, error) {
+	f, err := os.Open(filepath.Join(s.repoDir, s.path))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = csvCommentChar
+	// Rows with the wrong number of fields are reported as problems.
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, []sotProblem{{line: 1, message: "file is empty, expected a header"}}, nil
+	}
+	if err != nil {
+		return nil, csvProblem(err), nil
+	}
+	if _, err := findFieldIndices(header, sotColumns...); err != nil {
+		return nil, []sotProblem{{line: 1, message: err.Error()}}, nil
+	}
+
+	table := &sotTable{columns: header}
+	var problems []sotProblem
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The position in the file is unknown after a parse error, so reading stops.
+			return table, append(problems, csvProblem(err)...), nil
+		}
+		line, _ := r.FieldPos(0)
+		if len(record) != len(header) {
+			problems = append(problems, sotProblem{line: line, message: fmt.Sprintf("has %d fields, expected %d", len(record), len(header))})
+			continue
+		}
+		c := &sotCluster{line: line, fields: map[string]string{}}
+		for i, col := range header {
+			c.fields[col] = record[i]
+		}
+		table.clusters = append(table.clusters, c)
+	}
+	return table, problems, nil
+}
+
+func (s *csvSourceOfTruth) selectClusters(clusterGroup string, anyTags, allTags []string, expression selectorExpr, filter *clusterFilter) ([]string, []clusterExclusion, error) {
+	return selectLoadedClusters(s, s.path, clusterGroup, anyTags, allTags, expression, filter)
+}
+
+func (s *csvSourceOfTruth) updateRevisions(clusterNames []string, platformRevision, workloadRevision string) error {
+	return updatePlatformAndWorkloadRepositoryRevision(s.repoDir, clusterNames, s.path, platformRevision, workloadRevision)
+}
+
+// hydrationInput returns the path of the CSV file, unless it contains comment rows, which are removed from a
+// copy written into dir.
+func (s *csvSourceOfTruth) hydrationInput(dir string) (string, error) {
+	path := filepath.Join(s.repoDir, s.path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	stripped, err := stripCSVComments(data)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Equal(data, stripped) {
+		return path, nil
+	}
+	path = filepath.Join(dir, defaultSourceOfTruth)
+	return path, os.WriteFile(path, stripped, 0644)
+}
+
+// csvProblem returns the problem for a CSV parse error.
+func csvProblem(err error) []sotProblem {
+	var pErr *csv.ParseError
+	if errors.As(err, &pErr) {
+		return []sotProblem{{line: pErr.Line, message: pErr.Err.Error()}}
+	}
+	return []sotProblem{{line: 1, message: err.Error()}}
+}
+
+// validateClusters checks the fields of the clusters and that their names are unique.
+func validateClusters(clusters []*sotCluster) []sotProblem {
+	var problems []sotProblem
+	add := func(c *sotCluster, format string, a ...any) {
+		problems = append(problems, sotProblem{file: c.file, line: c.line, message: fmt.Sprintf(format, a...)})
+	}
+	type position struct {
+		file string
+		line int
+	}
+	names := map[string]position{}
+	for _, c := range clusters {
+		switch first, ok := names[c.name()]; {
+		case len(c.name()) == 0:
+			add(c, "%s is empty", clusterNameColumn)
+		case ok && first.file != c.file:
+			add(c, "duplicate %s %q, first defined in %s line %d", clusterNameColumn, c.name(), first.file, first.line)
+		case ok:
+			add(c, "duplicate %s %q, first defined on line %d", clusterNameColumn, c.name(), first.line)
+		default:
+			names[c.name()] = position{file: c.file, line: c.line}
+		}
+		if len(strings.TrimSpace(c.fields[clusterGroupColumn])) == 0 {
+			add(c, "%s is empty", clusterGroupColumn)
+		}
+		if tags := c.fields[clusterTagsColumn]; validateTags(tags) != nil {
+			add(c, "%s %q is malformed: %v", clusterTagsColumn, tags, validateTags(tags))
+		}
+		for _, col := range []string{platformRevisionColumn, workloadRevisionColumn} {
+			if err := validateRevision(c.fields[col]); err != nil {
+				add(c, "%s %q is malformed: %v", col, c.fields[col], err)
+			}
+		}
+	}
+	return problems
+}
+
+// splitTags returns the comma separated tags of a cluster, which may be quoted.
+func splitTags(tags string) []string {
+	return strings.Split(strings.Trim(tags, "\""), ",")
+}
+
+// validateTags checks the comma separated tags of a cluster, which may be empty, for empty tags and tags
+// containing whitespace.
+func validateTags(tags string) error {
+	tags = strings.Trim(tags, "\"")
+	if len(tags) == 0 {
+		return nil
+	}
+	for _, tag := range strings.Split(tags, ",") {
+		if len(tag) == 0 {
+			return fmt.Errorf("empty tag")
+		}
+		if strings.IndexFunc(tag, unicode.IsSpace) != -1 {
+			return fmt.Errorf("tag %q contains whitespace", tag)
+		}
+	}
+	return nil
+}
+
+// validateRevision checks that the revision, which may be empty, is a valid Git tag, branch or commit hash.
+// It follows the rules of `git check-ref-format`.
+func validateRevision(rev string) error {
+	if len(rev) == 0 {
+		return nil
+	}
+	if i := strings.IndexFunc(rev, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }); i != -1 {
+		return fmt.Errorf("contains whitespace or control characters")
+	}
+	if i := strings.IndexAny(rev, "~^:?*[\\"); i != -1 {
+		return fmt.Errorf("contains %q", rev[i])
+	}
+	for _, s := range []string{"..", "@{", "//", "/."} {
+		if strings.Contains(rev, s) {
+			return fmt.Errorf("contains %q", s)
+		}
+	}
+	if strings.HasPrefix(rev, "-") || strings.HasPrefix(rev, "/") || strings.HasPrefix(rev, ".") {
+		return fmt.Errorf("starts with %q", rev[0])
+	}
+	if strings.HasSuffix(rev, "/") || strings.HasSuffix(rev, ".") || strings.HasSuffix(rev, ".lock") || rev == "@" {
+		return fmt.Errorf("is not a valid reference name")
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestValidateSourceOfTruth(t *testing.T) {
+	const header = "cluster_name,cluster_group,cluster_tags,platform_repository_revision,workload_repository_revision\n"
+	testCases := []struct {
+		name             string
+		content          string
+		expectedProblems []sotProblem
+	}{
+		{
+			name:    "Valid",
+			content: header + "cluster1,prod,\"us,eu\",v1.0.0,main\ncluster2,dev,,,\n",
+		},
+		{
+			name:             "Empty file",
+			content:          "",
+			expectedProblems: []sotProblem{{line: 1, message: "file is empty, expected a header"}},
+		},
+		{
+			name:             "Missing columns",
+			content:          "cluster_name,cluster_group,cluster_tags\ncluster1,prod,us\n",
+			expectedProblems: []sotProblem{{line: 1, message: `fields ["platform_repository_revision" "workload_repository_revision"] not found in header`}},
+		},
+		{
+			name:    "Every problem is reported",
+			content: header + "cluster1,prod,us,v1,v1\ncluster2,prod\n,prod,us,v1,v1\ncluster1,,us,v1,v1\ncluster3,prod,\"us,,eu\",v1,v1\ncluster4,prod,\"us, eu\",v 1,-v1\n",
+			expectedProblems: []sotProblem{
+				{line: 3, message: "has 2 fields, expected 5"},
+				{line: 4, message: "cluster_name is empty"},
+				{line: 5, message: `duplicate cluster_name "cluster1", first defined on line 2`},
+				{line: 5, message: "cluster_group is empty"},
+				{line: 6, message: `cluster_tags "us,,eu" is malformed: empty tag`},
+				{line: 7, message: `cluster_tags "us, eu" is malformed: tag " eu" contains whitespace`},
+				{line: 7, message: `platform_repository_revision "v 1" is malformed: contains whitespace or control characters`},
+				{line: 7, message: `workload_repository_revision "-v1" is malformed: starts with '-'`},
+			},
+		},
+		{
+			name:             "Comment rows keep line numbers",
+			content:          "# Fleet inventory\n" + header + "\n# Production\ncluster1,prod,us,v1,v1\ncluster1,prod,us,v1,v1\n",
+			expectedProblems: []sotProblem{{line: 6, message: `duplicate cluster_name "cluster1", first defined on line 5`}},
+		},
+		{
+			name:    "Parse error",
+			content: header + "cluster1,prod,us,v1,v1\ncluster2,\"prod,us,v1,v1\n",
+			expectedProblems: []sotProblem{
+				{line: 3, message: `extraneous or missing " in quoted-field`},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestFile(t, dir, "sot.csv", tc.content)
+
+			sot, err := openSourceOfTruth(dir, "sot.csv", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = validateSourceOfTruth(sot, "sot.csv")
+			if len(tc.expectedProblems) == 0 {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			var vErr *sotValidationError
+			if !errors.As(err, &vErr) {
+				t.Fatalf("Expected validation error, got: %v", err)
+			}
+			if !reflect.DeepEqual(vErr.problems, tc.expectedProblems) {
+				t.Errorf("Problems mismatch\nExpected: %+v\n     Got: %+v", tc.expectedProblems, vErr.problems)
+			}
+		})
+	}
+}
+
+func TestValidateRevision(t *testing.T) {
+	for _, rev := range []string{"", "v1.2.3", "main", "release/2024-01", "0a1b2c3d"} {
+		if err := validateRevision(rev); err != nil {
+			t.Errorf("Expected revision %q to be valid, got: %v", rev, err)
+		}
+	}
+	for _, rev := range []string{"v1..2", "main~1", "feature/", "a.lock", "@", "a//b", "ref@{1}", "tab\tname"} {
+		if err := validateRevision(rev); err == nil {
+			t.Errorf("Expected revision %q to be invalid", rev)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlSourceOfTruth is a source of truth in a single YAML or JSON file, containing a list of clusters. Each
+// cluster is a mapping with the columns of the CSV source of truth as keys, e.g.:
+//
+//	# clusters.yaml
+//	- cluster_name: cluster1
+//	  cluster_group: prod
+//	  cluster_tags: [us, canary]
+//	  platform_repository_revision: v1.0.0
+//	  labels:
+//	    region: us-central1
+//
+// Nested mappings are flattened to dotted keys, e.g. labels.region, and lists are joined with commas.
+type yamlSourceOfTruth struct {
+	path string
+	// Whether the file is saved as JSON rather than YAML.
+	json bool
+}
+
+// parse returns the document of the file and the mappings of its clusters.
+func (s *yamlSourceOfTruth) parse() (*yaml.Node, []*yaml.Node, []sotProblem, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, []sotProblem{{line: 1, message: err.Error()}}, nil
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil, []sotProblem{{line: 1, message: "file is empty, expected a list of clusters"}}, nil
+	}
+	list := doc.Content[0]
+	if list.Kind != yaml.SequenceNode {
+		return nil, nil, []sotProblem{{line: list.Line, message: "expected a list of clusters"}}, nil
+	}
+	return &doc, list.Content, nil, nil
+}
+
+// load reads the clusters of the file.
+func (s *yamlSourceOfTruth) load() (*sotTable, []sotProblem, error) {
+	_, nodes, problems, err := s.parse()
+	if err != nil || nodes == nil {
+		return nil, problems, err
+	}
+	table, problems := newYAMLTable("", nodes)
+	return table, problems, nil
+}
+
+func (s *yamlSourceOfTruth) selectClusters(clusterGroup string, anyTags, allTags []string, expression selectorExpr, filter *clusterFilter) ([]string, []clusterExclusion, error) {
+	return selectLoadedClusters(s, s.path, clusterGroup, anyTags, allTags, expression, filter)
+}
+
+// updateRevisions sets the revisions of the clusters in the parsed document, so comments and the order of keys
+// are kept, and saves the file.
+func (s *yamlSourceOfTruth) updateRevisions(clusterNames []string, platformRevision, workloadRevision string) error {
+	doc, nodes, problems, err := s.parse()
+	if err != nil {
+		return err
+	}
+	if len(problems) != 0 {
+		return &sotValidationError{path: s.path, problems: problems}
+	}
+	for _, n := range nodes {
+		setYAMLRevisions(n, clusterNames, platformRevision, workloadRevision)
+	}
+	data, err := encodeYAMLDocument(doc, s.json)
+	if err != nil {
+		return fmt.Errorf("error encoding source of truth: %v", err)
+	}
+	return os.WriteFile(s.path, data, 0644)
+}
+
+func (s *yamlSourceOfTruth) hydrationInput(dir string) (string, error) {
+	return exportHydrationCSV(s, s.path, dir)
+}
+
+// yamlDirSourceOfTruth is a source of truth in a directory with a YAML file per cluster. Each file contains a
+// single cluster mapping as described for yamlSourceOfTruth.
+type yamlDirSourceOfTruth struct {
+	dir string
+}
+
+// yamlClusterFile is a cluster file of a yamlDirSourceOfTruth.
+type yamlClusterFile struct {
+	// Path of the file relative to the directory.
+	file string
+	doc  *yaml.Node
+}
+
+// parse returns the cluster files of the directory, in lexical order of their paths.
+func (s *yamlDirSourceOfTruth) parse() ([]*yamlClusterFile, []sotProblem, error) {
+	var files []*yamlClusterFile
+	var problems []sotProblem
+	err := filepath.WalkDir(s.dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() || (filepath.Ext(path) != ".yaml" && filepath.Ext(path) != ".yml") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			problems = append(problems, sotProblem{file: rel, line: 1, message: err.Error()})
+			return nil
+		}
+		if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+			problems = append(problems, sotProblem{file: rel, line: 1, message: "expected a mapping of cluster fields"})
+			return nil
+		}
+		files = append(files, &yamlClusterFile{file: rel, doc: &doc})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return files, problems, nil
+}
+
+// load reads the clusters of the files in the directory.
+func (s *yamlDirSourceOfTruth) load() (*sotTable, []sotProblem, error) {
+	files, problems, err := s.parse()
+	if err != nil {
+		return nil, nil, err
+	}
+	table := &sotTable{columns: slices.Clone(sotColumns)}
+	for _, f := range files {
+		t, p := newYAMLTable(f.file, f.doc.Content)
+		problems = append(problems, p...)
+		table.clusters = append(table.clusters, t.clusters...)
+		for _, col := range t.columns {
+			if !slices.Contains(table.columns, col) {
+				table.columns = append(table.columns, col)
+			}
+		}
+	}
+	return table, problems, nil
+}
+
+func (s *yamlDirSourceOfTruth) selectClusters(clusterGroup string, anyTags, allTags []string, expression selectorExpr, filter *clusterFilter) ([]string, []clusterExclusion, error) {
+	return selectLoadedClusters(s, s.dir, clusterGroup, anyTags, allTags, expression, filter)
+}
+
+// updateRevisions sets the revisions of the clusters and saves the files that changed.
+func (s *yamlDirSourceOfTruth) updateRevisions(clusterNames []string, platformRevision, workloadRevision string) error {
+	files, problems, err := s.parse()
+	if err != nil {
+		return err
+	}
+	if len(problems) != 0 {
+		return &sotValidationError{path: s.dir, problems: problems}
+	}
+	for _, f := range files {
+		if !setYAMLRevisions(f.doc.Content[0], clusterNames, platformRevision, workloadRevision) {
+			continue
+		}
+		data, err := encodeYAMLDocument(f.doc, false)
+		if err != nil {
+			return fmt.Errorf("error encoding cluster file %s: %v", f.file, err)
+		}
+		if err := os.WriteFile(filepath.Join(s.dir, f.file), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *yamlDirSourceOfTruth) hydrationInput(dir string) (string, error) {
+	return exportHydrationCSV(s, s.dir, dir)
+}
+
+// newYAMLTable returns the table of the cluster mappings in file. The columns are the columns of the CSV
+// source of truth followed by the other keys in order of appearance.
+func newYAMLTable(file string, nodes []*yaml.Node) (*sotTable, []sotProblem) {
+	table := &sotTable{columns: slices.Clone(sotColumns)}
+	var problems []sotProblem
+	for _, n := range nodes {
+		if n.Kind != yaml.MappingNode {
+			problems = append(problems, sotProblem{file: file, line: n.Line, message: "expected a mapping of cluster fields"})
+			continue
+		}
+		c := &sotCluster{file: file, line: n.Line, fields: map[string]string{}}
+		problems = append(problems, flattenYAMLMapping(c, "", n)...)
+		for _, col := range yamlKeys("", n) {
+			if !slices.Contains(table.columns, col) {
+				table.columns = append(table.columns, col)
+			}
+		}
+		table.clusters = append(table.clusters, c)
+	}
+	return table, problems
+}
+
+// flattenYAMLMapping sets the fields of the cluster from the mapping, with the keys of nested mappings joined
+// by dots and lists joined by commas.
+func flattenYAMLMapping(c *sotCluster, prefix string, n *yaml.Node) []sotProblem {
+	var problems []sotProblem
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := prefix+n.Content[i].Value, n.Content[i+1]
+		switch value.Kind {
+		case yaml.ScalarNode:
+			if value.Tag != "!!null" {
+				c.fields[key] = value.Value
+			}
+		case yaml.MappingNode:
+			problems = append(problems, flattenYAMLMapping(c, key+".", value)...)
+		case yaml.SequenceNode:
+			var items []string
+			for _, item := range value.Content {
+				if item.Kind != yaml.ScalarNode {
+					problems = append(problems, sotProblem{file: c.file, line: item.Line, message: fmt.Sprintf("%s must be a list of strings", key)})
+					break
+				}
+				items = append(items, item.Value)
+			}
+			c.fields[key] = strings.Join(items, ",")
+		default:
+			problems = append(problems, sotProblem{file: c.file, line: value.Line, message: fmt.Sprintf("%s has an unsupported value", key)})
+		}
+	}
+	return problems
+}
+
+// yamlKeys returns the flattened keys of the mapping in order of appearance.
+func yamlKeys(prefix string, n *yaml.Node) []string {
+	var keys []string
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key := prefix + n.Content[i].Value
+		if n.Content[i+1].Kind == yaml.MappingNode {
+			keys = append(keys, yamlKeys(key+".", n.Content[i+1])...)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// setYAMLRevisions sets the non-empty revisions of the cluster mapping if it is one of the named clusters.
+// Returns whether the mapping is one of the named clusters.
+func setYAMLRevisions(n *yaml.Node, clusterNames []string, platformRevision, workloadRevision string) bool {
+	if n.Kind != yaml.MappingNode {
+		return false
+	}
+	name := yamlMappingValue(n, clusterNameColumn)
+	if name == nil || !slices.Contains(clusterNames, name.Value) {
+		return false
+	}
+	for _, r := range []struct{ col, rev string }{{platformRevisionColumn, platformRevision}, {workloadRevisionColumn, workloadRevision}} {
+		col, rev := r.col, r.rev
+		if len(rev) == 0 {
+			continue
+		}
+		value := yamlMappingValue(n, col)
+		if value == nil {
+			value = &yaml.Node{}
+			n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: col}, value)
+		}
+		// Revisions are always strings, so e.g. 1.10 is quoted rather than becoming a number.
+		*value = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: rev, LineComment: value.LineComment}
+	}
+	return true
+}
+
+// yamlMappingValue returns the value of the key in the mapping, or nil if it has no such key.
+func yamlMappingValue(n *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// encodeYAMLDocument encodes the document as YAML with an indent of two spaces, or as indented JSON.
+func encodeYAMLDocument(doc *yaml.Node, asJSON bool) ([]byte, error) {
+	var b bytes.Buffer
+	if asJSON {
+		if err := writeJSONNode(&b, doc.Content[0]); err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		if err := json.Indent(&out, b.Bytes(), "", "  "); err != nil {
+			return nil, err
+		}
+		out.WriteByte('\n')
+		return out.Bytes(), nil
+	}
+	e := yaml.NewEncoder(&b)
+	e.SetIndent(2)
+	if err := e.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// writeJSONNode writes the node as compact JSON, keeping the order of mapping keys. Unlike encoding/json,
+// which sorts the keys of maps, this keeps the diff of a saved source of truth to the changed values.
+func writeJSONNode(b *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.MappingNode:
+		b.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			key, _ := json.Marshal(n.Content[i].Value)
+			b.Write(key)
+			b.WriteByte(':')
+			if err := writeJSONNode(b, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+	case yaml.SequenceNode:
+		b.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if err := writeJSONNode(b, item); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+	case yaml.ScalarNode:
+		switch n.Tag {
+		case "!!null":
+			b.WriteString("null")
+		case "!!bool", "!!int", "!!float":
+			b.WriteString(n.Value)
+		default:
+			value, _ := json.Marshal(n.Value)
+			b.Write(value)
+		}
+	default:
+		return fmt.Errorf("unsupported node on line %d", n.Line)
+	}
+	return nil
+}
+
+// selectLoadedClusters loads the source of truth and selects the clusters of the table.
+func selectLoadedClusters(sot sourceOfTruth, path, clusterGroup string, anyTags, allTags []string, expression selectorExpr, filter *clusterFilter) ([]string, []clusterExclusion, error) {
+	table, problems, err := sot.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(problems) != 0 {
+		return nil, nil, &sotValidationError{path: path, problems: problems}
+	}
+	return selectTableClusters(table, clusterGroup, anyTags, allTags, expression, filter)
+}
+
+// exportHydrationCSV writes the source of truth as CSV into dir for the hydration tool and returns its path.
+func exportHydrationCSV(sot sourceOfTruth, path, dir string) (string, error) {
+	table, problems, err := sot.load()
+	if err != nil {
+		return "", err
+	}
+	if len(problems) != 0 {
+		return "", &sotValidationError{path: path, problems: problems}
+	}
+	csvPath := filepath.Join(dir, defaultSourceOfTruth)
+	if err := writeHydrationCSV(table, csvPath); err != nil {
+		return "", fmt.Errorf("error writing source of truth CSV: %v", err)
+	}
+	return csvPath, nil
+}
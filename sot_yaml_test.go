@@ -0,0 +1,324 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const yamlSourceOfTruthContent = `# Fleet inventory
+- cluster_name: cluster1
+  cluster_group: prod
+  cluster_tags: [us, canary]
+  platform_repository_revision: v1
+  workload_repository_revision: v1 # pinned
+  labels:
+    region: us-central1
+- cluster_name: cluster2
+  cluster_group: prod
+  cluster_tags: eu
+  platform_repository_revision: "1.10"
+- cluster_name: cluster3
+  cluster_group: dev
+`
+
+const jsonSourceOfTruthContent = `[
+  {"cluster_name": "cluster1", "cluster_group": "prod", "cluster_tags": ["us", "canary"], "platform_repository_revision": "v1", "workload_repository_revision": "v1", "labels": {"region": "us-central1"}},
+  {"cluster_name": "cluster2", "cluster_group": "prod", "cluster_tags": "eu", "platform_repository_revision": "1.10", "replicas": 3},
+  {"cluster_name": "cluster3", "cluster_group": "dev"}
+]
+`
+
+func TestYAMLSourceOfTruth(t *testing.T) {
+	testCases := []struct {
+		name     string
+		format   string
+		path     string
+		files    map[string]string
+		expected map[string]string
+	}{
+		{
+			name:   "YAML",
+			path:   "clusters.yaml",
+			files:  map[string]string{"clusters.yaml": yamlSourceOfTruthContent},
+			format: sotFormatYAML,
+			expected: map[string]string{"clusters.yaml": `# Fleet inventory
+- cluster_name: cluster1
+  cluster_group: prod
+  cluster_tags: [us, canary]
+  platform_repository_revision: v2
+  workload_repository_revision: v1 # pinned
+  labels:
+    region: us-central1
+- cluster_name: cluster2
+  cluster_group: prod
+  cluster_tags: eu
+  platform_repository_revision: v2
+- cluster_name: cluster3
+  cluster_group: dev
+`},
+		},
+		{
+			name:   "JSON",
+			path:   "clusters.json",
+			files:  map[string]string{"clusters.json": jsonSourceOfTruthContent},
+			format: sotFormatJSON,
+			expected: map[string]string{"clusters.json": `[
+  {
+    "cluster_name": "cluster1",
+    "cluster_group": "prod",
+    "cluster_tags": [
+      "us",
+      "canary"
+    ],
+    "platform_repository_revision": "v2",
+    "workload_repository_revision": "v1",
+    "labels": {
+      "region": "us-central1"
+    }
+  },
+  {
+    "cluster_name": "cluster2",
+    "cluster_group": "prod",
+    "cluster_tags": "eu",
+    "platform_repository_revision": "v2",
+    "replicas": 3
+  },
+  {
+    "cluster_name": "cluster3",
+    "cluster_group": "dev"
+  }
+]
+`},
+		},
+		{
+			name: "YAML directory",
+			path: "clusters",
+			files: map[string]string{
+				"clusters/cluster1.yaml":    "cluster_name: cluster1\ncluster_group: prod\ncluster_tags: [us, canary]\nplatform_repository_revision: v1\nworkload_repository_revision: v1\nlabels:\n  region: us-central1\n",
+				"clusters/eu/cluster2.yml":  "cluster_name: cluster2\ncluster_group: prod\ncluster_tags: eu\n",
+				"clusters/us/cluster3.yaml": "cluster_name: cluster3\ncluster_group: dev\n",
+				"clusters/README.md":        "Fleet inventory\n",
+			},
+			format: sotFormatYAMLDir,
+			expected: map[string]string{
+				"clusters/cluster1.yaml":    "cluster_name: cluster1\ncluster_group: prod\ncluster_tags: [us, canary]\nplatform_repository_revision: v2\nworkload_repository_revision: v1\nlabels:\n  region: us-central1\n",
+				"clusters/eu/cluster2.yml":  "cluster_name: cluster2\ncluster_group: prod\ncluster_tags: eu\nplatform_repository_revision: v2\n",
+				"clusters/us/cluster3.yaml": "cluster_name: cluster3\ncluster_group: dev\n",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tc.files {
+				writeTestFile(t, dir, name, content)
+			}
+			if got := sotFormat(filepath.Join(dir, tc.path)); got != tc.format {
+				t.Errorf("Expected format %s, got: %s", tc.format, got)
+			}
+			sot, err := openSourceOfTruth(dir, tc.path, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := validateSourceOfTruth(sot, tc.path); err != nil {
+				t.Fatalf("Unexpected validation error: %v", err)
+			}
+
+			clusters, _, err := sot.selectClusters("prod", []string{"canary", "eu"}, nil, nil, nil)
+			if err != nil {
+				t.Fatalf("Failed to select clusters: %v", err)
+			}
+			if want := []string{"cluster1", "cluster2"}; !reflect.DeepEqual(clusters, want) {
+				t.Errorf("Selected clusters mismatch\nExpected: %v\n     Got: %v", want, clusters)
+			}
+
+			if err := sot.updateRevisions(clusters, "v2", ""); err != nil {
+				t.Fatalf("Failed to update revisions: %v", err)
+			}
+			for name, want := range tc.expected {
+				got, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("Updated %s mismatch\nExpected: %s\n     Got: %s", name, want, got)
+				}
+			}
+
+			workspace := t.TempDir()
+			csvPath, err := sot.hydrationInput(workspace)
+			if err != nil {
+				t.Fatalf("Failed to write hydration input: %v", err)
+			}
+			records, err := readCSV(csvPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 4 || filepath.Dir(csvPath) != workspace {
+				t.Errorf("Unexpected hydration input %s: %v", csvPath, records)
+			}
+		})
+	}
+}
+
+func TestWriteHydrationCSV(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "clusters.yaml", yamlSourceOfTruthContent)
+	sot, err := openSourceOfTruth(dir, "clusters.yaml", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csvPath, err := sot.hydrationInput(dir)
+	if err != nil {
+		t.Fatalf("Failed to write hydration input: %v", err)
+	}
+	got, err := os.ReadFile(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "cluster_name,cluster_group,cluster_tags,platform_repository_revision,workload_repository_revision,labels.region\n" +
+		"cluster1,prod,\"us,canary\",v1,v1,us-central1\n" +
+		"cluster2,prod,eu,1.10,,\n" +
+		"cluster3,dev,,,,\n"
+	if string(got) != want {
+		t.Errorf("Hydration input mismatch\nExpected: %s\n     Got: %s", want, got)
+	}
+}
+
+func TestYAMLSourceOfTruthProblems(t *testing.T) {
+	testCases := []struct {
+		name             string
+		path             string
+		files            map[string]string
+		expectedProblems []sotProblem
+	}{
+		{
+			name:             "Empty file",
+			path:             "clusters.yaml",
+			files:            map[string]string{"clusters.yaml": ""},
+			expectedProblems: []sotProblem{{line: 1, message: "file is empty, expected a list of clusters"}},
+		},
+		{
+			name:             "Not a list",
+			path:             "clusters.json",
+			files:            map[string]string{"clusters.json": "{\"cluster_name\": \"cluster1\"}\n"},
+			expectedProblems: []sotProblem{{line: 1, message: "expected a list of clusters"}},
+		},
+		{
+			name: "Every problem is reported",
+			path: "clusters.yaml",
+			files: map[string]string{"clusters.yaml": `- cluster_name: cluster1
+  cluster_group: prod
+- cluster_name: cluster1
+  cluster_group: ""
+- just a string
+- cluster_name: cluster2
+  cluster_group: prod
+  cluster_tags: [us, {region: eu}]
+  platform_repository_revision: v..1
+`},
+			expectedProblems: []sotProblem{
+				{line: 5, message: "expected a mapping of cluster fields"},
+				{line: 8, message: "cluster_tags must be a list of strings"},
+				{line: 3, message: `duplicate cluster_name "cluster1", first defined on line 1`},
+				{line: 3, message: "cluster_group is empty"},
+				{line: 6, message: `platform_repository_revision "v..1" is malformed: contains ".."`},
+			},
+		},
+		{
+			name: "YAML directory",
+			path: "clusters",
+			files: map[string]string{
+				"clusters/a.yaml": "cluster_name: cluster1\ncluster_group: prod\n",
+				"clusters/b.yaml": "- cluster_name: cluster2\n",
+				"clusters/c.yaml": "\n\ncluster_name: cluster1\ncluster_group: dev\n",
+			},
+			expectedProblems: []sotProblem{
+				{file: "b.yaml", line: 1, message: "expected a mapping of cluster fields"},
+				{file: "c.yaml", line: 3, message: `duplicate cluster_name "cluster1", first defined in a.yaml line 1`},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tc.files {
+				writeTestFile(t, dir, name, content)
+			}
+			sot, err := openSourceOfTruth(dir, tc.path, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var vErr *sotValidationError
+			if err := validateSourceOfTruth(sot, tc.path); !errors.As(err, &vErr) {
+				t.Fatalf("Expected validation error, got: %v", err)
+			}
+			if !reflect.DeepEqual(vErr.problems, tc.expectedProblems) {
+				t.Errorf("Problems mismatch\nExpected: %+v\n     Got: %+v", tc.expectedProblems, vErr.problems)
+			}
+		})
+	}
+}
+
+func TestOpenSourceOfTruthFormat(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "clusters.txt", yamlSourceOfTruthContent)
+
+	if _, err := openSourceOfTruth(dir, "clusters.txt", ""); err == nil {
+		t.Error("Expected error for unknown source of truth format")
+	}
+	sot, err := openSourceOfTruth(dir, "clusters.txt", sotFormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateSourceOfTruth(sot, "clusters.txt"); err != nil {
+		t.Errorf("Unexpected validation error: %v", err)
+	}
+}
+
+func TestCSVSourceOfTruthHydrationInput(t *testing.T) {
+	dir, workspace := t.TempDir(), t.TempDir()
+	content := "cluster_name,cluster_group,cluster_tags,platform_repository_revision,workload_repository_revision\ncluster1,prod,us,v1,v1\n"
+	writeTestFile(t, dir, "plain.csv", content)
+	writeTestFile(t, dir, "commented.csv", "# Fleet inventory\n"+content)
+
+	sot, err := openSourceOfTruth(dir, "plain.csv", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := sot.hydrationInput(workspace); err != nil || got != filepath.Join(dir, "plain.csv") {
+		t.Errorf("Expected the source of truth to be hydrated as is, got: %s, %v", got, err)
+	}
+
+	sot, err = openSourceOfTruth(dir, "commented.csv", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := sot.hydrationInput(workspace)
+	if err != nil {
+		t.Fatalf("Failed to write hydration input: %v", err)
+	}
+	if data, err := os.ReadFile(got); err != nil || string(data) != content {
+		t.Errorf("Expected comment rows to be removed from %s, got: %q, %v", got, data, err)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Batching strategies.
+const (
+	// Batches of consecutive clusters.
+	batchStrategySequential = "sequential"
+	// Batches with at most a number of clusters per failure domain, e.g. region.
+	batchStrategyTopology = "topology"
+)
+
+// batchFunc groups the clusters into batches of the sizes of the schedule.
+type batchFunc func(clusters []string, schedule batchSchedule) [][]string
+
+// topologyBatches returns a batchFunc that puts at most maxPerDomain clusters having the same value of the
+// domain column of the table into a batch, e.g. so both clusters of an HA pair in a region are never updated
+// at once. Clusters with an empty domain are not constrained.
+func topologyBatches(table *sotTable, domainColumn string, maxPerDomain int) (batchFunc, error) {
+	if !slices.Contains(table.columns, domainColumn) {
+		return nil, fmt.Errorf("source of truth has no topology column %q", domainColumn)
+	}
+	domains := map[string]string{}
+	for _, c := range table.clusters {
+		domains[c.name()] = strings.TrimSpace(c.fields[domainColumn])
+	}
+	return func(clusters []string, schedule batchSchedule) [][]string {
+		return planTopologyBatches(clusters, schedule, domains, maxPerDomain)
+	}, nil
+}
+
+// planTopologyBatches groups the clusters into batches of at most the sizes of the schedule, with at most
+// maxPerDomain clusters of each domain per batch. Each batch is filled with the remaining clusters in order,
+// skipping clusters whose domain is full, so a batch can be smaller than its size.
+func planTopologyBatches(clusters []string, schedule batchSchedule, domains map[string]string, maxPerDomain int) [][]string {
+	remaining := slices.Clone(clusters)
+	var batches [][]string
+	for len(remaining) != 0 {
+		size := len(remaining)
+		if len(schedule) != 0 {
+			if n := schedule[min(len(batches), len(schedule)-1)].clusters(len(clusters)); n > 0 {
+				size = min(n, size)
+			}
+		}
+		var batch []string
+		perDomain := map[string]int{}
+		remaining = slices.DeleteFunc(remaining, func(name string) bool {
+			domain := domains[name]
+			if len(batch) == size || (len(domain) != 0 && perDomain[domain] >= maxPerDomain) {
+				return false
+			}
+			perDomain[domain]++
+			batch = append(batch, name)
+			return true
+		})
+		batches = append(batches, batch)
+	}
+	return batches
+}
@@ -0,0 +1,70 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestPlanTopologyBatches(t *testing.T) {
+	domains := map[string]string{
+		"us-a": "us", "us-b": "us",
+		"eu-a": "eu", "eu-b": "eu",
+		"asia-a": "asia", "asia-b": "asia",
+		"edge": "",
+	}
+	clusters := []string{"us-a", "us-b", "eu-a", "eu-b", "asia-a", "asia-b", "edge"}
+	testCases := []struct {
+		schedule     batchSchedule
+		maxPerDomain int
+		expected     [][]string
+	}{
+		// Both clusters of a pair are never in the same batch.
+		{batchSchedule{{n: 3}}, 1, [][]string{{"us-a", "eu-a", "asia-a"}, {"us-b", "eu-b", "asia-b"}, {"edge"}}},
+		// Batches are smaller than their size rather than touching a domain twice.
+		{batchSchedule{{n: 0}}, 1, [][]string{{"us-a", "eu-a", "asia-a", "edge"}, {"us-b", "eu-b", "asia-b"}}},
+		{batchSchedule{{n: 4}}, 2, [][]string{{"us-a", "us-b", "eu-a", "eu-b"}, {"asia-a", "asia-b", "edge"}}},
+		{batchSchedule{{n: 1}, {n: 50, percent: true}}, 1, [][]string{{"us-a"}, {"us-b", "eu-a", "asia-a", "edge"}, {"eu-b", "asia-b"}}},
+	}
+	for _, tc := range testCases {
+		got := planTopologyBatches(clusters, tc.schedule, domains, tc.maxPerDomain)
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Batches with schedule %s and at most %d per domain mismatch\nExpected: %v\n     Got: %v", tc.schedule, tc.maxPerDomain, tc.expected, got)
+		}
+	}
+	if got := planTopologyBatches(nil, batchSchedule{{n: 2}}, domains, 1); len(got) != 0 {
+		t.Errorf("Expected no batches, got: %v", got)
+	}
+}
+
+func TestTopologyBatches(t *testing.T) {
+	table := &sotTable{columns: append(slices.Clone(sotColumns), "region")}
+	for _, c := range [][]string{{"cluster1", "us"}, {"cluster2", "us"}, {"cluster3", "eu"}} {
+		table.clusters = append(table.clusters, &sotCluster{fields: map[string]string{clusterNameColumn: c[0], "region": c[1]}})
+	}
+	batch, err := topologyBatches(table, "region", 1)
+	if err != nil {
+		t.Fatalf("Failed to create topology batches: %v", err)
+	}
+	got := batch([]string{"cluster1", "cluster2", "cluster3"}, batchSchedule{{n: 2}})
+	if want := [][]string{{"cluster1", "cluster3"}, {"cluster2"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Batches mismatch\nExpected: %v\n     Got: %v", want, got)
+	}
+	if _, err := topologyBatches(table, "failure_domain", 1); err == nil {
+		t.Error("Expected error for missing topology column")
+	}
+}
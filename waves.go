@@ -0,0 +1,183 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// rolloutWavesMetadataKey is the deploy result metadata key describing the waves of the rollout, if the
+// clusters are grouped into waves.
+const rolloutWavesMetadataKey = "rollout-waves"
+
+// rolloutWave is a group of clusters rolled out before the clusters of later waves, e.g. canary clusters.
+type rolloutWave struct {
+	// Value of the wave column of the clusters, empty if the clusters are not grouped into waves.
+	name     string
+	clusters []string
+	batches  [][]string
+}
+
+// label returns the name of the wave as shown in logs and the deploy result.
+func (w *rolloutWave) label() string {
+	if len(w.name) == 0 {
+		return "wave (none)"
+	}
+	return "wave " + w.name
+}
+
+func (w *rolloutWave) String() string {
+	batches := "1 batch"
+	if len(w.batches) != 1 {
+		batches = fmt.Sprintf("%d batches", len(w.batches))
+	}
+	return fmt.Sprintf("%s: %s (%s)", w.label(), strings.Join(w.clusters, ", "), batches)
+}
+
+// formatWaves returns the waves as a semicolon separated list.
+func formatWaves(waves []*rolloutWave) string {
+	s := make([]string, len(waves))
+	for i, w := range waves {
+		s[i] = w.String()
+	}
+	return strings.Join(s, "; ")
+}
+
+// parseWaveBatchSizes parses comma separated wave batch sizes of the form "{wave}={batch size}", where the batch
+// size is a number of clusters or a percentage of the clusters of the wave.
+func parseWaveBatchSizes(value string) (map[string]batchSchedule, error) {
+	sizes := map[string]batchSchedule{}
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		wave, size, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not of the form {wave}={batch size}", s)
+		}
+		wave = strings.TrimSpace(wave)
+		schedule, err := parseBatchSchedule(size)
+		if err != nil {
+			return nil, fmt.Errorf("batch size of wave %q is not valid: %v", wave, err)
+		}
+		if _, ok := sizes[wave]; ok {
+			return nil, fmt.Errorf("duplicate batch size of wave %q", wave)
+		}
+		sizes[wave] = schedule
+	}
+	return sizes, nil
+}
+
+// compareWaves orders waves numerically if both names are integers, integers before other names, and other
+// names lexically. Clusters without a wave are rolled out last.
+func compareWaves(a, b string) int {
+	if (len(a) == 0) != (len(b) == 0) {
+		if len(a) == 0 {
+			return 1
+		}
+		return -1
+	}
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		if na != nb {
+			return na - nb
+		}
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// waveBatches returns the batches of all waves in rollout order, numbered across waves.
+func waveBatches(waves []*rolloutWave) []*rolloutBatch {
+	var batches []*rolloutBatch
+	for _, w := range waves {
+		for _, clusters := range w.batches {
+			batches = append(batches, &rolloutBatch{number: len(batches) + 1, clusters: clusters, wave: w.name})
+		}
+	}
+	for _, b := range batches {
+		b.total = len(batches)
+	}
+	return batches
+}
+
+// planWaves groups the clusters into waves by their value of the wave column of the table, and each wave into
+// batches of the wave's batch size with the batch function, defaulting to batchSize, with percentages of the
+// clusters of the wave. The clusters keep their order within a wave. All clusters are in a single wave if
+// waveColumn is empty.
+func planWaves(table *sotTable, clusters []string, waveColumn string, batchSize batchSchedule, waveBatchSizes map[string]batchSchedule, batch batchFunc) ([]*rolloutWave, error) {
+	if len(waveColumn) == 0 {
+		return []*rolloutWave{{clusters: clusters, batches: batch(clusters, batchSize)}}, nil
+	}
+	if !slices.Contains(table.columns, waveColumn) {
+		return nil, fmt.Errorf("source of truth has no wave column %q", waveColumn)
+	}
+	clusterWaves := map[string]string{}
+	for _, c := range table.clusters {
+		clusterWaves[c.name()] = strings.TrimSpace(c.fields[waveColumn])
+	}
+
+	var waves []*rolloutWave
+	for _, name := range clusters {
+		wave, ok := clusterWaves[name]
+		if !ok {
+			return nil, fmt.Errorf("cluster %q is not in the source of truth", name)
+		}
+		i := slices.IndexFunc(waves, func(w *rolloutWave) bool { return w.name == wave })
+		if i == -1 {
+			waves = append(waves, &rolloutWave{name: wave})
+			i = len(waves) - 1
+		}
+		waves[i].clusters = append(waves[i].clusters, name)
+	}
+	slices.SortFunc(waves, func(a, b *rolloutWave) int { return compareWaves(a.name, b.name) })
+	for _, w := range waves {
+		size, ok := waveBatchSizes[w.name]
+		if !ok {
+			size = batchSize
+		}
+		w.batches = batch(w.clusters, size)
+	}
+	return waves, nil
+}
+
+// planWaves returns the waves of the clusters to update and their batches planned with the batch strategy,
+// loading the source of truth if the clusters are grouped into waves or by topology.
+func (d *deployer) planWaves(sot sourceOfTruth, clusters []string) ([]*rolloutWave, error) {
+	var table *sotTable
+	if len(d.params.hydrationWaveColumn) != 0 || d.params.hydrationBatchStrategy == batchStrategyTopology {
+		var err error
+		if table, _, err = sot.load(); err != nil {
+			return nil, err
+		}
+	}
+	batch := planBatches
+	if d.params.hydrationBatchStrategy == batchStrategyTopology {
+		var err error
+		if batch, err = topologyBatches(table, d.params.hydrationTopologyColumn, d.params.hydrationMaxClustersPerDomain); err != nil {
+			return nil, err
+		}
+	}
+	return planWaves(table, clusters, d.params.hydrationWaveColumn, d.params.hydrationBatchSize, d.params.hydrationWaveBatchSizes, batch)
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestPlanWaves(t *testing.T) {
+	table := &sotTable{columns: append(slices.Clone(sotColumns), "rollout_wave")}
+	for _, c := range [][]string{
+		{"cluster1", "10"},
+		{"cluster2", "2"},
+		{"cluster3", ""},
+		{"cluster4", "canary"},
+		{"cluster5", "2"},
+		{"cluster6", "10"},
+		{"cluster7", "2"},
+	} {
+		table.clusters = append(table.clusters, &sotCluster{fields: map[string]string{clusterNameColumn: c[0], "rollout_wave": c[1]}})
+	}
+	clusters := []string{"cluster1", "cluster2", "cluster3", "cluster4", "cluster5", "cluster6", "cluster7"}
+
+	waves, err := planWaves(table, clusters, "rollout_wave", batchSchedule{{n: 2}}, map[string]batchSchedule{"10": {{n: 0}}, "canary": {{n: 1}}}, planBatches)
+	if err != nil {
+		t.Fatalf("Failed to plan waves: %v", err)
+	}
+	want := "wave 2: cluster2, cluster5, cluster7 (2 batches); " +
+		"wave 10: cluster1, cluster6 (1 batch); " +
+		"wave canary: cluster4 (1 batch); " +
+		"wave (none): cluster3 (1 batch)"
+	if got := formatWaves(waves); got != want {
+		t.Errorf("Waves mismatch\nExpected: %s\n     Got: %s", want, got)
+	}
+
+	var batches [][]string
+	for _, b := range waveBatches(waves) {
+		if b.total != 5 {
+			t.Errorf("Expected 5 batches in total, got: %d", b.total)
+		}
+		batches = append(batches, b.clusters)
+	}
+	wantBatches := [][]string{{"cluster2", "cluster5"}, {"cluster7"}, {"cluster1", "cluster6"}, {"cluster4"}, {"cluster3"}}
+	if !reflect.DeepEqual(batches, wantBatches) {
+		t.Errorf("Batches mismatch\nExpected: %v\n     Got: %v", wantBatches, batches)
+	}
+
+	// Without a wave column all clusters are in a single wave, in order.
+	schedule := batchSchedule{{n: 4}}
+	waves, err = planWaves(nil, clusters, "", schedule, nil, planBatches)
+	if err != nil {
+		t.Fatalf("Failed to plan waves: %v", err)
+	}
+	if len(waves) != 1 || !reflect.DeepEqual(waves[0].batches, planBatches(clusters, schedule)) {
+		t.Errorf("Expected a single wave with batches %v, got: %v", planBatches(clusters, schedule), formatWaves(waves))
+	}
+
+	if _, err := planWaves(table, clusters, "priority", schedule, nil, planBatches); err == nil {
+		t.Error("Expected error for missing wave column")
+	}
+	if _, err := planWaves(table, []string{"cluster8"}, "rollout_wave", schedule, nil, planBatches); err == nil {
+		t.Error("Expected error for cluster not in the source of truth")
+	}
+}
+
+func TestParseWaveBatchSizes(t *testing.T) {
+	got, err := parseWaveBatchSizes(" 1=1, canary = 50%,,3=0")
+	if err != nil {
+		t.Fatalf("Failed to parse wave batch sizes: %v", err)
+	}
+	want := map[string]batchSchedule{"1": {{n: 1}}, "canary": {{n: 50, percent: true}}, "3": {{n: 0}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wave batch sizes mismatch\nExpected: %v\n     Got: %v", want, got)
+	}
+	for _, value := range []string{"1", "1=one", "1=1,1=2"} {
+		if _, err := parseWaveBatchSizes(value); err == nil {
+			t.Errorf("Expected error parsing %q", value)
+		}
+	}
+}